@@ -0,0 +1,63 @@
+package cmd
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/cretz/takecast/pkg/preview"
+	"github.com/cretz/takecast/pkg/receiver/mirror"
+	"github.com/spf13/cobra"
+)
+
+func previewCmd() *cobra.Command {
+	var listen string
+	var constraints constraintFlags
+	cmd := applyRun(
+		&cobra.Command{
+			Use:   "preview",
+			Short: "Play the current stream live in a browser",
+		},
+		func(ctx *rootContext) error {
+			// Browsers cannot play h264 in WebM, so leave it out unless asked for
+			if len(constraints.videoCodecs) == 0 {
+				constraints.videoCodecs = []string{"av1", "vp9", "vp8"}
+			}
+			mirrorConfig := mirror.Config{Log: ctx.log}
+			var err error
+			if mirrorConfig.Constraints, err = constraints.toConstraints(); err != nil {
+				return err
+			}
+			previewServer, err := listenPreview(ctx, listen)
+			if err != nil {
+				return err
+			}
+			mirrorConfig.OnSession = previewServer.OnSession
+			return serveMirror(ctx, mirrorConfig, nil)
+		},
+	)
+	cmd.Flags().StringVar(&listen, "listen", "127.0.0.1:8080", "Address to serve the preview page on")
+	constraints.applyFlags(cmd)
+	return cmd
+}
+
+// Serves the preview page in the background until the context is done
+func listenPreview(ctx *rootContext, listen string) (*preview.Server, error) {
+	previewServer := preview.New(preview.Config{Log: ctx.log})
+	l, err := net.Listen("tcp", listen)
+	if err != nil {
+		return nil, fmt.Errorf("failed listening on %v: %w", listen, err)
+	}
+	httpServer := &http.Server{Handler: previewServer}
+	go func() {
+		if err := httpServer.Serve(l); err != http.ErrServerClosed {
+			ctx.log.Errorf("Preview server failed: %v", err)
+		}
+	}()
+	go func() {
+		<-ctx.Done()
+		httpServer.Close()
+	}()
+	ctx.log.Infof("Serving preview at http://%v", l.Addr())
+	return previewServer, nil
+}
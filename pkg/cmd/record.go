@@ -1,103 +1,580 @@
 package cmd
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
+	"image"
+	"io/ioutil"
+	"net"
 	"os"
 	"path/filepath"
+	"regexp"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"text/template"
+	"time"
 
 	"github.com/cretz/takecast/pkg/cert"
+	"github.com/cretz/takecast/pkg/execsink"
+	"github.com/cretz/takecast/pkg/preview"
+	"github.com/cretz/takecast/pkg/receiver"
+	"github.com/cretz/takecast/pkg/receiver/media"
 	"github.com/cretz/takecast/pkg/receiver/mirror"
+	"github.com/cretz/takecast/pkg/receiver/rtsp"
 	"github.com/cretz/takecast/pkg/receiver/webrtc"
 	"github.com/cretz/takecast/pkg/server"
 	"github.com/spf13/cobra"
 )
 
 func recordCmd() *cobra.Command {
-	var outFilenameTemplate string
+	var outFilenameTemplate, format, previewListen, rtspListen, execTemplate, execFormat, snapshotFormat string
+	var maxSize, retainSize, mediaDir string
+	var execRestart bool
+	var snapshotInterval, maxDuration, retainAge time.Duration
+	var constraints constraintFlags
 	cmd := applyRun(
 		&cobra.Command{
 			Use:   "record",
-			Short: "Record all incoming streams as webm",
+			Short: "Record all incoming streams as webm, mp4, ivf, or ogg",
 		},
 		func(ctx *rootContext) error {
-			// Load root CA
-			rootCA, err := cert.LoadKeyPairFromFiles(filepath.Join("ca.crt"), filepath.Join("ca.key"))
-			if err != nil {
-				return fmt.Errorf("failed loading ca.crt/ca.key, did you forget to run 'patch'? err: %w", err)
-			}
 			// Create recorder
-			rec, err := newRecorder(ctx, outFilenameTemplate)
+			rec, err := newRecorder(ctx, outFilenameTemplate, format)
 			if err != nil {
 				return err
 			}
-			// Start server listen
-			s, err := server.Listen(server.Config{RootCACert: rootCA, Log: ctx.log})
-			if err != nil {
-				return fmt.Errorf("failed starting server: %w", err)
+			rec.maxDuration, rec.retainAge = maxDuration, retainAge
+			if rec.maxSize, err = parseSize(maxSize); err != nil {
+				return err
+			} else if rec.retainSize, err = parseSize(retainSize); err != nil {
+				return err
 			}
-			defer s.Close()
-			// Register mirror application
-			if m, err := mirror.New(mirror.Config{Log: ctx.log, OnSession: rec.onSession}); err != nil {
-				return fmt.Errorf("failed creating mirror application: %w", err)
-			} else if err = s.Receiver.RegisterApplication(m); err != nil {
-				return fmt.Errorf("failed registering mirror application: %w", err)
+			if rec.retainSize > 0 || rec.retainAge > 0 {
+				go rec.runRetention()
 			}
-			// Run server in background
-			errCh := make(chan error, 1)
-			go func() { errCh <- s.Serve() }()
-			// Wait for context done or error
-			select {
-			case <-ctx.Done():
-				return nil
-			case err := <-errCh:
-				return fmt.Errorf("server failed: %w", err)
+			if snapshotInterval > 0 {
+				if !containsString(webrtc.ImageFormats, snapshotFormat) {
+					return fmt.Errorf("unrecognized snapshot format %q", snapshotFormat)
+				}
+				rec.snapshotInterval, rec.snapshotFormat = snapshotInterval, snapshotFormat
 			}
+			if previewListen != "" {
+				if rec.preview, err = listenPreview(ctx, previewListen); err != nil {
+					return err
+				}
+			}
+			if rtspListen != "" {
+				if rec.rtsp, err = listenRTSP(ctx, rtspListen); err != nil {
+					return err
+				}
+			}
+			if execTemplate != "" {
+				rec.exec, err = execsink.New(execsink.Config{
+					Log:             ctx.log,
+					CommandTemplate: execTemplate,
+					Format:          execFormat,
+					Restart:         execRestart,
+				})
+				if err != nil {
+					return err
+				}
+			}
+			mirrorConfig := mirror.Config{Log: ctx.log, OnSession: rec.onSession}
+			if mirrorConfig.Constraints, err = constraints.toConstraints(); err != nil {
+				return err
+			}
+			return serveMirror(ctx, mirrorConfig, func(recv receiver.Receiver) error {
+				rec.watchVolume(recv)
+				// Also accept media cast to the Default Media Receiver, playing it with the
+				// simulated player and only downloading it if a dir is set
+				if mediaDir != "" {
+					if err := os.MkdirAll(mediaDir, 0755); err != nil {
+						return fmt.Errorf("failed creating media dir: %w", err)
+					}
+				}
+				m, err := media.New(media.Config{Log: ctx.log, DownloadDir: mediaDir})
+				if err != nil {
+					return fmt.Errorf("failed creating media application: %w", err)
+				} else if err = recv.RegisterApplication(m); err != nil {
+					return fmt.Errorf("failed registering media application: %w", err)
+				}
+				return nil
+			})
 		},
 	)
 	cmd.Flags().StringVarP(&outFilenameTemplate, "out-filename-template", "o",
-		"./stream-{{.Index}}.webm", "Template to create filename to save each stream as")
+		"./stream-{{.Index}}.{{.Ext}}", "Template to create filename to save each stream as. Available values are "+
+			".Index, .Part, .Ext, .SessionID, .UserAgent, .AppID, and .StartTime (a time.Time). Characters other than "+
+			"letters, digits, '.', '_', and '-' are replaced with '_' in string values. If splitting and the "+
+			"template does not use .Part, parts after the first have -PART added before the extension. Session "+
+			"metadata and events are written next to the first part as JSON.")
+	cmd.Flags().DurationVar(&maxDuration, "max-duration", 0,
+		"If set, split recordings into parts at the next key frame after this long")
+	cmd.Flags().StringVar(&maxSize, "max-size", "",
+		"If set, split recordings into parts at the next key frame after this size, e.g. 500MB")
+	cmd.Flags().StringVar(&retainSize, "retain-size", "",
+		"If set, delete the oldest recordings, snapshots, and metadata written by the recorder past this total "+
+			"size, e.g. 10GB. Other files are never deleted. Written files are listed in "+retentionManifestName+
+			" in the template's directory so ones from earlier runs are included.")
+	cmd.Flags().DurationVar(&retainAge, "retain-age", 0,
+		"If set, delete recordings, snapshots, and metadata written by the recorder older than this, e.g. 168h. "+
+			"Like --retain-size, earlier runs' files are included.")
+	cmd.Flags().StringVar(&format, "format", "",
+		"Output format, webm, mp4 (h264 only), ivf (video only), or ogg (audio only). Default is ogg for "+
+			"audio-only sessions, mp4 for h264 sessions, and webm otherwise.")
+	cmd.Flags().DurationVar(&snapshotInterval, "snapshot-interval", 0,
+		"If set, also save a snapshot image of the video next to the recording at most this often, e.g. 10s. "+
+			"Snapshots are only available for vp8 sessions.")
+	cmd.Flags().StringVar(&snapshotFormat, "snapshot-format", "png", "Snapshot image format, png or jpeg")
+	cmd.Flags().StringVar(&previewListen, "preview-listen", "",
+		"Address to also serve a live preview page on, e.g. 127.0.0.1:8080. The preview is only available for "+
+			"non-h264 sessions.")
+	cmd.Flags().StringVar(&rtspListen, "rtsp-listen", "",
+		"Address to also serve the stream over RTSP on, e.g. 0.0.0.0:8554. Any path can be used.")
+	cmd.Flags().StringVar(&execTemplate, "exec", "",
+		"Template for a command to also run for each stream with the stream piped to its stdin, e.g. "+
+			"'ffmpeg -f {{.Ext}} -i - out-{{.Index}}.mkv'. Quotes group arguments.")
+	cmd.Flags().StringVar(&execFormat, "exec-format", "",
+		"Format piped to the --exec command, same values and default as --format")
+	cmd.Flags().BoolVar(&execRestart, "exec-restart", false,
+		"Restart the --exec command if it exits while the stream is still running")
+	cmd.Flags().StringVar(&mediaDir, "media-dir", "",
+		"If set, media cast to the Default Media Receiver is also downloaded into this directory")
+	constraints.applyFlags(cmd)
 	return cmd
 }
 
+type constraintFlags struct {
+	maxResolution   string
+	maxFrameRate    float64
+	maxVideoBitRate int
+	maxAudioBitRate int
+	maxDelay        time.Duration
+	aspectRatio     string
+	audioCodecs     []string
+	videoCodecs     []string
+}
+
+func (c *constraintFlags) applyFlags(cmd *cobra.Command) {
+	cmd.Flags().StringVar(&c.maxResolution, "max-resolution", "", "Max video resolution as WIDTHxHEIGHT, e.g. 1280x720")
+	cmd.Flags().Float64Var(&c.maxFrameRate, "max-frame-rate", 0, "Max video frames per second")
+	cmd.Flags().IntVar(&c.maxVideoBitRate, "max-video-bit-rate", 0, "Max video bits per second")
+	cmd.Flags().IntVar(&c.maxAudioBitRate, "max-audio-bit-rate", 0, "Max audio bits per second")
+	cmd.Flags().DurationVar(&c.maxDelay, "max-delay", 0, "Max playout delay")
+	cmd.Flags().StringVar(&c.aspectRatio, "aspect-ratio", "", "Display aspect ratio, e.g. 16:9")
+	cmd.Flags().StringSliceVar(&c.audioCodecs, "audio-codecs", nil,
+		"Audio codecs in order of preference. Default: "+strings.Join(webrtc.SupportedAudioCodecs, ","))
+	cmd.Flags().StringSliceVar(&c.videoCodecs, "video-codecs", nil,
+		"Video codecs in order of preference. Default: "+strings.Join(webrtc.SupportedVideoCodecs, ","))
+}
+
+func (c *constraintFlags) toConstraints() (webrtc.Constraints, error) {
+	ret := webrtc.Constraints{
+		MaxFrameRate:    c.maxFrameRate,
+		MaxVideoBitRate: c.maxVideoBitRate,
+		MaxAudioBitRate: c.maxAudioBitRate,
+		MaxDelay:        c.maxDelay,
+		AspectRatio:     c.aspectRatio,
+		AudioCodecs:     c.audioCodecs,
+		VideoCodecs:     c.videoCodecs,
+	}
+	for _, codec := range c.audioCodecs {
+		if !containsString(webrtc.SupportedAudioCodecs, codec) {
+			return ret, fmt.Errorf("unsupported audio codec %q", codec)
+		}
+	}
+	for _, codec := range c.videoCodecs {
+		if !containsString(webrtc.SupportedVideoCodecs, codec) {
+			return ret, fmt.Errorf("unsupported video codec %q", codec)
+		}
+	}
+	if c.maxResolution != "" {
+		if _, err := fmt.Sscanf(c.maxResolution, "%dx%d", &ret.MaxWidth, &ret.MaxHeight); err != nil {
+			return ret, fmt.Errorf("invalid max resolution %q: %w", c.maxResolution, err)
+		}
+	}
+	return ret, nil
+}
+
 type recorder struct {
 	*rootContext
 	filenameTemplate *template.Template
-	sessionCounter   int32
+	// Whether the template uses .Part
+	templateHasPart bool
+	// The directory of the template before any values, which filenames must be
+	// under
+	filenameDir string
+	// Empty means choose per session
+	format         string
+	sessionCounter int32
+	// Zero if not splitting on that limit
+	maxDuration time.Duration
+	maxSize     int64
+	// Zero if not deleting on that limit
+	retainSize int64
+	retainAge  time.Duration
+	// Zero if not saving snapshots
+	snapshotInterval time.Duration
+	snapshotFormat   string
+	// Nil if not previewing
+	preview *preview.Server
+	// Nil if not publishing over RTSP
+	rtsp *rtsp.Server
+	// Nil if not running a command per session
+	exec *execsink.Sink
+
+	filesLock sync.Mutex // Governs fields below
+	// Absolute paths of recordings being written
+	activeFiles map[string]struct{}
+	// Absolute paths of recordings, snapshots, and sidecars written by this and
+	// earlier runs, the only files retention deletes
+	writtenFiles map[string]struct{}
+
+	liveLock sync.Mutex // Governs fields below
+	// Sessions being recorded, for volume events
+	live map[*webrtc.Session]struct{}
 }
 
-func newRecorder(ctx *rootContext, filenameTemplate string) (*recorder, error) {
+func newRecorder(ctx *rootContext, filenameTemplate string, format string) (*recorder, error) {
 	tmpl, err := template.New("out").Parse(filenameTemplate)
 	if err != nil {
 		return nil, fmt.Errorf("failed parsing out filename template: %w", err)
 	}
-	return &recorder{rootContext: ctx, filenameTemplate: tmpl}, nil
+	if format != "" && !containsString(webrtc.SaveFormats, format) {
+		return nil, fmt.Errorf("unrecognized format %q", format)
+	}
+	// The part of the template before any actions can't be changed by values
+	filenameDir := filenameTemplate
+	if i := strings.Index(filenameDir, "{{"); i >= 0 {
+		filenameDir = filenameDir[:i]
+	}
+	filenameDir = filepath.Dir(filenameDir)
+	// Check whether different parts get different names using sample values
+	sample := filenameData(1, "webm", "session", "agent", "app", time.Now())
+	partNames := make([]string, 2)
+	for i := range partNames {
+		sample["Part"] = i + 1
+		var b strings.Builder
+		if err := tmpl.Execute(&b, sample); err != nil {
+			return nil, fmt.Errorf("failed executing out filename template: %w", err)
+		}
+		partNames[i] = b.String()
+	}
+	r := &recorder{
+		rootContext:      ctx,
+		filenameTemplate: tmpl,
+		templateHasPart:  partNames[0] != partNames[1],
+		filenameDir:      filenameDir,
+		format:           format,
+		activeFiles:      map[string]struct{}{},
+		writtenFiles:     map[string]struct{}{},
+		live:             map[*webrtc.Session]struct{}{},
+	}
+	if err := r.loadManifest(); err != nil {
+		return nil, err
+	}
+	return r, nil
 }
 
 func (r *recorder) onSession(s *webrtc.Session) {
+	// Share the session frames between the recording, preview, RTSP, and exec.
+	// All drop video until the next key frame if they fall behind so it stays
+	// decodable.
+	b := webrtc.NewBroadcaster(s, webrtc.FrameBufferConfig{Log: r.log})
+	frames := b.Subscribe(webrtc.SubscriberConfig{QueueSize: 1024, DropPolicy: webrtc.DropPolicyUntilKeyFrame})
+	var snapshotFrames *webrtc.Subscriber
+	if r.snapshotInterval > 0 && s.Video != nil {
+		if s.Video.CodecName == "vp8" {
+			snapshotFrames = b.Subscribe(webrtc.SubscriberConfig{DropPolicy: webrtc.DropPolicyUntilKeyFrame})
+		} else {
+			r.log.Warnf("Cannot save snapshots of session %v: expected vp8 video codec, got %v", s.ID, s.Video.CodecName)
+		}
+	}
 	// Run it async
 	go func() {
-		if err := r.runSession(s); err != nil {
+		if err := r.runSession(s, frames, snapshotFrames); err != nil {
 			r.log.Warnf("recorder failure: %v", err)
 		}
 	}()
+	if r.preview != nil {
+		r.preview.Preview(s, b.Subscribe(webrtc.SubscriberConfig{DropPolicy: webrtc.DropPolicyUntilKeyFrame}))
+	}
+	if r.rtsp != nil {
+		r.rtsp.Publish(s, b.Subscribe(webrtc.SubscriberConfig{DropPolicy: webrtc.DropPolicyUntilKeyFrame}))
+	}
+	if r.exec != nil {
+		execFrames := b.Subscribe(webrtc.SubscriberConfig{QueueSize: 1024, DropPolicy: webrtc.DropPolicyUntilKeyFrame})
+		go func() {
+			defer execFrames.Close()
+			if err := r.exec.Run(r, s, execFrames); err != nil {
+				r.log.Warnf("exec failure: %v", err)
+			}
+		}()
+	}
+	go func() {
+		err := b.Run()
+		r.log.Debugf("Session %v ended: %v", s.ID, err)
+	}()
 }
 
-func (r *recorder) runSession(s *webrtc.Session) error {
-	var filename strings.Builder
-	err := r.filenameTemplate.Execute(&filename, map[string]interface{}{
-		"Index": atomic.AddInt32(&r.sessionCounter, 1),
+// Records the session, split into parts if limits are set. Snapshot frames
+// are nil if not saving snapshots.
+func (r *recorder) runSession(s *webrtc.Session, frames, snapshotFrames *webrtc.Subscriber) error {
+	defer frames.Close()
+	if snapshotFrames != nil {
+		defer snapshotFrames.Close()
+	}
+	format := r.format
+	if format == "" {
+		format = webrtc.DefaultSaveFormat(s)
+	}
+	userAgent := ""
+	if s.ConnectionInfo != nil {
+		userAgent = s.ConnectionInfo.UserAgent
+	}
+	data := filenameData(atomic.AddInt32(&r.sessionCounter, 1), format, s.ID, userAgent, s.AppID, time.Now())
+	r.liveLock.Lock()
+	r.live[s] = struct{}{}
+	r.liveLock.Unlock()
+	defer func() {
+		r.liveLock.Lock()
+		delete(r.live, s)
+		r.liveLock.Unlock()
+	}()
+	sidecar := &recordingSidecar{StartTime: time.Now()}
+	var sidecarFilename string
+	defer func() {
+		if sidecarFilename != "" {
+			sidecar.EndTime = time.Now()
+			r.writeSidecar(sidecarFilename, sidecar, s)
+		}
+	}()
+	parts := &partReader{frames: frames, session: s, maxDuration: r.maxDuration, maxSize: r.maxSize}
+	for part := 1; ; part++ {
+		data["Part"] = part
+		filename, err := r.filename(data, part)
+		if err != nil {
+			return err
+		}
+		// Create/overwrite file
+		r.log.Infof("Recording stream to %v", filename)
+		w, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			return fmt.Errorf("failed creating file at %v: %w", filename, err)
+		}
+		r.setFileActive(filename, true)
+		r.enforceRetention()
+		// The sidecar is next to the first part and rewritten for each part
+		if part == 1 {
+			sidecarFilename = strings.TrimSuffix(filename, filepath.Ext(filename)) + ".json"
+		}
+		sidecar.Recordings = append(sidecar.Recordings, filename)
+		r.writeSidecar(sidecarFilename, sidecar, s)
+		if part == 1 && snapshotFrames != nil {
+			go func() {
+				if err := r.saveSnapshots(s, snapshotFrames, filename); err != nil {
+					r.log.Debugf("Snapshots of session %v ended: %v", s.ID, err)
+				}
+			}()
+		}
+		err = webrtc.SaveFrames(r, format, parts.startPart(w), s, parts)
+		r.setFileActive(filename, false)
+		if !errors.Is(err, errPartDone) {
+			return err
+		}
+	}
+}
+
+// JSON written next to recordings
+type recordingSidecar struct {
+	*webrtc.SessionInfo
+	StartTime time.Time `json:"startTime"`
+	// Zero while recording
+	EndTime    time.Time `json:"endTime"`
+	Recordings []string  `json:"recordings"`
+}
+
+// Failures are only logged
+func (r *recorder) writeSidecar(filename string, sidecar *recordingSidecar, s *webrtc.Session) {
+	sidecar.SessionInfo = s.Info()
+	b, err := json.MarshalIndent(sidecar, "", "  ")
+	if err == nil {
+		err = ioutil.WriteFile(filename, b, 0600)
+	}
+	r.setFileWritten(filename)
+	if err != nil {
+		r.log.Warnf("Failed writing session metadata to %v: %v", filename, err)
+	}
+}
+
+// Adds volume events to sessions being recorded as the receiver volume changes
+func (r *recorder) watchVolume(recv receiver.Receiver) {
+	statusCh := make(chan *receiver.ReceiverStatus, 10)
+	recv.AddStatusListener(statusCh)
+	last := recv.Status().Volume
+	go func() {
+		defer recv.RemoveStatusListener(statusCh)
+		for {
+			select {
+			case <-r.Done():
+				return
+			case status := <-statusCh:
+				vol := status.Volume
+				if vol == nil || (last != nil && *vol == *last) {
+					continue
+				}
+				last = vol
+				level, muted := vol.Level, vol.Muted
+				r.liveLock.Lock()
+				for s := range r.live {
+					s.AddEvent(webrtc.Event{Type: webrtc.EventVolume, Level: &level, Muted: &muted})
+				}
+				r.liveLock.Unlock()
+			}
+		}
+	}()
+}
+
+var unsafeFilenameChars = regexp.MustCompile(`[^a-zA-Z0-9._-]`)
+
+func sanitizeFilename(name string) string { return unsafeFilenameChars.ReplaceAllString(name, "_") }
+
+// Values for the filename template. The string values come from the sender so
+// they are sanitized.
+func filenameData(index int32, ext, sessionID, userAgent, appID string, startTime time.Time) map[string]interface{} {
+	return map[string]interface{}{
+		"Index":     index,
+		"Ext":       ext,
+		"SessionID": sanitizeFilename(sessionID),
+		"UserAgent": sanitizeFilename(userAgent),
+		"AppID":     sanitizeFilename(appID),
+		"StartTime": startTime,
+	}
+}
+
+// Fails if the filename is not under the template's directory
+func (r *recorder) filename(data map[string]interface{}, part int) (string, error) {
+	var b strings.Builder
+	if err := r.filenameTemplate.Execute(&b, data); err != nil {
+		return "", fmt.Errorf("failed executing filename template: %w", err)
+	}
+	filename := b.String()
+	if part > 1 && !r.templateHasPart {
+		ext := filepath.Ext(filename)
+		filename = fmt.Sprintf("%v-%v%v", strings.TrimSuffix(filename, ext), part, ext)
+	}
+	// Values like ".." are still possible after sanitizing
+	if !isUnderDir(r.filenameDir, filename) {
+		return "", fmt.Errorf("filename %v is outside of %v", filename, r.filenameDir)
+	}
+	return filename, nil
+}
+
+// Applies the retention policy every minute until the context is done, since
+// files can age out between recordings
+func (r *recorder) runRetention() {
+	t := time.NewTicker(time.Minute)
+	defer t.Stop()
+	for {
+		select {
+		case <-r.Done():
+			return
+		case <-t.C:
+			r.enforceRetention()
+		}
+	}
+}
+
+// Saves snapshots as the recording filename without its extension plus a
+// counter
+func (r *recorder) saveSnapshots(s *webrtc.Session, frames *webrtc.Subscriber, recordingFilename string) error {
+	base := strings.TrimSuffix(recordingFilename, filepath.Ext(recordingFilename))
+	index := 0
+	return webrtc.SaveSnapshots(r, s, frames, webrtc.SnapshotConfig{
+		Interval: r.snapshotInterval,
+		OnSnapshot: func(img image.Image, timestamp time.Duration) error {
+			index++
+			filename := fmt.Sprintf("%v-%04d.%v", base, index, r.snapshotFormat)
+			r.log.Debugf("Saving snapshot at %v to %v", timestamp, filename)
+			f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+			if err != nil {
+				return fmt.Errorf("failed creating file at %v: %w", filename, err)
+			}
+			r.setFileWritten(filename)
+			defer f.Close()
+			if err := webrtc.EncodeImage(f, img, r.snapshotFormat); err != nil {
+				return fmt.Errorf("failed writing snapshot to %v: %w", filename, err)
+			}
+			return f.Close()
+		},
 	})
+}
+
+// Runs the cast server with the mirror application until the context is done.
+// If set, onReceiver is called with the receiver before serving, e.g. to
+// register more applications.
+func serveMirror(ctx *rootContext, mirrorConfig mirror.Config, onReceiver func(receiver.Receiver) error) error {
+	// Load root CA
+	rootCA, err := cert.LoadKeyPairFromFiles(filepath.Join(ctx.certDir, "ca.crt"), filepath.Join(ctx.certDir, "ca.key"))
+	if err != nil {
+		return fmt.Errorf("failed loading ca.crt/ca.key, did you forget to run 'patch'? err: %w", err)
+	}
+	// Start server listen
+	s, err := server.Listen(server.Config{RootCACert: rootCA, Log: ctx.log})
 	if err != nil {
-		return fmt.Errorf("failed executing filename template: %w", err)
+		return fmt.Errorf("failed starting server: %w", err)
+	}
+	defer s.Close()
+	// Register mirror application
+	if m, err := mirror.New(mirrorConfig); err != nil {
+		return fmt.Errorf("failed creating mirror application: %w", err)
+	} else if err = s.Receiver.RegisterApplication(m); err != nil {
+		return fmt.Errorf("failed registering mirror application: %w", err)
+	}
+	if onReceiver != nil {
+		if err := onReceiver(s.Receiver); err != nil {
+			return err
+		}
+	}
+	// Run server in background
+	errCh := make(chan error, 1)
+	go func() { errCh <- s.Serve() }()
+	// Wait for context done or error
+	select {
+	case <-ctx.Done():
+		return nil
+	case err := <-errCh:
+		return fmt.Errorf("server failed: %w", err)
 	}
-	// Create/overwrite file
-	r.log.Infof("Recording new stream to %v", filename)
-	w, err := os.OpenFile(filename.String(), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+}
+
+// Serves RTSP in the background until the context is done
+func listenRTSP(ctx *rootContext, listen string) (*rtsp.Server, error) {
+	rtspServer := rtsp.New(rtsp.Config{Log: ctx.log})
+	l, err := net.Listen("tcp", listen)
 	if err != nil {
-		return fmt.Errorf("failed creating file at %v: %w", filename, err)
+		return nil, fmt.Errorf("failed listening on %v: %w", listen, err)
+	}
+	go func() {
+		if err := rtspServer.Serve(l); err != rtsp.ErrServerClosed {
+			ctx.log.Errorf("RTSP server failed: %v", err)
+		}
+	}()
+	go func() {
+		<-ctx.Done()
+		rtspServer.Close()
+	}()
+	ctx.log.Infof("Serving RTSP at rtsp://%v/", l.Addr())
+	return rtspServer, nil
+}
+
+func containsString(strs []string, str string) bool {
+	for _, s := range strs {
+		if s == str {
+			return true
+		}
 	}
-	return webrtc.SaveSessionToWebM(r, w, s)
+	return false
 }
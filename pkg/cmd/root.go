@@ -17,7 +17,7 @@ func Root() *cobra.Command {
 	}
 	cmd.PersistentFlags().StringP("cert-dir", "d", ".", "Dir to load/create ca.crt and ca.key")
 	cmd.PersistentFlags().StringP("log-level", "l", "info", "Log level (debug, info, warn, error, or off)")
-	cmd.AddCommand(patchCmd(), recordCmd(), unpatchCmd())
+	cmd.AddCommand(patchCmd(), previewCmd(), recordCmd(), serveHLSCmd(), unpatchCmd())
 	return cmd
 }
 
@@ -0,0 +1,260 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/cretz/takecast/pkg/receiver/webrtc"
+)
+
+// Returned by partReader when the current part should end
+var errPartDone = errors.New("part done")
+
+// Reads frames for one recording part at a time. Once a limit is reached, the
+// next split point (video key frame, or any frame if audio only) fails with
+// errPartDone and is held as the first frame of the next part.
+type partReader struct {
+	frames      webrtc.FrameReader
+	session     *webrtc.Session
+	maxDuration time.Duration
+	maxSize     int64
+
+	// Reset per part
+	written           *countingWriter
+	start             time.Duration
+	hasStart          bool
+	keyFrameRequested bool
+	// Held over from the previous part
+	pending *webrtc.Frame
+}
+
+// Starts a new part, returning the writer to use for it
+func (p *partReader) startPart(w io.WriteCloser) io.WriteCloser {
+	p.written = &countingWriter{WriteCloser: w}
+	p.hasStart, p.keyFrameRequested = false, false
+	return p.written
+}
+
+func (p *partReader) Read(f *webrtc.Frame) error {
+	if p.pending != nil {
+		*f, p.pending = *p.pending, nil
+	} else if err := p.frames.Read(f); err != nil {
+		return err
+	}
+	if !p.hasStart {
+		p.start, p.hasStart = f.Timestamp, true
+		return nil
+	}
+	full := (p.maxDuration > 0 && f.Timestamp-p.start >= p.maxDuration) ||
+		(p.maxSize > 0 && atomic.LoadInt64(&p.written.n) >= p.maxSize)
+	if !full {
+		return nil
+	}
+	if p.session.Video == nil || (f.KeyFrame && !f.Audio) {
+		held := *f
+		p.pending = &held
+		return errPartDone
+	}
+	// Ask for a key frame once instead of waiting for the next natural one
+	if !p.keyFrameRequested {
+		p.keyFrameRequested = true
+		p.session.RequestKeyFrame()
+	}
+	return nil
+}
+
+type countingWriter struct {
+	io.WriteCloser
+	// Accessed atomically
+	n int64
+}
+
+func (c *countingWriter) Write(b []byte) (int, error) {
+	n, err := c.WriteCloser.Write(b)
+	atomic.AddInt64(&c.n, int64(n))
+	return n, err
+}
+
+// Parses a byte size such as 1024, 500MB, or 2GB. Suffixes are multiples of
+// 1024. Empty is 0.
+func parseSize(s string) (int64, error) {
+	str := strings.ToUpper(strings.TrimSpace(s))
+	if str == "" {
+		return 0, nil
+	}
+	mult := int64(1)
+	for i, suffix := range []string{"KB", "MB", "GB", "TB"} {
+		if strings.HasSuffix(str, suffix) {
+			mult = 1 << (10 * (i + 1))
+			str = strings.TrimSpace(strings.TrimSuffix(str, suffix))
+			break
+		}
+	}
+	str = strings.TrimSuffix(str, "B")
+	n, err := strconv.ParseInt(str, 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", s)
+	}
+	return n * mult, nil
+}
+
+// Name of the file in the template's directory that lists the files written by
+// the recorder, one absolute path per line, so retention also covers files from
+// earlier runs
+const retentionManifestName = ".takecast-files"
+
+// Deletes files past the retention limits. Only recordings, snapshots, and
+// sidecars written by this or earlier recorders are considered and files still
+// being written are never deleted, though they count towards the total size.
+func (r *recorder) enforceRetention() {
+	if r.retainSize <= 0 && r.retainAge <= 0 {
+		return
+	}
+	r.filesLock.Lock()
+	defer r.filesLock.Unlock()
+	var files []os.FileInfo
+	var paths []string
+	removed := false
+	for path := range r.writtenFiles {
+		info, err := os.Stat(path)
+		if os.IsNotExist(err) {
+			// Removed by someone else
+			delete(r.writtenFiles, path)
+			removed = true
+			continue
+		} else if err != nil {
+			r.log.Warnf("Failed reading %v for retention: %v", path, err)
+			continue
+		} else if info.Mode().IsRegular() {
+			files = append(files, info)
+			paths = append(paths, path)
+		}
+	}
+	// Oldest first
+	indices := make([]int, len(files))
+	var total int64
+	for i := range indices {
+		indices[i] = i
+		total += files[i].Size()
+	}
+	sort.Slice(indices, func(i, j int) bool { return files[indices[i]].ModTime().Before(files[indices[j]].ModTime()) })
+	now := time.Now()
+	for _, i := range indices {
+		tooOld := r.retainAge > 0 && now.Sub(files[i].ModTime()) > r.retainAge
+		tooBig := r.retainSize > 0 && total > r.retainSize
+		if !tooOld && !tooBig {
+			break
+		} else if _, active := r.activeFiles[paths[i]]; active {
+			continue
+		}
+		r.log.Infof("Deleting %v per retention policy", paths[i])
+		if err := os.Remove(paths[i]); err != nil {
+			r.log.Warnf("Failed deleting %v: %v", paths[i], err)
+			continue
+		}
+		delete(r.writtenFiles, paths[i])
+		removed = true
+		total -= files[i].Size()
+	}
+	if removed {
+		r.writeManifestUnlocked()
+	}
+}
+
+// Marks the recording as being written, or not, and tracks it for retention
+func (r *recorder) setFileActive(filename string, active bool) {
+	path := absPath(filename)
+	r.filesLock.Lock()
+	defer r.filesLock.Unlock()
+	if active {
+		r.activeFiles[path] = struct{}{}
+		r.addWrittenFileUnlocked(path)
+	} else {
+		delete(r.activeFiles, path)
+	}
+}
+
+// Tracks the snapshot or sidecar for retention
+func (r *recorder) setFileWritten(filename string) {
+	path := absPath(filename)
+	r.filesLock.Lock()
+	defer r.filesLock.Unlock()
+	r.addWrittenFileUnlocked(path)
+}
+
+func (r *recorder) addWrittenFileUnlocked(path string) {
+	if _, ok := r.writtenFiles[path]; ok {
+		return
+	}
+	r.writtenFiles[path] = struct{}{}
+	f, err := os.OpenFile(r.manifestPath(), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err == nil {
+		_, err = f.WriteString(path + "\n")
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if err != nil {
+		r.log.Warnf("Failed adding %v to %v: %v", path, r.manifestPath(), err)
+	}
+}
+
+// Rewrites the manifest with the files still tracked. Failures are only logged.
+func (r *recorder) writeManifestUnlocked() {
+	paths := make([]string, 0, len(r.writtenFiles))
+	for path := range r.writtenFiles {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	var b strings.Builder
+	for _, path := range paths {
+		b.WriteString(path + "\n")
+	}
+	if err := ioutil.WriteFile(r.manifestPath(), []byte(b.String()), 0600); err != nil {
+		r.log.Warnf("Failed writing %v: %v", r.manifestPath(), err)
+	}
+}
+
+// Tracks the files listed in the manifest by earlier runs. Paths outside of the
+// template's directory are ignored so a bad manifest can't delete other files.
+func (r *recorder) loadManifest() error {
+	b, err := ioutil.ReadFile(r.manifestPath())
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("failed reading %v: %w", r.manifestPath(), err)
+	}
+	dir := absPath(r.filenameDir)
+	r.filesLock.Lock()
+	defer r.filesLock.Unlock()
+	for _, path := range strings.Split(string(b), "\n") {
+		if path = strings.TrimSpace(path); path != "" && filepath.IsAbs(path) && isUnderDir(dir, path) {
+			r.writtenFiles[path] = struct{}{}
+		}
+	}
+	return nil
+}
+
+func (r *recorder) manifestPath() string { return filepath.Join(r.filenameDir, retentionManifestName) }
+
+func absPath(filename string) string {
+	if path, err := filepath.Abs(filename); err == nil {
+		return path
+	}
+	return filename
+}
+
+// Whether the path is the directory or under it
+func isUnderDir(dir, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
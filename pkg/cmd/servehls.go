@@ -0,0 +1,68 @@
+package cmd
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/cretz/takecast/pkg/hls"
+	"github.com/cretz/takecast/pkg/receiver/mirror"
+	"github.com/spf13/cobra"
+)
+
+func serveHLSCmd() *cobra.Command {
+	var listen string
+	var hlsConfig hls.Config
+	var lowLatency bool
+	var constraints constraintFlags
+	cmd := applyRun(
+		&cobra.Command{
+			Use:   "serve-hls",
+			Short: "Serve the current stream as live HLS",
+		},
+		func(ctx *rootContext) error {
+			// Segments are fragmented MP4 which only supports h264 here
+			if len(constraints.videoCodecs) == 0 {
+				constraints.videoCodecs = []string{"h264"}
+			}
+			mirrorConfig := mirror.Config{Log: ctx.log}
+			var err error
+			if mirrorConfig.Constraints, err = constraints.toConstraints(); err != nil {
+				return err
+			}
+			hlsConfig.Log = ctx.log
+			if lowLatency && hlsConfig.PartDuration == 0 {
+				hlsConfig.PartDuration = 500 * time.Millisecond
+			} else if !lowLatency {
+				hlsConfig.PartDuration = 0
+			}
+			hlsServer := hls.New(hlsConfig)
+			mirrorConfig.OnSession = hlsServer.OnSession
+			// Start HTTP server
+			l, err := net.Listen("tcp", listen)
+			if err != nil {
+				return fmt.Errorf("failed listening on %v: %w", listen, err)
+			}
+			httpServer := &http.Server{Handler: hlsServer}
+			go func() {
+				if err := httpServer.Serve(l); err != http.ErrServerClosed {
+					ctx.log.Errorf("HLS server failed: %v", err)
+				}
+			}()
+			defer httpServer.Close()
+			ctx.log.Infof("Serving HLS at http://%v/index.m3u8", l.Addr())
+			return serveMirror(ctx, mirrorConfig, nil)
+		},
+	)
+	cmd.Flags().StringVar(&listen, "listen", "0.0.0.0:8080", "Address to serve HLS on")
+	cmd.Flags().DurationVar(&hlsConfig.SegmentDuration, "segment-duration", hls.DefaultSegmentDuration,
+		"Target segment duration")
+	cmd.Flags().IntVar(&hlsConfig.PlaylistSegments, "playlist-segments", hls.DefaultPlaylistSegments,
+		"Number of segments kept in the playlist")
+	cmd.Flags().BoolVar(&lowLatency, "low-latency", false, "Use Low-Latency HLS partial segments")
+	cmd.Flags().DurationVar(&hlsConfig.PartDuration, "part-duration", 0,
+		"Partial segment duration with --low-latency. Default 500ms.")
+	constraints.applyFlags(cmd)
+	return cmd
+}
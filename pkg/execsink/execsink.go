@@ -0,0 +1,242 @@
+package execsink
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"text/template"
+	"time"
+	"unicode"
+
+	"github.com/cretz/takecast/pkg/receiver"
+	"github.com/cretz/takecast/pkg/receiver/webrtc"
+)
+
+const (
+	DefaultRestartDelay = time.Second
+	DefaultStopTimeout  = 5 * time.Second
+	// Longer stderr lines are logged in pieces
+	maxStderrLine = 4096
+)
+
+// Sink runs a command per session and streams the session to its stdin
+type Sink struct {
+	Config
+	tmpl           *template.Template
+	sessionCounter int32
+}
+
+type Config struct {
+	Log receiver.Log
+	// Template for the command line, executed per session with Index, SessionID,
+	// and Ext (the format). The result is split into arguments on whitespace,
+	// where single or double quotes group an argument.
+	CommandTemplate string
+	// One of webrtc.SaveFormats. If empty, webrtc.DefaultSaveFormat is used per
+	// session.
+	Format string
+	// Whether to start the command again if it exits while the session is still
+	// running
+	Restart bool
+	// Wait before restarting. Default is DefaultRestartDelay.
+	RestartDelay time.Duration
+	// How long to wait for the command to exit after its stdin is closed before
+	// killing it. Default is DefaultStopTimeout.
+	StopTimeout time.Duration
+}
+
+func New(config Config) (*Sink, error) {
+	s := &Sink{Config: config}
+	if s.Log == nil {
+		s.Log = receiver.NopLog()
+	}
+	if s.RestartDelay <= 0 {
+		s.RestartDelay = DefaultRestartDelay
+	}
+	if s.StopTimeout <= 0 {
+		s.StopTimeout = DefaultStopTimeout
+	}
+	if s.Format != "" && !containsString(webrtc.SaveFormats, s.Format) {
+		return nil, fmt.Errorf("unrecognized format %q", s.Format)
+	}
+	var err error
+	if s.tmpl, err = template.New("command").Parse(s.CommandTemplate); err != nil {
+		return nil, fmt.Errorf("failed parsing command template: %w", err)
+	}
+	return s, nil
+}
+
+// Runs the command for the session, streaming the frames to it until they end
+// or the context is done. Then the command's stdin is closed and it is given
+// StopTimeout to exit. The frames are not closed.
+func (s *Sink) Run(ctx context.Context, sess *webrtc.Session, frames webrtc.FrameReader) error {
+	format := s.Format
+	if format == "" {
+		format = webrtc.DefaultSaveFormat(sess)
+	}
+	var command strings.Builder
+	err := s.tmpl.Execute(&command, map[string]interface{}{
+		"Index":     atomic.AddInt32(&s.sessionCounter, 1),
+		"SessionID": sess.ID,
+		"Ext":       format,
+	})
+	if err != nil {
+		return fmt.Errorf("failed executing command template: %w", err)
+	}
+	args, err := splitArgs(command.String())
+	if err != nil {
+		return err
+	} else if len(args) == 0 {
+		return fmt.Errorf("empty command")
+	}
+	for {
+		s.Log.Infof("Starting %v for session %v", args, sess.ID)
+		exited, err := s.runOnce(ctx, sess, frames, format, args)
+		if !exited || !s.Restart {
+			return err
+		}
+		s.Log.Warnf("Command %v exited early (%v), restarting in %v", args[0], err, s.RestartDelay)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(s.RestartDelay):
+		}
+	}
+}
+
+// Returns true if the command exited before the frames ended
+func (s *Sink) runOnce(
+	ctx context.Context,
+	sess *webrtc.Session,
+	frames webrtc.FrameReader,
+	format string,
+	args []string,
+) (exited bool, err error) {
+	cmd := exec.Command(args[0], args[1:]...)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return false, err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return false, err
+	}
+	if err := cmd.Start(); err != nil {
+		return false, fmt.Errorf("failed starting %v: %w", args[0], err)
+	}
+	// Log stderr lines, then wait for exit once they're done per exec docs
+	waitCh := make(chan error, 1)
+	go func() {
+		name := filepath.Base(args[0])
+		scanner := bufio.NewScanner(stderr)
+		scanner.Buffer(make([]byte, maxStderrLine), maxStderrLine)
+		scanner.Split(scanStderrLines)
+		for scanner.Scan() {
+			if line := scanner.Text(); line != "" {
+				s.Log.Infof("[%v] %v", name, line)
+			}
+		}
+		// Keep the pipe drained so the command doesn't block writing to it
+		if err := scanner.Err(); err != nil {
+			s.Log.Debugf("Failed reading %v stderr: %v", name, err)
+			io.Copy(ioutil.Discard, stderr)
+		}
+		waitCh <- cmd.Wait()
+	}()
+	// Stream until the frames end or writing fails, which closes stdin
+	w := &errWriter{WriteCloser: stdin}
+	err = webrtc.SaveFrames(ctx, format, w, sess, frames)
+	var waitErr error
+	select {
+	case waitErr = <-waitCh:
+	case <-time.After(s.StopTimeout):
+		s.Log.Warnf("Command %v did not exit, killing", args[0])
+		cmd.Process.Kill()
+		waitErr = <-waitCh
+	}
+	if w.err != nil {
+		return true, fmt.Errorf("command ended with %v: %w", waitErr, w.err)
+	} else if waitErr != nil {
+		s.Log.Warnf("Command %v failed: %v", args[0], waitErr)
+	}
+	return false, err
+}
+
+// Splits on \r as well as \n since progress output like ffmpeg's rewrites
+// the line with \r. Lines past maxStderrLine are split there.
+func scanStderrLines(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	if i := bytes.IndexAny(data, "\r\n"); i >= 0 && i < maxStderrLine {
+		return i + 1, data[:i], nil
+	} else if len(data) >= maxStderrLine {
+		return maxStderrLine, data[:maxStderrLine], nil
+	} else if atEOF && len(data) > 0 {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
+
+// Remembers the first write error
+type errWriter struct {
+	io.WriteCloser
+	err error
+}
+
+func (e *errWriter) Write(b []byte) (int, error) {
+	n, err := e.WriteCloser.Write(b)
+	if err != nil && e.err == nil {
+		e.err = err
+	}
+	return n, err
+}
+
+// Splits on whitespace, with single or double quotes grouping an argument.
+// Backslashes are not special so Windows paths work.
+func splitArgs(s string) ([]string, error) {
+	var args []string
+	var arg strings.Builder
+	inArg := false
+	var quote rune
+	for _, r := range s {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				arg.WriteRune(r)
+			}
+		case r == '\'' || r == '"':
+			quote, inArg = r, true
+		case unicode.IsSpace(r):
+			if inArg {
+				args = append(args, arg.String())
+				arg.Reset()
+				inArg = false
+			}
+		default:
+			arg.WriteRune(r)
+			inArg = true
+		}
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated quote in command %q", s)
+	} else if inArg {
+		args = append(args, arg.String())
+	}
+	return args, nil
+}
+
+func containsString(strs []string, str string) bool {
+	for _, s := range strs {
+		if s == str {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,458 @@
+package hls
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cretz/takecast/pkg/receiver"
+	"github.com/cretz/takecast/pkg/receiver/webrtc"
+)
+
+const (
+	DefaultSegmentDuration  = 2 * time.Second
+	DefaultPlaylistSegments = 6
+)
+
+// Server is an HTTP handler serving the current session as a live HLS media
+// playlist at "/index.m3u8" with fragmented MP4 segments. When
+// Config.PartDuration is set, the playlist also has Low-Latency HLS partial
+// segments, blocking playlist reloads, and preload hints. Sessions must have
+// h264 video, if any, and opus or aac audio.
+type Server struct {
+	Config
+
+	lock sync.Mutex // Governs fields below
+	// Closed and replaced on every change to wake blocked requests
+	updated chan struct{}
+	// Nil when no session is streaming
+	current *stream
+	// Init segments keyed by ID, removed when no segment uses them
+	inits      map[int][]byte
+	nextInitID int
+	// Oldest first, the last may be in progress
+	segments     []*segment
+	nextSequence int
+	nextPart     int
+	// Number of discontinuities removed from the playlist
+	discontinuitySequence int
+}
+
+type Config struct {
+	Log receiver.Log
+	// Target segment duration. Segments are cut at the first video key frame
+	// after this and a key frame is requested from the sender when it is near.
+	// If a key frame doesn't arrive, segments are cut without one at 1.5 times
+	// this. Default is DefaultSegmentDuration.
+	SegmentDuration time.Duration
+	// If non-zero, Low-Latency HLS is used with parts of at most this duration
+	PartDuration time.Duration
+	// Number of complete segments in the playlist. Default is
+	// DefaultPlaylistSegments.
+	PlaylistSegments int
+}
+
+type stream struct {
+	// Never changed after creation
+	session *webrtc.Session
+	initID  int
+	// Governed by the server lock. Nil until the first part.
+	segment *segment
+	started bool
+}
+
+type segment struct {
+	sequence      int
+	initID        int
+	discontinuity bool
+	parts         []*part
+	duration      time.Duration
+	complete      bool
+	// Whether a key frame has been requested to start the next segment
+	keyFrameRequested bool
+}
+
+type part struct {
+	number      int
+	data        []byte
+	duration    time.Duration
+	independent bool
+}
+
+func New(config Config) *Server {
+	s := &Server{Config: config, updated: make(chan struct{}), inits: map[int][]byte{}}
+	if s.Log == nil {
+		s.Log = receiver.NopLog()
+	}
+	if s.SegmentDuration <= 0 {
+		s.SegmentDuration = DefaultSegmentDuration
+	}
+	if s.PlaylistSegments <= 0 {
+		s.PlaylistSegments = DefaultPlaylistSegments
+	}
+	return s
+}
+
+// OnSession streams the session until it ends, reading it with a new
+// FrameBuffer. This can be used as mirror.Config.OnSession.
+func (s *Server) OnSession(sess *webrtc.Session) {
+	s.Stream(sess, webrtc.NewFrameBuffer(sess, webrtc.FrameBufferConfig{Log: s.Log}))
+}
+
+// Stream makes the session the one being streamed, reading its frames from the
+// given reader in the background until it fails or another session is
+// streamed. The playlist continues across sessions with a discontinuity. If
+// the reader is an io.Closer, it is closed when done.
+func (s *Server) Stream(sess *webrtc.Session, frames webrtc.FrameReader) {
+	var w chunkWriter
+	muxer, err := webrtc.NewMP4SessionMuxer(&w, sess)
+	if err != nil {
+		s.Log.Warnf("Cannot stream session %v over HLS: %v", sess.ID, err)
+		if closer, ok := frames.(io.Closer); ok {
+			closer.Close()
+		}
+		return
+	}
+	s.lock.Lock()
+	st := &stream{session: sess, initID: s.nextInitID}
+	s.nextInitID++
+	s.endStreamUnlocked()
+	s.current = st
+	s.lock.Unlock()
+	// Each fragment becomes a part. Cutting before the part duration makes sure
+	// parts with one more frame don't exceed the target.
+	muxer.Writer.MaxFragmentDuration = s.partTarget() * 3 / 4
+	muxer.Writer.OnFragment = func(frag webrtc.MP4Fragment) {
+		chunks := w.chunks
+		w.chunks = nil
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		if s.current != st {
+			return
+		}
+		// The first write is the init segment
+		if !st.started {
+			s.inits[st.initID], chunks, st.started = chunks[0], chunks[1:], true
+		}
+		s.addPartUnlocked(st, chunks[0], frag)
+	}
+	go s.pump(st, muxer, frames)
+}
+
+func (s *Server) pump(st *stream, muxer *webrtc.MP4SessionMuxer, frames webrtc.FrameReader) {
+	if closer, ok := frames.(io.Closer); ok {
+		defer closer.Close()
+	}
+	var f webrtc.Frame
+	for {
+		if err := frames.Read(&f); err != nil {
+			s.Log.Debugf("HLS stream of session %v ended: %v", st.session.ID, err)
+			break
+		} else if _, err = muxer.WriteFrame(&f); err != nil {
+			s.Log.Warnf("Failed muxing HLS stream of session %v: %v", st.session.ID, err)
+			break
+		}
+		s.lock.Lock()
+		current := s.current == st
+		s.lock.Unlock()
+		if !current {
+			return
+		}
+	}
+	// Flush the last part and end the stream if still current
+	if err := muxer.Close(); err != nil {
+		s.Log.Warnf("Failed muxing HLS stream of session %v: %v", st.session.ID, err)
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.current == st {
+		s.endStreamUnlocked()
+	}
+}
+
+// Completes the current stream's segment and removes the stream
+func (s *Server) endStreamUnlocked() {
+	if s.current == nil {
+		return
+	}
+	if s.current.segment != nil {
+		s.current.segment.complete = true
+	}
+	s.current = nil
+	s.notifyUnlocked()
+}
+
+func (s *Server) addPartUnlocked(st *stream, data []byte, frag webrtc.MP4Fragment) {
+	seg := st.segment
+	if seg != nil && seg.duration >= s.SegmentDuration &&
+		(frag.Independent || seg.duration >= s.SegmentDuration*3/2) {
+		seg.complete = true
+		seg = nil
+	}
+	if seg == nil {
+		seg = &segment{sequence: s.nextSequence, initID: st.initID}
+		// A new session after an earlier one is a discontinuity
+		seg.discontinuity = st.segment == nil && len(s.segments) > 0
+		s.nextSequence++
+		st.segment = seg
+		s.segments = append(s.segments, seg)
+		s.trimUnlocked()
+	}
+	seg.parts = append(seg.parts, &part{
+		number:      s.nextPart,
+		data:        data,
+		duration:    frag.Duration,
+		independent: frag.Independent,
+	})
+	s.nextPart++
+	seg.duration += frag.Duration
+	// Ask for a key frame to start the next segment on time
+	if !seg.keyFrameRequested && seg.duration+s.partTarget() >= s.SegmentDuration {
+		seg.keyFrameRequested = true
+		if err := st.session.RequestKeyFrame(); err != nil {
+			s.Log.Debugf("Failed requesting key frame: %v", err)
+		}
+	}
+	s.notifyUnlocked()
+}
+
+// Removes the oldest complete segments past the playlist size and any init
+// segments no longer used
+func (s *Server) trimUnlocked() {
+	complete := 0
+	for _, seg := range s.segments {
+		if seg.complete {
+			complete++
+		}
+	}
+	for ; complete > s.PlaylistSegments; complete-- {
+		if s.segments[0].discontinuity {
+			s.discontinuitySequence++
+		}
+		s.segments = s.segments[1:]
+	}
+	for id := range s.inits {
+		used := s.current != nil && s.current.initID == id
+		for _, seg := range s.segments {
+			used = used || seg.initID == id
+		}
+		if !used {
+			delete(s.inits, id)
+		}
+	}
+}
+
+func (s *Server) notifyUnlocked() {
+	close(s.updated)
+	s.updated = make(chan struct{})
+}
+
+func (s *Server) partTarget() time.Duration {
+	if s.PartDuration > 0 {
+		return s.PartDuration
+	}
+	return s.SegmentDuration
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// Allow web players on other origins
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	name := strings.TrimPrefix(r.URL.Path, "/")
+	var id int
+	switch {
+	case name == "index.m3u8":
+		s.servePlaylist(w, r)
+	case scanName(name, "init-%d.mp4", &id):
+		s.lock.Lock()
+		data, ok := s.inits[id]
+		s.lock.Unlock()
+		serveData(w, r, "video/mp4", data, ok)
+	case scanName(name, "seg-%d.m4s", &id):
+		s.lock.Lock()
+		var data []byte
+		seg := s.segmentUnlocked(id)
+		if seg != nil && seg.complete {
+			for _, part := range seg.parts {
+				data = append(data, part.data...)
+			}
+		}
+		s.lock.Unlock()
+		serveData(w, r, "video/iso.segment", data, seg != nil && seg.complete)
+	case scanName(name, "part-%d.m4s", &id):
+		// The next part can be requested from a preload hint before it exists
+		part, ok := s.waitPart(r, id)
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		serveData(w, r, "video/iso.segment", part.data, true)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func scanName(name, format string, id *int) bool {
+	// Sscanf ignores trailing text, so check by formatting it back
+	_, err := fmt.Sscanf(name, format, id)
+	return err == nil && fmt.Sprintf(format, *id) == name
+}
+
+func serveData(w http.ResponseWriter, r *http.Request, contentType string, data []byte, ok bool) {
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.Write(data)
+}
+
+func (s *Server) segmentUnlocked(sequence int) *segment {
+	for _, seg := range s.segments {
+		if seg.sequence == sequence {
+			return seg
+		}
+	}
+	return nil
+}
+
+// Waits for the part if it is the next one to be made
+func (s *Server) waitPart(r *http.Request, number int) (*part, bool) {
+	var found *part
+	s.wait(r, func() bool {
+		for _, seg := range s.segments {
+			for _, part := range seg.parts {
+				if part.number == number {
+					found = part
+					return true
+				}
+			}
+		}
+		// Give up unless it's the next part of a live stream
+		return s.current == nil || number != s.nextPart
+	})
+	return found, found != nil
+}
+
+// Waits until ready returns true, which is called with the lock held, or until
+// the request is done or it takes too long
+func (s *Server) wait(r *http.Request, ready func() bool) {
+	timer := time.NewTimer(3 * s.SegmentDuration)
+	defer timer.Stop()
+	for {
+		s.lock.Lock()
+		ok, updated := ready(), s.updated
+		s.lock.Unlock()
+		if ok {
+			return
+		}
+		select {
+		case <-updated:
+		case <-timer.C:
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func (s *Server) servePlaylist(w http.ResponseWriter, r *http.Request) {
+	// Blocking playlist reload waits for the requested segment or part
+	if msn, err := strconv.Atoi(r.URL.Query().Get("_HLS_msn")); err == nil && s.PartDuration > 0 {
+		partIndex, err := strconv.Atoi(r.URL.Query().Get("_HLS_part"))
+		if err != nil {
+			partIndex = -1
+		}
+		s.wait(r, func() bool { return s.current == nil || s.hasPartUnlocked(msn, partIndex) })
+	}
+	s.lock.Lock()
+	playlist := s.playlistUnlocked()
+	s.lock.Unlock()
+	w.Header().Set("Content-Type", "application/vnd.apple.mpegurl")
+	w.Header().Set("Cache-Control", "no-cache")
+	io.WriteString(w, playlist)
+}
+
+// Whether the playlist has the part of the segment, or the entire segment if
+// the part index is negative. Any later segment counts.
+func (s *Server) hasPartUnlocked(sequence int, partIndex int) bool {
+	if s.nextSequence > sequence+1 {
+		return true
+	}
+	seg := s.segmentUnlocked(sequence)
+	return seg != nil && (seg.complete || (partIndex >= 0 && len(seg.parts) > partIndex))
+}
+
+func (s *Server) playlistUnlocked() string {
+	var b strings.Builder
+	// Segments can exceed the target by up to half
+	targetDuration := int(math.Ceil((s.SegmentDuration * 3 / 2).Seconds()))
+	version := 7
+	if s.PartDuration > 0 {
+		version = 9
+	}
+	fmt.Fprintf(&b, "#EXTM3U\n#EXT-X-VERSION:%v\n#EXT-X-TARGETDURATION:%v\n", version, targetDuration)
+	if s.PartDuration > 0 {
+		fmt.Fprintf(&b, "#EXT-X-SERVER-CONTROL:CAN-BLOCK-RELOAD=YES,PART-HOLD-BACK=%.3f\n",
+			(3 * s.PartDuration).Seconds())
+		fmt.Fprintf(&b, "#EXT-X-PART-INF:PART-TARGET=%.3f\n", s.PartDuration.Seconds())
+	}
+	sequence := s.nextSequence
+	if len(s.segments) > 0 {
+		sequence = s.segments[0].sequence
+	}
+	fmt.Fprintf(&b, "#EXT-X-MEDIA-SEQUENCE:%v\n#EXT-X-DISCONTINUITY-SEQUENCE:%v\n", sequence, s.discontinuitySequence)
+	// Parts are only listed for the last few segments
+	var partsAfter time.Duration
+	for _, seg := range s.segments {
+		partsAfter += seg.duration
+	}
+	partsAfter -= 3 * s.SegmentDuration
+	var elapsed time.Duration
+	initID := -1
+	for _, seg := range s.segments {
+		// Without parts there is nothing to list for the last segment until done
+		if !seg.complete && s.PartDuration == 0 {
+			continue
+		}
+		if seg.discontinuity {
+			b.WriteString("#EXT-X-DISCONTINUITY\n")
+		}
+		if seg.initID != initID {
+			initID = seg.initID
+			fmt.Fprintf(&b, "#EXT-X-MAP:URI=\"init-%v.mp4\"\n", initID)
+		}
+		if s.PartDuration > 0 && elapsed+seg.duration > partsAfter {
+			for _, part := range seg.parts {
+				fmt.Fprintf(&b, "#EXT-X-PART:DURATION=%.3f,URI=\"part-%v.m4s\"", part.duration.Seconds(), part.number)
+				if part.independent {
+					b.WriteString(",INDEPENDENT=YES")
+				}
+				b.WriteString("\n")
+			}
+		}
+		elapsed += seg.duration
+		if seg.complete {
+			fmt.Fprintf(&b, "#EXTINF:%.3f,\nseg-%v.m4s\n", seg.duration.Seconds(), seg.sequence)
+		}
+	}
+	if s.PartDuration > 0 && s.current != nil {
+		fmt.Fprintf(&b, "#EXT-X-PRELOAD-HINT:TYPE=PART,URI=\"part-%v.m4s\"\n", s.nextPart)
+	}
+	return b.String()
+}
+
+// Captures each write as a separate chunk
+type chunkWriter struct {
+	chunks [][]byte
+}
+
+func (c *chunkWriter) Write(b []byte) (int, error) {
+	c.chunks = append(c.chunks, append([]byte(nil), b...))
+	return len(b), nil
+}
@@ -0,0 +1,358 @@
+package preview
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/cretz/takecast/pkg/receiver"
+	"github.com/cretz/takecast/pkg/receiver/webrtc"
+	"golang.org/x/net/websocket"
+)
+
+// Server is an HTTP handler serving a page at "/" that plays the current
+// session live. WebM chunks are sent over a WebSocket at "/ws" to be appended
+// to a Media Source Extensions source buffer.
+type Server struct {
+	Config
+	mux *http.ServeMux
+
+	lock sync.Mutex // Governs fields below
+	// Nil when there is no session
+	live    *liveSession
+	clients map[*client]struct{}
+}
+
+type Config struct {
+	Log receiver.Log
+	// Number of chunks that can be queued for a client before it is
+	// disconnected as too slow. Default is DefaultClientQueueSize.
+	ClientQueueSize int
+}
+
+const DefaultClientQueueSize = 512
+
+type liveSession struct {
+	// Never changed after creation
+	session  *webrtc.Session
+	mimeType string
+	// Nil until the muxer writes it, governed by the server lock
+	header []byte
+}
+
+type client struct {
+	ch chan []byte
+	// Never changed after creation
+	live *liveSession
+	// Whether the header has been queued, governed by the server lock
+	joined bool
+}
+
+func New(config Config) *Server {
+	s := &Server{Config: config, mux: http.NewServeMux(), clients: map[*client]struct{}{}}
+	if s.Log == nil {
+		s.Log = receiver.NopLog()
+	}
+	if s.ClientQueueSize <= 0 {
+		s.ClientQueueSize = DefaultClientQueueSize
+	}
+	s.mux.HandleFunc("/", s.servePage)
+	s.mux.Handle("/ws", websocket.Handler(s.serveWebSocket))
+	return s
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) { s.mux.ServeHTTP(w, r) }
+
+// OnSession previews the session until it ends, reading it with a new
+// FrameBuffer. This can be used as mirror.Config.OnSession.
+func (s *Server) OnSession(sess *webrtc.Session) {
+	s.Preview(sess, webrtc.NewFrameBuffer(sess, webrtc.FrameBufferConfig{Log: s.Log}))
+}
+
+// Preview makes the session the one being previewed, reading its frames from
+// the given reader until it fails or another session is previewed. Clients of
+// the previous session are disconnected so they reconnect to this one. If the
+// reader is an io.Closer, it is closed when done.
+func (s *Server) Preview(sess *webrtc.Session, frames webrtc.FrameReader) {
+	var w chunkWriter
+	mimeType, err := MIMEType(sess)
+	var muxer *webrtc.WebMSessionMuxer
+	if err == nil {
+		muxer, err = webrtc.NewWebMSessionMuxer(&w, sess)
+	}
+	if err != nil {
+		s.Log.Warnf("Cannot preview session %v: %v", sess.ID, err)
+		if closer, ok := frames.(io.Closer); ok {
+			closer.Close()
+		}
+		return
+	}
+	live := &liveSession{session: sess, mimeType: mimeType}
+	s.lock.Lock()
+	s.live = live
+	s.disconnectAllUnlocked()
+	s.lock.Unlock()
+	go s.pump(live, muxer, &w, frames)
+}
+
+// MIMEType returns the WebM MIME type with codecs for the session as expected
+// by MediaSource.isTypeSupported.
+func MIMEType(sess *webrtc.Session) (string, error) {
+	var codecs []string
+	if sess.Video != nil {
+		codec := mseVideoCodecs[sess.Video.CodecName]
+		if codec == "" {
+			return "", fmt.Errorf("unsupported video codec %v", sess.Video.CodecName)
+		}
+		codecs = append(codecs, codec)
+	}
+	if sess.Audio != nil {
+		if sess.Audio.CodecName != "opus" {
+			return "", fmt.Errorf("unsupported audio codec %v", sess.Audio.CodecName)
+		}
+		codecs = append(codecs, "opus")
+	}
+	typ := "video/webm"
+	if sess.Video == nil {
+		typ = "audio/webm"
+	}
+	return fmt.Sprintf("%v; codecs=\"%v\"", typ, strings.Join(codecs, ",")), nil
+}
+
+var mseVideoCodecs = map[string]string{
+	"vp8": "vp8",
+	"vp9": "vp9",
+	// Main profile, level 4.0, 8 bit which browsers accept for any AV1 stream
+	"av1": "av01.0.08M.08",
+}
+
+// Reads frames until the reader fails or the session is no longer live, sending
+// each muxed frame to the clients
+func (s *Server) pump(live *liveSession, muxer *webrtc.WebMSessionMuxer, w *chunkWriter,
+	frames webrtc.FrameReader) {
+	defer s.endSession(live)
+	if closer, ok := frames.(io.Closer); ok {
+		defer closer.Close()
+	}
+	var f webrtc.Frame
+	for {
+		if err := frames.Read(&f); err != nil {
+			s.Log.Debugf("Preview of session %v ended: %v", live.session.ID, err)
+			return
+		}
+		w.chunks = w.chunks[:0]
+		if written, err := muxer.WriteFrame(&f); err != nil {
+			s.Log.Warnf("Failed muxing preview of session %v: %v", live.session.ID, err)
+			return
+		} else if !written {
+			continue
+		}
+		chunks := w.chunks
+		s.lock.Lock()
+		if s.live != live {
+			s.lock.Unlock()
+			return
+		}
+		// The first write is the header
+		if live.header == nil {
+			live.header, chunks = chunks[0], chunks[1:]
+		}
+		// Clients can only start at video key frames, or any audio frame if
+		// audio only
+		joinable := f.KeyFrame && (!f.Audio || live.session.Video == nil)
+		for _, chunk := range chunks {
+			s.sendUnlocked(live, chunk, joinable)
+		}
+		s.lock.Unlock()
+	}
+}
+
+func (s *Server) sendUnlocked(live *liveSession, chunk []byte, joinable bool) {
+	for c := range s.clients {
+		if c.live != live {
+			continue
+		} else if !c.joined {
+			if !joinable {
+				continue
+			}
+			c.joined = true
+			if !s.queueUnlocked(c, live.header) {
+				continue
+			}
+		}
+		s.queueUnlocked(c, chunk)
+	}
+}
+
+// Returns false and disconnects the client if its queue is full
+func (s *Server) queueUnlocked(c *client, chunk []byte) bool {
+	select {
+	case c.ch <- chunk:
+		return true
+	default:
+		s.Log.Infof("Disconnecting slow preview client")
+		s.disconnectUnlocked(c)
+		return false
+	}
+}
+
+func (s *Server) endSession(live *liveSession) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.live == live {
+		s.live = nil
+		s.disconnectAllUnlocked()
+	}
+}
+
+func (s *Server) disconnectAllUnlocked() {
+	for c := range s.clients {
+		s.disconnectUnlocked(c)
+	}
+}
+
+// Does nothing if already disconnected
+func (s *Server) disconnectUnlocked(c *client) {
+	if _, ok := s.clients[c]; ok {
+		delete(s.clients, c)
+		close(c.ch)
+	}
+}
+
+func (s *Server) serveWebSocket(ws *websocket.Conn) {
+	defer ws.Close()
+	s.lock.Lock()
+	live := s.live
+	c := &client{ch: make(chan []byte, s.ClientQueueSize), live: live}
+	s.clients[c] = struct{}{}
+	s.lock.Unlock()
+	defer func() {
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		s.disconnectUnlocked(c)
+	}()
+	// Without a session, wait until one starts and disconnects this client
+	if live != nil {
+		if err := websocket.JSON.Send(ws, map[string]string{"mimeType": live.mimeType}); err != nil {
+			return
+		}
+		// Get a key frame to join on as soon as possible
+		if err := live.session.RequestKeyFrame(); err != nil {
+			s.Log.Debugf("Failed requesting key frame: %v", err)
+		}
+	}
+	// Nothing is expected from the client, but reading notices the close
+	closed := make(chan struct{})
+	go func() {
+		io.Copy(ioutil.Discard, ws)
+		close(closed)
+	}()
+	for {
+		select {
+		case chunk, ok := <-c.ch:
+			if !ok {
+				return
+			} else if err := websocket.Message.Send(ws, chunk); err != nil {
+				return
+			}
+		case <-closed:
+			return
+		}
+	}
+}
+
+func (s *Server) servePage(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	io.WriteString(w, page)
+}
+
+// Captures each write as a separate chunk
+type chunkWriter struct {
+	chunks [][]byte
+}
+
+func (c *chunkWriter) Write(b []byte) (int, error) {
+	c.chunks = append(c.chunks, append([]byte(nil), b...))
+	return len(b), nil
+}
+
+const page = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>TakeCast Preview</title>
+<style>
+  body { margin: 0; background: #000; color: #ccc; font-family: sans-serif; }
+  video { width: 100vw; height: calc(100vh - 2em); }
+  #status { height: 2em; line-height: 2em; padding: 0 0.5em; }
+</style>
+</head>
+<body>
+<video id="video" autoplay muted controls></video>
+<div id="status">Connecting...</div>
+<script>
+const video = document.getElementById('video');
+const status = document.getElementById('status');
+
+function connect() {
+  const ws = new WebSocket((location.protocol === 'https:' ? 'wss://' : 'ws://') + location.host + '/ws');
+  ws.binaryType = 'arraybuffer';
+  const queue = [];
+  let sourceBuffer = null;
+
+  function appendNext() {
+    if (!sourceBuffer || sourceBuffer.updating) return;
+    // Stay near the live edge and drop old data
+    const buffered = sourceBuffer.buffered;
+    if (buffered.length > 0) {
+      const start = buffered.start(0), end = buffered.end(buffered.length - 1);
+      if (video.currentTime < start || end - video.currentTime > 1.5) {
+        video.currentTime = Math.max(buffered.start(buffered.length - 1), end - 0.3);
+      }
+      if (video.currentTime - start > 60) {
+        sourceBuffer.remove(start, video.currentTime - 30);
+        return;
+      }
+    }
+    if (queue.length > 0) sourceBuffer.appendBuffer(queue.shift());
+  }
+
+  ws.onopen = () => { status.textContent = 'Waiting for session...'; };
+  ws.onmessage = (event) => {
+    if (typeof event.data !== 'string') {
+      queue.push(event.data);
+      appendNext();
+      return;
+    }
+    const info = JSON.parse(event.data);
+    if (!window.MediaSource || !MediaSource.isTypeSupported(info.mimeType)) {
+      status.textContent = 'Browser cannot play ' + info.mimeType;
+      return;
+    }
+    const mediaSource = new MediaSource();
+    mediaSource.addEventListener('sourceopen', () => {
+      sourceBuffer = mediaSource.addSourceBuffer(info.mimeType);
+      sourceBuffer.addEventListener('updateend', appendNext);
+      appendNext();
+    });
+    video.src = URL.createObjectURL(mediaSource);
+    status.textContent = 'Playing ' + info.mimeType;
+  };
+  ws.onclose = () => {
+    status.textContent = 'Disconnected, reconnecting...';
+    setTimeout(connect, 1000);
+  };
+}
+
+connect();
+</script>
+</body>
+</html>
+`
@@ -2,19 +2,48 @@ package receiver
 
 import (
 	"context"
+	"fmt"
 )
 
+// Applications can run many sessions at once, one per sender transport ID.
 type Application interface {
-	// Can trust not mutated after returned. This is a quick call, so callers can
-	// call it frequently.
+	// Metadata common to all sessions, so SessionID is empty. Can trust not
+	// mutated after returned. This is a quick call, so callers can call it
+	// frequently.
 	Metadata() *ApplicationMetadata
-	// Should not error if already started. Fast and non-blocking. Context can be
-	// used for life of run even beyond call.
-	Start(ctx context.Context, appID string, appParams interface{}) error
-	// Should not error if not started. Fast and non-blocking.
-	Stop(ctx context.Context) error
-	// Handle the message
-	HandleMessage(ctx context.Context, conn Conn, msg RequestMessage) error
+	// Metadata for the session started for the transport ID, or nil if none.
+	// Same rules as Metadata.
+	SessionMetadata(transportID string) *ApplicationMetadata
+	// Should not error if already started for the transport ID. Fast and
+	// non-blocking. Context can be used for life of run even beyond call.
+	Start(ctx context.Context, transportID, appID string, appParams interface{}) error
+	// Should not error if not started for the transport ID. Fast and
+	// non-blocking.
+	Stop(ctx context.Context, transportID string) error
+	// Handle the message for the session started for the transport ID
+	HandleMessage(ctx context.Context, conn Conn, transportID string, msg RequestMessage) error
+}
+
+// LaunchError can be returned from Application.Start to choose the
+// LaunchErrorResponseMessage reason sent to the sender. Other Start errors are
+// sent as LaunchErrorNotAllowed.
+type LaunchError struct {
+	// One of the LaunchError constants
+	Reason string
+	Err    error
+}
+
+func (l *LaunchError) Error() string { return fmt.Sprintf("launch error %v: %v", l.Reason, l.Err) }
+
+func (l *LaunchError) Unwrap() error { return l.Err }
+
+// VolumeApplication is optionally implemented by applications to be told of
+// receiver volume changes, e.g. to apply gain or change a player's output.
+type VolumeApplication interface {
+	Application
+	// Called with the receiver volume for the session started for the transport
+	// ID, on start and on every change. Fast and non-blocking.
+	SetVolume(ctx context.Context, transportID string, volume Volume) error
 }
 
 type ApplicationMetadata struct {
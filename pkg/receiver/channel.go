@@ -2,6 +2,7 @@ package receiver
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"sync"
 
@@ -46,6 +47,15 @@ func NewChannel(config ChannelConfig) (Channel, error) {
 	return c, nil
 }
 
+type channelContextKey struct{}
+
+// ChannelFromContext returns the channel handling the current message, or nil
+// if none. Contexts given to Application.Start and HandleMessage have it.
+func ChannelFromContext(ctx context.Context) Channel {
+	ch, _ := ctx.Value(channelContextKey{}).(Channel)
+	return ch
+}
+
 func (c *channel) ConnectionInfo() *ConnectRequestMessage {
 	c.connectionInfoLock.RLock()
 	defer c.connectionInfoLock.RUnlock()
@@ -58,6 +68,15 @@ func (c *channel) Run(ctx context.Context) error {
 	}
 	c.runCalled = true
 	defer c.conn.Close()
+	// No sender can control the apps this channel started once it is done. This
+	// uses a new context since the given one may be done.
+	defer func() {
+		err := c.recv.StopApplicationsForChannel(context.Background(), c)
+		if err != nil && !errors.Is(err, ErrReceiverClosed) {
+			c.log.Warnf("Failed stopping applications for closed channel: %v", err)
+		}
+	}()
+	ctx = context.WithValue(ctx, channelContextKey{}, Channel(c))
 	// Accept status updates w/ a buffer of 10
 	statusCh := make(chan *ReceiverStatus, 10)
 	c.recv.AddStatusListener(statusCh)
@@ -90,7 +109,13 @@ func (c *channel) Run(ctx context.Context) error {
 		case err := <-errCh:
 			return err
 		case msg := <-msgCh:
-			if reqMsg, err := UnmarshalRequestMessage(msg); err != nil {
+			var invalidErr *InvalidMessageError
+			if reqMsg, err := UnmarshalRequestMessage(msg); errors.As(err, &invalidErr) {
+				// Only the message is bad, so reject it and keep going
+				if err = c.rejectInvalidMessage(invalidErr); err != nil {
+					return err
+				}
+			} else if err != nil {
 				return err
 			} else if err = c.handleMessage(ctx, reqMsg); err != nil {
 				return err
@@ -144,28 +169,67 @@ func (c *channel) handleMessage(ctx context.Context, msg RequestMessage) error {
 		}
 		return new(MessageBuilder).ApplyReceived(msg.Raw).MustSetJSONPayload(resp).Send(c.conn)
 	case *LaunchRequestMessage:
-		return c.recv.SwitchToApplication(ctx, c, msg.AppID, msg.AppParams)
+		// Launch failures are sent back to the sender instead of ending the channel
+		err := c.recv.SwitchToApplication(ctx, c, msg.AppID, msg.AppParams)
+		if err == nil {
+			return nil
+		}
+		c.log.Warnf("Failed launching application %v: %v", msg.AppID, err)
+		resp := &LaunchErrorResponseMessage{
+			MessageHeader: MessageHeader{Type: "LAUNCH_ERROR", RequestID: msg.RequestID},
+			Reason:        launchErrorReason(err),
+		}
+		return new(MessageBuilder).ApplyReceived(msg.Raw).MustSetJSONPayload(resp).Send(c.conn)
 	case *PingRequestMessage:
 		resp := &MessageHeader{Type: "PONG"}
 		return new(MessageBuilder).ApplyReceived(msg.Raw).MustSetJSONPayload(resp).Send(c.conn)
 	case *StopRequestMessage:
-		// Send back invalid request if not the right session ID
-		if s := c.recv.Status(); len(s.Applications) == 0 || s.Applications[0].SessionID != msg.SessionID {
+		// Send back invalid request if not a known session ID
+		var transportID string
+		for _, app := range c.recv.Status().Applications {
+			if app.SessionID == msg.SessionID {
+				transportID = app.TransportID
+			}
+		}
+		if transportID == "" {
 			resp := &InvalidRequestResponseMessage{
 				MessageHeader: MessageHeader{Type: "INVALID_REQUEST", RequestID: msg.RequestID},
 				Reason:        "INVALID_SESSION_ID",
 			}
 			return new(MessageBuilder).ApplyReceived(msg.Raw).MustSetJSONPayload(resp).Send(c.conn)
 		}
-		// Switch app to nothing
-		return c.recv.SwitchToApplication(ctx, c, "", nil)
+		return c.recv.StopApplication(ctx, transportID)
+	case *SetVolumeRequestMessage:
+		// Send back invalid request if missing or out of range
+		if msg.Volume == nil || msg.Volume.Validate() != nil {
+			resp := &InvalidRequestResponseMessage{
+				MessageHeader: MessageHeader{Type: "INVALID_REQUEST", RequestID: msg.RequestID},
+				Reason:        "INVALID_PARAMS",
+			}
+			return new(MessageBuilder).ApplyReceived(msg.Raw).MustSetJSONPayload(resp).Send(c.conn)
+		} else if err := c.recv.SetVolume(ctx, msg.Volume); err != nil {
+			return err
+		}
+		// Reply with the new status, which is also sent to all channels
+		resp := &ReceiverStatusResponseMessage{
+			MessageHeader: MessageHeader{Type: "RECEIVER_STATUS", RequestID: msg.RequestID},
+			Status:        c.recv.Status(),
+		}
+		return new(MessageBuilder).ApplyReceived(msg.Raw).MustSetJSONPayload(resp).Send(c.conn)
 	default:
-		// Grab the current application and if the message is a supported namespace
+		// Grab the application for the message destination, falling back to the
+		// one this channel started, and if the message is a supported namespace
 		// then let the app handle it
-		if app := c.recv.CurrentApplication(); app != nil {
+		transportID := msg.Header().Raw.GetDestinationId()
+		app := c.recv.ApplicationForTransport(transportID)
+		if app == nil {
+			transportID = c.recv.TransportForChannel(c)
+			app = c.recv.ApplicationForTransport(transportID)
+		}
+		if app != nil {
 			for _, supportedNamespace := range app.Metadata().SupportedNamespaces {
 				if supportedNamespace == msg.Header().Raw.GetNamespace() {
-					return app.HandleMessage(ctx, c.conn, msg)
+					return app.HandleMessage(ctx, c.conn, transportID, msg)
 				}
 			}
 		}
@@ -174,3 +238,31 @@ func (c *channel) handleMessage(ctx context.Context, msg RequestMessage) error {
 		return nil
 	}
 }
+
+// Replies with INVALID_REQUEST if the message had a request ID, otherwise just
+// logs it
+func (c *channel) rejectInvalidMessage(invalidErr *InvalidMessageError) error {
+	c.log.Warnf("Rejecting message: %v", invalidErr)
+	if invalidErr.Header.RequestID == 0 {
+		return nil
+	}
+	resp := &InvalidRequestResponseMessage{
+		MessageHeader: MessageHeader{Type: "INVALID_REQUEST", RequestID: invalidErr.Header.RequestID},
+		Reason:        "INVALID_PARAMS",
+	}
+	return new(MessageBuilder).ApplyReceived(invalidErr.Header.Raw).MustSetJSONPayload(resp).Send(c.conn)
+}
+
+func launchErrorReason(err error) string {
+	var launchErr *LaunchError
+	switch {
+	case errors.As(err, &launchErr):
+		return launchErr.Reason
+	case errors.Is(err, ErrApplicationNotFound):
+		return LaunchErrorNotFound
+	case errors.Is(err, ErrReceiverClosed), errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return LaunchErrorCancelled
+	default:
+		return LaunchErrorNotAllowed
+	}
+}
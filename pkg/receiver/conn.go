@@ -7,6 +7,7 @@ import (
 	"encoding/binary"
 	"fmt"
 	"io"
+	"sync"
 
 	"github.com/cretz/takecast/pkg/cert"
 	"github.com/cretz/takecast/pkg/receiver/cast_channel"
@@ -16,7 +17,8 @@ import (
 type Conn interface {
 	Auth(*DeviceAuthRequestMessage) (*cast_channel.AuthResponse, error)
 	Receive() (*cast_channel.CastMessage, error)
-	// Source and destination are replaced with defaults if not present
+	// Source and destination are replaced with defaults if not present. Safe for
+	// concurrent use.
 	Send(*cast_channel.CastMessage) error
 	Close() error
 }
@@ -31,6 +33,7 @@ func receiveRequestMessage(conn Conn) (RequestMessage, error) {
 
 type conn struct {
 	ConnConfig
+	sendLock sync.Mutex
 }
 
 type ConnConfig struct {
@@ -138,15 +141,14 @@ func (c *conn) Send(msg *cast_channel.CastMessage) error {
 	if err != nil {
 		return fmt.Errorf("failed marshaling cast message: %w", err)
 	}
-	sizeByts := make([]byte, 4)
-	binary.BigEndian.PutUint32(sizeByts, uint32(len(byts)))
-	if _, err = c.Socket.Write(sizeByts); err != nil {
-		return err
-	}
-	if _, err = c.Socket.Write(byts); err != nil {
-		return err
-	}
-	return nil
+	// Write the size and message at once so concurrent sends don't interleave
+	sizedByts := make([]byte, 4, 4+len(byts))
+	binary.BigEndian.PutUint32(sizedByts, uint32(len(byts)))
+	sizedByts = append(sizedByts, byts...)
+	c.sendLock.Lock()
+	defer c.sendLock.Unlock()
+	_, err = c.Socket.Write(sizedByts)
+	return err
 }
 
 func (c *conn) Close() error { return c.Socket.Close() }
@@ -0,0 +1,329 @@
+package media
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// What was found fetching the start of a media URL
+type probe struct {
+	url *url.URL
+	// Nil if not HLS
+	hls *hlsPlaylist
+	// Nil if HLS, otherwise the open response body to download or close
+	body io.ReadCloser
+	// In seconds, 0 if unknown
+	duration float64
+}
+
+// Fetches the URL to check it can be played. HLS is detected by content type
+// or extension and its media playlist is loaded. For progressive media, the
+// response body is left open.
+func fetchProbe(ctx context.Context, client *http.Client, rawURL, contentType string) (*probe, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return nil, fmt.Errorf("unsupported URL %q", rawURL)
+	}
+	resp, err := httpGet(ctx, client, u)
+	if err != nil {
+		return nil, err
+	}
+	p := &probe{url: u}
+	if !isHLS(u, contentType, resp.Header.Get("Content-Type")) {
+		p.body = resp.Body
+		return p, nil
+	}
+	defer resp.Body.Close()
+	if p.hls, err = parseHLSPlaylist(resp.Body, u); err != nil {
+		return nil, err
+	}
+	// Take the highest bandwidth variant of a master playlist
+	if len(p.hls.variants) > 0 {
+		best := p.hls.variants[0]
+		for _, v := range p.hls.variants[1:] {
+			if v.bandwidth > best.bandwidth {
+				best = v
+			}
+		}
+		if p.hls, err = fetchHLSPlaylist(ctx, client, best.url); err != nil {
+			return nil, err
+		}
+	}
+	if p.hls.key {
+		return nil, fmt.Errorf("encrypted HLS not supported")
+	}
+	if p.hls.ended {
+		for _, seg := range p.hls.segments {
+			p.duration += seg.duration
+		}
+	}
+	return p, nil
+}
+
+func httpGet(ctx context.Context, client *http.Client, u *url.URL) (*http.Response, error) {
+	req, err := http.NewRequest("GET", u.String(), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		return nil, err
+	} else if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		resp.Body.Close()
+		return nil, fmt.Errorf("fetching %v returned status %v", u, resp.Status)
+	}
+	return resp, nil
+}
+
+func isHLS(u *url.URL, contentTypes ...string) bool {
+	for _, contentType := range contentTypes {
+		contentType = strings.ToLower(contentType)
+		if strings.Contains(contentType, "mpegurl") {
+			return true
+		}
+	}
+	return strings.HasSuffix(strings.ToLower(u.Path), ".m3u8")
+}
+
+// Downloads the probed media into the directory, returning the file name. For
+// HLS, segments are appended to one file and live playlists are reloaded until
+// they end or the context is done. The probe body is closed.
+func download(ctx context.Context, client *http.Client, p *probe, dir string) (string, error) {
+	if p.body != nil {
+		defer p.body.Close()
+	}
+	name := path.Base(p.url.Path)
+	if name == "." || name == "/" {
+		name = "media"
+	}
+	if p.hls != nil {
+		ext := ".ts"
+		if p.hls.mapURL != nil {
+			ext = ".mp4"
+		}
+		name = strings.TrimSuffix(name, path.Ext(name)) + ext
+	}
+	f, err := createUnique(filepath.Join(dir, time.Now().Format("20060102-150405-")+sanitizeFilename(name)))
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	filename := f.Name()
+	if p.body != nil {
+		_, err = io.Copy(f, p.body)
+	} else {
+		err = downloadHLS(ctx, client, p.hls, f)
+	}
+	if err != nil {
+		return filename, err
+	}
+	return filename, f.Close()
+}
+
+// Creates the file, adding -2, -3, etc before the extension if it exists so
+// downloads in the same second never overwrite each other
+func createUnique(filename string) (*os.File, error) {
+	ext := filepath.Ext(filename)
+	for i := 1; ; i++ {
+		name := filename
+		if i > 1 {
+			name = fmt.Sprintf("%v-%v%v", strings.TrimSuffix(filename, ext), i, ext)
+		}
+		f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if os.IsExist(err) && i < maxUniqueAttempts {
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("failed creating file at %v: %w", name, err)
+		}
+		return f, nil
+	}
+}
+
+// Attempts to find an unused name before giving up
+const maxUniqueAttempts = 1000
+
+func downloadHLS(ctx context.Context, client *http.Client, pl *hlsPlaylist, w io.Writer) error {
+	if pl.mapURL != nil {
+		if err := copyURL(ctx, client, pl.mapURL, w); err != nil {
+			return err
+		}
+	}
+	// Segments are tracked by media sequence number across reloads
+	next := pl.mediaSequence
+	for {
+		for i, seg := range pl.segments {
+			if seq := pl.mediaSequence + i; seq >= next {
+				if err := copyURL(ctx, client, seg.url, w); err != nil {
+					return err
+				}
+				next = seq + 1
+			}
+		}
+		if pl.ended {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Duration(pl.targetDuration * float64(time.Second))):
+		}
+		var err error
+		if pl, err = fetchHLSPlaylist(ctx, client, pl.url); err != nil {
+			return err
+		}
+	}
+}
+
+func copyURL(ctx context.Context, client *http.Client, u *url.URL, w io.Writer) error {
+	resp, err := httpGet(ctx, client, u)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+var unsafeFilenameChars = regexp.MustCompile(`[^a-zA-Z0-9._-]`)
+
+func sanitizeFilename(name string) string { return unsafeFilenameChars.ReplaceAllString(name, "_") }
+
+type hlsPlaylist struct {
+	url *url.URL
+	// Only set on master playlists
+	variants []*hlsVariant
+	// Fields below only set on media playlists
+	segments       []*hlsSegment
+	targetDuration float64
+	mediaSequence  int
+	mapURL         *url.URL
+	ended          bool
+	key            bool
+}
+
+type hlsVariant struct {
+	url       *url.URL
+	bandwidth int
+}
+
+type hlsSegment struct {
+	url      *url.URL
+	duration float64
+}
+
+func fetchHLSPlaylist(ctx context.Context, client *http.Client, u *url.URL) (*hlsPlaylist, error) {
+	resp, err := httpGet(ctx, client, u)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return parseHLSPlaylist(resp.Body, u)
+}
+
+// Parses the parts of a master or media playlist needed to download it
+func parseHLSPlaylist(r io.Reader, base *url.URL) (*hlsPlaylist, error) {
+	pl := &hlsPlaylist{url: base}
+	scanner := bufio.NewScanner(r)
+	first := true
+	var pendingVariant *hlsVariant
+	var pendingDuration float64
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if first {
+			if line != "#EXTM3U" {
+				return nil, fmt.Errorf("invalid playlist at %v", base)
+			}
+			first = false
+			continue
+		}
+		tag, value := line, ""
+		if i := strings.Index(line, ":"); i >= 0 && strings.HasPrefix(line, "#") {
+			tag, value = line[:i], line[i+1:]
+		}
+		switch {
+		case line == "":
+		case tag == "#EXT-X-STREAM-INF":
+			bandwidth, _ := strconv.Atoi(hlsAttributes(value)["BANDWIDTH"])
+			pendingVariant = &hlsVariant{bandwidth: bandwidth}
+		case tag == "#EXTINF":
+			pendingDuration, _ = strconv.ParseFloat(strings.SplitN(value, ",", 2)[0], 64)
+		case tag == "#EXT-X-TARGETDURATION":
+			pl.targetDuration, _ = strconv.ParseFloat(value, 64)
+		case tag == "#EXT-X-MEDIA-SEQUENCE":
+			pl.mediaSequence, _ = strconv.Atoi(value)
+		case tag == "#EXT-X-ENDLIST":
+			pl.ended = true
+		case tag == "#EXT-X-KEY":
+			pl.key = pl.key || hlsAttributes(value)["METHOD"] != "NONE"
+		case tag == "#EXT-X-MAP":
+			u, err := base.Parse(hlsAttributes(value)["URI"])
+			if err != nil {
+				return nil, fmt.Errorf("invalid map URI: %w", err)
+			}
+			pl.mapURL = u
+		case strings.HasPrefix(line, "#"):
+			// Other tags are not needed
+		default:
+			u, err := base.Parse(line)
+			if err != nil {
+				return nil, fmt.Errorf("invalid URI %q: %w", line, err)
+			}
+			if pendingVariant != nil {
+				pendingVariant.url = u
+				pl.variants = append(pl.variants, pendingVariant)
+				pendingVariant = nil
+			} else {
+				pl.segments = append(pl.segments, &hlsSegment{url: u, duration: pendingDuration})
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	} else if first {
+		return nil, fmt.Errorf("empty playlist at %v", base)
+	}
+	if pl.targetDuration <= 0 {
+		pl.targetDuration = 5
+	}
+	return pl, nil
+}
+
+// Parses an attribute list, unquoting quoted values
+func hlsAttributes(s string) map[string]string {
+	attrs := map[string]string{}
+	for len(s) > 0 {
+		eq := strings.Index(s, "=")
+		if eq < 0 {
+			break
+		}
+		key := strings.TrimSpace(s[:eq])
+		s = s[eq+1:]
+		var value string
+		if strings.HasPrefix(s, `"`) {
+			end := strings.Index(s[1:], `"`)
+			if end < 0 {
+				value, s = s[1:], ""
+			} else {
+				value, s = s[1:end+1], s[end+2:]
+			}
+		} else if comma := strings.Index(s, ","); comma >= 0 {
+			value, s = s[:comma], s[comma:]
+		} else {
+			value, s = s, ""
+		}
+		attrs[key] = value
+		s = strings.TrimPrefix(s, ",")
+	}
+	return attrs
+}
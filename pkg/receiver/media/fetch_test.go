@@ -0,0 +1,247 @@
+package media
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Serves the files by path. A path can end with "|" and a content type to
+// respond with.
+func newTestServer(t *testing.T, files map[string]string) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		for path, body := range files {
+			contentType := ""
+			if i := strings.Index(path, "|"); i >= 0 {
+				path, contentType = path[:i], path[i+1:]
+			}
+			if path == req.URL.Path {
+				if contentType != "" {
+					w.Header().Set("Content-Type", contentType)
+				}
+				w.Write([]byte(body))
+				return
+			}
+		}
+		http.NotFound(w, req)
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestParseHLSPlaylist(t *testing.T) {
+	base, _ := url.Parse("http://example.com/hls/master.m3u8")
+	master := "#EXTM3U\n" +
+		"#EXT-X-STREAM-INF:BANDWIDTH=1280000,CODECS=\"avc1.4d401f,mp4a.40.2\"\n" +
+		"low/index.m3u8\n" +
+		"#EXT-X-STREAM-INF:BANDWIDTH=2560000\n" +
+		"/abs/high.m3u8\n"
+	pl, err := parseHLSPlaylist(strings.NewReader(master), base)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(pl.variants) != 2 || len(pl.segments) != 0 {
+		t.Fatalf("unexpected playlist %+v", pl)
+	} else if v := pl.variants[0]; v.bandwidth != 1280000 || v.url.String() != "http://example.com/hls/low/index.m3u8" {
+		t.Fatalf("unexpected first variant %v %v", v.bandwidth, v.url)
+	} else if v := pl.variants[1]; v.bandwidth != 2560000 || v.url.String() != "http://example.com/abs/high.m3u8" {
+		t.Fatalf("unexpected second variant %v %v", v.bandwidth, v.url)
+	}
+
+	media := "#EXTM3U\n" +
+		"#EXT-X-TARGETDURATION:6\n" +
+		"#EXT-X-MEDIA-SEQUENCE:42\n" +
+		"#EXT-X-KEY:METHOD=NONE\n" +
+		"#EXT-X-MAP:URI=\"init.mp4\"\n" +
+		"\n" +
+		"#EXTINF:5.5,First\n" +
+		"seg42.m4s\n" +
+		"#EXTINF:4,\n" +
+		"seg43.m4s\n" +
+		"#EXT-X-ENDLIST\n"
+	if pl, err = parseHLSPlaylist(strings.NewReader(media), base); err != nil {
+		t.Fatal(err)
+	}
+	if pl.targetDuration != 6 || pl.mediaSequence != 42 || !pl.ended || pl.key || len(pl.variants) != 0 {
+		t.Fatalf("unexpected playlist %+v", pl)
+	} else if pl.mapURL.String() != "http://example.com/hls/init.mp4" {
+		t.Fatalf("unexpected map URL %v", pl.mapURL)
+	} else if len(pl.segments) != 2 {
+		t.Fatalf("expected 2 segments, got %v", len(pl.segments))
+	} else if seg := pl.segments[0]; seg.duration != 5.5 || seg.url.String() != "http://example.com/hls/seg42.m4s" {
+		t.Fatalf("unexpected first segment %v %v", seg.duration, seg.url)
+	} else if seg := pl.segments[1]; seg.duration != 4 || seg.url.String() != "http://example.com/hls/seg43.m4s" {
+		t.Fatalf("unexpected second segment %v %v", seg.duration, seg.url)
+	}
+
+	// Live without target duration defaults it, encrypted is flagged
+	live := "#EXTM3U\n#EXT-X-KEY:METHOD=AES-128,URI=\"key\"\n#EXTINF:2,\nseg.ts\n"
+	if pl, err = parseHLSPlaylist(strings.NewReader(live), base); err != nil {
+		t.Fatal(err)
+	} else if pl.ended || !pl.key || pl.targetDuration != 5 {
+		t.Fatalf("unexpected playlist %+v", pl)
+	}
+
+	for name, invalid := range map[string]string{
+		"empty":      "",
+		"not m3u":    "<html></html>\n",
+		"bad map":    "#EXTM3U\n#EXT-X-MAP:URI=\"%zz\"\n",
+		"bad uri":    "#EXTM3U\n#EXTINF:2,\n%zz\n",
+		"only blank": "\n",
+	} {
+		if _, err := parseHLSPlaylist(strings.NewReader(invalid), base); err == nil {
+			t.Fatalf("expected error for %v", name)
+		}
+	}
+}
+
+func TestHLSAttributes(t *testing.T) {
+	attrs := hlsAttributes(`BANDWIDTH=100,CODECS="a,b",URI="x.m3u8", NAME=foo`)
+	if attrs["BANDWIDTH"] != "100" || attrs["CODECS"] != "a,b" || attrs["URI"] != "x.m3u8" || attrs["NAME"] != "foo" {
+		t.Fatalf("unexpected attributes %v", attrs)
+	}
+}
+
+func TestFetchProbe(t *testing.T) {
+	srv := newTestServer(t, map[string]string{
+		"/video.mp4": "progressive",
+		"/master.m3u8": "#EXTM3U\n" +
+			"#EXT-X-STREAM-INF:BANDWIDTH=100\nlow.m3u8\n" +
+			"#EXT-X-STREAM-INF:BANDWIDTH=300\nhigh.m3u8\n" +
+			"#EXT-X-STREAM-INF:BANDWIDTH=200\nmid.m3u8\n",
+		"/high.m3u8":                                 "#EXTM3U\n#EXTINF:4,\na.ts\n#EXTINF:5.5,\nb.ts\n#EXT-X-ENDLIST\n",
+		"/live|application/vnd.apple.mpegurl":        "#EXTM3U\n#EXTINF:4,\na.ts\n",
+		"/encrypted.m3u8":                            "#EXTM3U\n#EXT-X-KEY:METHOD=AES-128,URI=\"k\"\n#EXTINF:4,\na.ts\n",
+		"/playlist|application/x-mpegURL; charset=x": "#EXTM3U\n#EXTINF:1,\na.ts\n#EXT-X-ENDLIST\n",
+	})
+	ctx := context.Background()
+	client := srv.Client()
+
+	// Progressive keeps the body open
+	p, err := fetchProbe(ctx, client, srv.URL+"/video.mp4", "video/mp4")
+	if err != nil {
+		t.Fatal(err)
+	} else if p.hls != nil || p.body == nil || p.duration != 0 {
+		t.Fatalf("unexpected probe %+v", p)
+	}
+	b, err := ioutil.ReadAll(p.body)
+	p.body.Close()
+	if err != nil || string(b) != "progressive" {
+		t.Fatalf("unexpected body %q %v", b, err)
+	}
+
+	// Master playlist picks the highest bandwidth
+	if p, err = fetchProbe(ctx, client, srv.URL+"/master.m3u8", ""); err != nil {
+		t.Fatal(err)
+	} else if p.body != nil || p.hls == nil || p.hls.url.Path != "/high.m3u8" || p.duration != 9.5 {
+		t.Fatalf("unexpected probe %+v", p)
+	}
+
+	// Content type from the sender or the response marks HLS without an
+	// extension, live has no duration
+	if p, err = fetchProbe(ctx, client, srv.URL+"/live", ""); err != nil {
+		t.Fatal(err)
+	} else if p.hls == nil || p.duration != 0 {
+		t.Fatalf("unexpected probe %+v", p)
+	}
+	if p, err = fetchProbe(ctx, client, srv.URL+"/playlist", ""); err != nil {
+		t.Fatal(err)
+	} else if p.hls == nil || p.duration != 1 {
+		t.Fatalf("unexpected probe %+v", p)
+	}
+
+	for _, rawURL := range []string{
+		srv.URL + "/encrypted.m3u8",
+		srv.URL + "/missing.mp4",
+		srv.URL + "/missing.m3u8",
+		"ftp://example.com/video.mp4",
+		"not a url",
+	} {
+		if _, err := fetchProbe(ctx, client, rawURL, ""); err == nil {
+			t.Fatalf("expected error for %v", rawURL)
+		}
+	}
+}
+
+func TestDownload(t *testing.T) {
+	srv := newTestServer(t, map[string]string{
+		"/dir/video.mp4": "progressive",
+		"/hls/index.m3u8": "#EXTM3U\n#EXT-X-MAP:URI=\"init.mp4\"\n" +
+			"#EXTINF:4,\nseg1.m4s\n#EXTINF:4,\nseg2.m4s\n#EXT-X-ENDLIST\n",
+		"/hls/init.mp4": "init-",
+		"/hls/seg1.m4s": "one-",
+		"/hls/seg2.m4s": "two",
+		"/ts.m3u8":      "#EXTM3U\n#EXTINF:4,\n/missing.ts\n#EXT-X-ENDLIST\n",
+	})
+	dir, err := ioutil.TempDir("", "takecast-media-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ctx := context.Background()
+	client := srv.Client()
+	for _, test := range []struct {
+		path    string
+		suffix  string
+		content string
+	}{
+		{"/dir/video.mp4", "-video.mp4", "progressive"},
+		{"/hls/index.m3u8", "-index.mp4", "init-one-two"},
+	} {
+		p, err := fetchProbe(ctx, client, srv.URL+test.path, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		filename, err := download(ctx, client, p, dir)
+		if err != nil {
+			t.Fatal(err)
+		} else if filepath.Dir(filename) != dir || !strings.HasSuffix(filename, test.suffix) {
+			t.Fatalf("unexpected filename %v", filename)
+		}
+		if b, err := ioutil.ReadFile(filename); err != nil || string(b) != test.content {
+			t.Fatalf("expected %q, got %q %v", test.content, b, err)
+		}
+	}
+
+	// Segment failure returns the partial file
+	p, err := fetchProbe(ctx, client, srv.URL+"/ts.m3u8", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if filename, err := download(ctx, client, p, dir); err == nil {
+		t.Fatal("expected error")
+	} else if !strings.HasSuffix(filename, "-ts.ts") {
+		t.Fatalf("unexpected filename %v", filename)
+	}
+}
+
+func TestCreateUnique(t *testing.T) {
+	dir, err := ioutil.TempDir("", "takecast-media-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	base := filepath.Join(dir, "media.mp4")
+	if err := ioutil.WriteFile(base, []byte("existing"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{"media-2.mp4", "media-3.mp4"} {
+		f, err := createUnique(base)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+		if filepath.Base(f.Name()) != expected {
+			t.Fatalf("expected %v, got %v", expected, f.Name())
+		}
+	}
+	// Existing file untouched
+	if b, _ := ioutil.ReadFile(base); string(b) != "existing" {
+		t.Fatalf("existing file overwritten with %q", b)
+	}
+}
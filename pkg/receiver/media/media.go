@@ -0,0 +1,212 @@
+package media
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/cretz/takecast/pkg/receiver"
+)
+
+// The Default Media Receiver used by senders that cast a URL
+const AppID = "CC1AD845"
+
+// How long a LOAD can take to fetch the start of the media before failing
+const fetchTimeout = 15 * time.Second
+
+type Media interface {
+	receiver.VolumeApplication
+}
+
+type media struct {
+	Config
+	// Never changed after creation
+	metadata *receiver.ApplicationMetadata
+
+	lock sync.RWMutex // Governs fields below
+	// Keyed by transport ID
+	sessions map[string]*session
+	// Last media session ID given out, unique across sessions
+	lastMediaSessionID int
+}
+
+type Config struct {
+	Log receiver.Log
+	// Only used for AppIDs, DisplayName, and SupportedNamespaces. Defaults
+	// provided for each when not set.
+	DefaultMetadata receiver.ApplicationMetadata
+	// If set, loaded media is downloaded into this directory. HLS segments are
+	// appended into a single file.
+	DownloadDir string
+	// Called to create a player for each session. Default is a simulated player
+	// on the wall clock.
+	NewPlayer func() receiver.Player
+	// Default is http.DefaultClient
+	HTTPClient *http.Client
+}
+
+func New(config Config) (Media, error) {
+	m := &media{Config: config, sessions: map[string]*session{}}
+	if len(m.DefaultMetadata.AppIDs) == 0 {
+		m.DefaultMetadata.AppIDs = []string{AppID}
+	}
+	if m.DefaultMetadata.DisplayName == "" {
+		m.DefaultMetadata.DisplayName = "Default Media Receiver"
+	}
+	if len(m.DefaultMetadata.SupportedNamespaces) == 0 {
+		m.DefaultMetadata.SupportedNamespaces = []string{receiver.NamespaceMedia}
+	}
+	if m.Log == nil {
+		m.Log = receiver.NopLog()
+	}
+	if m.HTTPClient == nil {
+		m.HTTPClient = http.DefaultClient
+	}
+	if m.NewPlayer == nil {
+		m.NewPlayer = func() receiver.Player { return receiver.NewSimulatedPlayer(receiver.SimulatedPlayerConfig{}) }
+	}
+	m.metadata = m.newApplicationMetadata()
+	return m, nil
+}
+
+func (m *media) Metadata() *receiver.ApplicationMetadata { return m.metadata }
+
+func (m *media) SessionMetadata(transportID string) *receiver.ApplicationMetadata {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	if sess := m.sessions[transportID]; sess != nil {
+		return sess.metadata
+	}
+	return nil
+}
+
+func (m *media) Start(ctx context.Context, transportID, appID string, appParams interface{}) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	// If there's already a session, nothing to do
+	if m.sessions[transportID] != nil {
+		return nil
+	}
+	m.sessions[transportID] = newSession(m)
+	return nil
+}
+
+func (m *media) Stop(ctx context.Context, transportID string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	// If there's no session, nothing to do
+	sess := m.sessions[transportID]
+	if sess == nil {
+		return nil
+	}
+	sess.close()
+	delete(m.sessions, transportID)
+	return nil
+}
+
+func (m *media) SetVolume(ctx context.Context, transportID string, volume receiver.Volume) error {
+	m.lock.RLock()
+	sess := m.sessions[transportID]
+	m.lock.RUnlock()
+	if sess == nil {
+		return nil
+	}
+	return sess.setReceiverVolume(volume)
+}
+
+func (m *media) newApplicationMetadata() *receiver.ApplicationMetadata {
+	return &receiver.ApplicationMetadata{
+		AppIDs:              m.DefaultMetadata.AppIDs,
+		DisplayName:         m.DefaultMetadata.DisplayName,
+		StatusText:          "Ready To Cast",
+		SupportedNamespaces: m.DefaultMetadata.SupportedNamespaces,
+	}
+}
+
+func (m *media) nextMediaSessionID() int {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.lastMediaSessionID++
+	return m.lastMediaSessionID
+}
+
+func (m *media) HandleMessage(ctx context.Context, conn receiver.Conn, transportID string, msg receiver.RequestMessage) error {
+	m.lock.RLock()
+	sess := m.sessions[transportID]
+	m.lock.RUnlock()
+	if sess == nil {
+		return fmt.Errorf("no session for transport %v", transportID)
+	}
+	sess.status.AddSender(conn, msg)
+	switch msg := msg.(type) {
+	case *receiver.GetMediaStatusRequestMessage:
+		return sess.status.Reply(conn, msg, sess.currentStatus()...)
+	case *receiver.LoadRequestMessage:
+		return sess.loadMedia(conn, msg)
+	case *receiver.PlayRequestMessage:
+		return sess.command(conn, msg, msg.MediaSessionID, sess.playUnlocked)
+	case *receiver.PauseRequestMessage:
+		return sess.command(conn, msg, msg.MediaSessionID, sess.pauseUnlocked)
+	case *receiver.SeekRequestMessage:
+		return sess.command(conn, msg, msg.MediaSessionID, func() (string, string) { return sess.seekUnlocked(msg) })
+	case *receiver.StopMediaRequestMessage:
+		return sess.command(conn, msg, msg.MediaSessionID, sess.stopUnlocked)
+	case *receiver.SetMediaVolumeRequestMessage:
+		return sess.command(conn, msg, msg.MediaSessionID, func() (string, string) {
+			return sess.setVolumeUnlocked(msg.Volume)
+		})
+	case *receiver.EditTracksInfoRequestMessage:
+		return sess.command(conn, msg, msg.MediaSessionID, func() (string, string) {
+			return sess.editTracksUnlocked(msg)
+		})
+	case *receiver.QueueLoadRequestMessage:
+		return sess.loadQueue(conn, msg)
+	case *receiver.QueueInsertRequestMessage:
+		return sess.command(conn, msg, msg.MediaSessionID, func() (string, string) {
+			return sess.queueInsertUnlocked(msg)
+		})
+	case *receiver.QueueUpdateRequestMessage:
+		return sess.command(conn, msg, msg.MediaSessionID, func() (string, string) {
+			return sess.queueUpdateUnlocked(msg)
+		})
+	case *receiver.QueueRemoveRequestMessage:
+		return sess.command(conn, msg, msg.MediaSessionID, func() (string, string) {
+			return sess.queueRemoveUnlocked(msg)
+		})
+	case *receiver.QueueReorderRequestMessage:
+		return sess.command(conn, msg, msg.MediaSessionID, func() (string, string) {
+			return sess.queueReorderUnlocked(msg)
+		})
+	case *receiver.QueueGetItemIDsRequestMessage:
+		return sess.query(conn, msg, msg.MediaSessionID, func() interface{} {
+			return &receiver.QueueItemIDsResponseMessage{
+				MessageHeader: receiver.MessageHeader{Type: "QUEUE_ITEM_IDS", RequestID: msg.RequestID},
+				ItemIDs:       sess.queue.ItemIDs(),
+			}
+		})
+	case *receiver.QueueGetItemsRequestMessage:
+		return sess.query(conn, msg, msg.MediaSessionID, func() interface{} {
+			return &receiver.QueueItemsResponseMessage{
+				MessageHeader: receiver.MessageHeader{Type: "QUEUE_ITEMS", RequestID: msg.RequestID},
+				Items:         sess.queue.Items(msg.ItemIDs...),
+			}
+		})
+	default:
+		if msg.Header().Raw.GetNamespace() == receiver.NamespaceMedia {
+			return sendError(conn, msg, receiver.MediaErrorInvalidRequest, "INVALID_COMMAND")
+		}
+		m.Log.Debugf("Ignoring unknown message: %v", msg.Header().Raw)
+		return nil
+	}
+}
+
+// Replies with a media error of the given type and optional reason
+func sendError(conn receiver.Conn, req receiver.RequestMessage, errType, reason string) error {
+	return new(receiver.MessageBuilder).ApplyReceived(req.Header().Raw).MustSetJSONPayload(
+		&receiver.MediaErrorResponseMessage{
+			MessageHeader: receiver.MessageHeader{Type: errType, RequestID: req.Header().RequestID},
+			Reason:        reason,
+		}).Send(conn)
+}
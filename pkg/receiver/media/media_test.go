@@ -0,0 +1,142 @@
+package media
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/cretz/takecast/pkg/receiver"
+	"github.com/cretz/takecast/pkg/receiver/cast_channel"
+)
+
+// Conn that records sent payloads
+type testConn struct {
+	sent chan string
+}
+
+func newTestConn() *testConn { return &testConn{sent: make(chan string, 100)} }
+
+func (*testConn) Auth(*receiver.DeviceAuthRequestMessage) (*cast_channel.AuthResponse, error) {
+	return nil, nil
+}
+
+func (*testConn) Receive() (*cast_channel.CastMessage, error) { return nil, io.EOF }
+
+func (t *testConn) Send(msg *cast_channel.CastMessage) error {
+	t.sent <- msg.GetPayloadUtf8()
+	return nil
+}
+
+func (*testConn) Close() error { return nil }
+
+type testResponse struct {
+	Type      string                  `json:"type"`
+	RequestID int                     `json:"requestId"`
+	Reason    string                  `json:"reason"`
+	Status    []*receiver.MediaStatus `json:"status"`
+}
+
+// Sends the media namespace request to the app and returns the reply to it,
+// skipping broadcasts
+func request(t *testing.T, m Media, conn *testConn, payload map[string]interface{}) *testResponse {
+	raw := new(receiver.MessageBuilder).SetNamespace(receiver.NamespaceMedia).SetDestinationID("receiver-1").
+		MustSetJSONPayload(payload).Ref()
+	source := "sender-1"
+	raw.SourceId = &source
+	msg, err := receiver.UnmarshalRequestMessage(raw)
+	if err != nil {
+		t.Fatal(err)
+	} else if err = m.HandleMessage(context.Background(), conn, "transport", msg); err != nil {
+		t.Fatal(err)
+	}
+	requestID := payload["requestId"].(int)
+	for {
+		select {
+		case b := <-conn.sent:
+			var resp testResponse
+			if err := json.Unmarshal([]byte(b), &resp); err != nil {
+				t.Fatal(err)
+			} else if resp.RequestID == requestID {
+				return &resp
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for reply to %v", payload["type"])
+		}
+	}
+}
+
+func TestLoadMediaStatus(t *testing.T) {
+	srv := newTestServer(t, map[string]string{
+		"/video.m3u8": "#EXTM3U\n#EXTINF:4,\na.ts\n#EXTINF:5.5,\nb.ts\n#EXT-X-ENDLIST\n",
+	})
+	m, err := New(Config{
+		HTTPClient: srv.Client(),
+		NewPlayer: func() receiver.Player {
+			return receiver.NewSimulatedPlayer(receiver.SimulatedPlayerConfig{ManualClock: true})
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	} else if err = m.Start(context.Background(), "transport", AppID, nil); err != nil {
+		t.Fatal(err)
+	}
+	defer m.Stop(context.Background(), "transport")
+	conn := newTestConn()
+
+	// Nothing loaded yet
+	resp := request(t, m, conn, map[string]interface{}{"type": "GET_STATUS", "requestId": 1})
+	if resp.Type != "MEDIA_STATUS" || len(resp.Status) != 0 {
+		t.Fatalf("unexpected response %+v", resp)
+	}
+
+	// Load replies once fetched with the duration from the playlist
+	resp = request(t, m, conn, map[string]interface{}{
+		"type":        "LOAD",
+		"requestId":   2,
+		"currentTime": 3,
+		"media":       map[string]interface{}{"contentId": srv.URL + "/video.m3u8", "streamType": "BUFFERED"},
+	})
+	if resp.Type != "MEDIA_STATUS" || len(resp.Status) != 1 {
+		t.Fatalf("unexpected response %+v", resp)
+	}
+	status := resp.Status[0]
+	if status.MediaSessionID == 0 || status.PlayerState != receiver.PlayerStatePlaying || status.CurrentTime != 3 {
+		t.Fatalf("unexpected status %+v", status)
+	} else if status.Media == nil || status.Media.Duration == nil || *status.Media.Duration != 9.5 {
+		t.Fatalf("unexpected media %+v", status.Media)
+	}
+	mediaSessionID := status.MediaSessionID
+
+	// Commands need the current media session ID
+	resp = request(t, m, conn, map[string]interface{}{"type": "PAUSE", "requestId": 3, "mediaSessionId": mediaSessionID})
+	if resp.Type != "MEDIA_STATUS" || resp.Status[0].PlayerState != receiver.PlayerStatePaused {
+		t.Fatalf("unexpected response %+v", resp)
+	}
+	resp = request(t, m, conn, map[string]interface{}{"type": "PLAY", "requestId": 4, "mediaSessionId": mediaSessionID + 1})
+	if resp.Type != receiver.MediaErrorInvalidRequest || resp.Reason != "INVALID_MEDIA_SESSION_ID" {
+		t.Fatalf("unexpected response %+v", resp)
+	}
+
+	// Failed load leaves the previous media idle with an error
+	resp = request(t, m, conn, map[string]interface{}{
+		"type":      "LOAD",
+		"requestId": 5,
+		"media":     map[string]interface{}{"contentId": srv.URL + "/missing.mp4"},
+	})
+	if resp.Type != receiver.MediaErrorLoadFailed {
+		t.Fatalf("unexpected response %+v", resp)
+	}
+	resp = request(t, m, conn, map[string]interface{}{"type": "GET_STATUS", "requestId": 6})
+	if len(resp.Status) != 1 || resp.Status[0].MediaSessionID != mediaSessionID ||
+		resp.Status[0].PlayerState != receiver.PlayerStateIdle || resp.Status[0].IdleReason != receiver.IdleReasonError {
+		t.Fatalf("unexpected response %+v", resp)
+	}
+
+	// Missing media is rejected right away
+	resp = request(t, m, conn, map[string]interface{}{"type": "LOAD", "requestId": 7})
+	if resp.Type != receiver.MediaErrorInvalidRequest || resp.Reason != "INVALID_PARAMS" {
+		t.Fatalf("unexpected response %+v", resp)
+	}
+}
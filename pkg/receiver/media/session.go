@@ -0,0 +1,709 @@
+package media
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/cretz/takecast/pkg/receiver"
+	"github.com/google/uuid"
+)
+
+// How often to check whether the upcoming queue item should preload
+const preloadCheckInterval = time.Second
+
+// A media app session for a transport
+type session struct {
+	media *media
+	// Never changed after creation
+	metadata *receiver.ApplicationMetadata
+	status   receiver.MediaStatusBroadcaster
+	player   receiver.Player
+	// Closed when the session is closed
+	done chan struct{}
+
+	lock sync.Mutex // Governs fields below
+	// 0 until media is loaded
+	mediaSessionID int
+	queue          receiver.MediaQueue
+	// The playing media, a copy of the current queue item's media
+	info         *receiver.MediaInformation
+	playerState  string
+	idleReason   string
+	playbackRate float64
+	// Stream volume as set by senders
+	volume receiver.Volume
+	// Receiver volume, applied on top of the stream volume for the player
+	receiverVolume receiver.Volume
+	activeTrackIDs []int
+	// Cancels the current media's download and playback
+	cancelLoad context.CancelFunc
+	// Incremented on each load so outdated background loads are dropped
+	loadGen int
+	// Item ID being loaded in the background, 0 if none
+	loadingItemID int
+	// Nil unless the upcoming queue item was fetched ahead of time
+	preloaded *prepared
+	closed    bool
+}
+
+// Media that was fetched and is ready to play
+type prepared struct {
+	item *receiver.QueueItem
+	// Copy of the item's media with the duration set if found while fetching
+	info   *receiver.MediaInformation
+	probe  *probe
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func (p *prepared) discard() {
+	p.cancel()
+	if p.probe.body != nil {
+		p.probe.body.Close()
+	}
+}
+
+func (p *prepared) autoplay() bool { return p.item.Autoplay == nil || *p.item.Autoplay }
+
+func newSession(m *media) *session {
+	s := &session{
+		media:    m,
+		metadata: m.newApplicationMetadata(),
+		player:   m.NewPlayer(),
+		done:     make(chan struct{}),
+	}
+	s.metadata.SessionID = uuid.New().String()
+	s.volume.Level, s.receiverVolume.Level = 1, 1
+	go s.run()
+	return s
+}
+
+// Fetches the start of the item's media to check it can be played
+func (s *session) prepare(item *receiver.QueueItem) (*prepared, error) {
+	if item.Media == nil {
+		return nil, fmt.Errorf("missing media")
+	}
+	rawURL := item.Media.ContentURL
+	if rawURL == "" {
+		rawURL = item.Media.ContentID
+	}
+	// The fetch context lasts for the life of the media, but the first fetch is
+	// limited
+	ctx, cancel := context.WithCancel(context.Background())
+	probeTimer := time.AfterFunc(fetchTimeout, cancel)
+	p, err := fetchProbe(ctx, s.media.HTTPClient, rawURL, item.Media.ContentType)
+	if !probeTimer.Stop() && err == nil {
+		if p.body != nil {
+			p.body.Close()
+		}
+		err = context.DeadlineExceeded
+	}
+	if err != nil {
+		cancel()
+		return nil, fmt.Errorf("failed loading media from %v: %w", rawURL, err)
+	}
+	info := *item.Media
+	if info.Duration == nil && p.duration > 0 {
+		info.Duration = &p.duration
+	}
+	return &prepared{item: item, info: &info, probe: p, ctx: ctx, cancel: cancel}, nil
+}
+
+// Replaces the current media with the prepared media and starts downloading it
+// if configured
+func (s *session) startUnlocked(p *prepared, startTime float64) error {
+	err := s.player.Load(p.ctx, &receiver.PlayerLoad{
+		Media:        p.info,
+		URL:          p.probe.url,
+		StartTime:    startTime,
+		Autoplay:     p.autoplay(),
+		PlaybackRate: s.playbackRate,
+		Volume:       s.playerVolumeUnlocked(s.volume),
+	})
+	if err != nil {
+		return err
+	}
+	if s.cancelLoad != nil {
+		s.cancelLoad()
+	}
+	if s.preloaded != nil && s.preloaded != p {
+		s.preloaded.discard()
+	}
+	s.info, s.cancelLoad, s.loadingItemID, s.preloaded = p.info, p.cancel, 0, nil
+	s.playerState, s.idleReason = receiver.PlayerStatePaused, ""
+	if p.autoplay() {
+		s.playerState = receiver.PlayerStatePlaying
+	}
+	s.activeTrackIDs = p.item.ActiveTrackIDs
+	rawURL := p.probe.url.String()
+	s.media.Log.Infof("Loaded media %v", rawURL)
+	// Download or just close the body
+	go func() {
+		if s.media.DownloadDir == "" {
+			if p.probe.body != nil {
+				p.probe.body.Close()
+			}
+			return
+		}
+		if filename, err := download(p.ctx, s.media.HTTPClient, p.probe, s.media.DownloadDir); err != nil {
+			s.media.Log.Warnf("Failed downloading %v to %v: %v", rawURL, filename, err)
+		} else {
+			s.media.Log.Infof("Downloaded %v to %v", rawURL, filename)
+		}
+	}()
+	return nil
+}
+
+// Fetches the current item of the queue loadQueue applies in the background,
+// then replaces any current media and queue with it under a new media session
+// ID and replies. loadQueue is given a copy of the queue with the lock held and
+// is checked before fetching so invalid loads are rejected immediately.
+func (s *session) load(
+	conn receiver.Conn,
+	msg receiver.RequestMessage,
+	startTime float64,
+	playbackRate float64,
+	loadQueue func(*receiver.MediaQueue) error,
+) error {
+	s.lock.Lock()
+	if s.closed {
+		s.lock.Unlock()
+		return sendError(conn, msg, receiver.MediaErrorLoadCancelled, "")
+	}
+	// The queue is only replaced once loaded
+	queue := s.queue
+	if err := loadQueue(&queue); err != nil {
+		s.lock.Unlock()
+		s.media.Log.Debugf("Invalid queue load: %v", err)
+		return sendError(conn, msg, receiver.MediaErrorInvalidRequest, "INVALID_PARAMS")
+	}
+	// Drop any other background loads and buffer any current media meanwhile
+	s.loadGen++
+	gen := s.loadGen
+	var status []*receiver.MediaStatus
+	if s.mediaSessionID != 0 && s.playerState != receiver.PlayerStateIdle {
+		if err := s.player.Pause(); err != nil {
+			s.media.Log.Warnf("Failed pausing media player: %v", err)
+		}
+		s.playerState, s.loadingItemID = receiver.PlayerStateBuffering, 0
+		status = s.statusUnlocked()
+	}
+	s.lock.Unlock()
+	if status != nil {
+		s.status.Broadcast(status...)
+	}
+	// Fetching can take a while, so it is not done while handling the message
+	go func() {
+		if err := s.finishLoad(conn, msg, gen, queue, startTime, playbackRate); err != nil {
+			s.media.Log.Debugf("Failed replying to load: %v", err)
+		}
+	}()
+	return nil
+}
+
+// Fetches and starts the current item of the queue, replying with the status
+// or an error unless another load happened since the given generation
+func (s *session) finishLoad(
+	conn receiver.Conn,
+	msg receiver.RequestMessage,
+	gen int,
+	queue receiver.MediaQueue,
+	startTime float64,
+	playbackRate float64,
+) error {
+	p, err := s.prepare(queue.Current())
+	var mediaSessionID int
+	if err == nil {
+		mediaSessionID = s.media.nextMediaSessionID()
+	}
+	s.lock.Lock()
+	if s.closed || s.loadGen != gen {
+		s.lock.Unlock()
+		if p != nil {
+			p.discard()
+		}
+		return sendError(conn, msg, receiver.MediaErrorLoadCancelled, "")
+	}
+	if err == nil {
+		s.playbackRate = playbackRate
+		if s.playbackRate <= 0 {
+			s.playbackRate = 1
+		}
+		if err = s.startUnlocked(p, startTime); err != nil {
+			p.discard()
+		}
+	}
+	if err != nil {
+		s.media.Log.Warnf("Failed loading: %v", err)
+		// Any current media was stopped for this load
+		var status []*receiver.MediaStatus
+		if s.playerState == receiver.PlayerStateBuffering {
+			s.playerState, s.idleReason = receiver.PlayerStateIdle, receiver.IdleReasonError
+			status = s.statusUnlocked()
+		}
+		s.lock.Unlock()
+		if status != nil {
+			s.status.Broadcast(status...)
+		}
+		return sendError(conn, msg, receiver.MediaErrorLoadFailed, "")
+	}
+	s.queue, s.mediaSessionID = queue, mediaSessionID
+	status := s.statusUnlocked()
+	s.lock.Unlock()
+	return s.status.Reply(conn, msg, status...)
+}
+
+func (s *session) loadMedia(conn receiver.Conn, msg *receiver.LoadRequestMessage) error {
+	if msg.Media == nil {
+		return sendError(conn, msg, receiver.MediaErrorInvalidRequest, "INVALID_PARAMS")
+	}
+	item := &receiver.QueueItem{
+		Media:          msg.Media,
+		Autoplay:       msg.Autoplay,
+		StartTime:      msg.CurrentTime,
+		ActiveTrackIDs: msg.ActiveTrackIDs,
+	}
+	return s.load(conn, msg, msg.CurrentTime, msg.PlaybackRate, func(q *receiver.MediaQueue) error {
+		return q.Load([]*receiver.QueueItem{item}, 0, "")
+	})
+}
+
+func (s *session) loadQueue(conn receiver.Conn, msg *receiver.QueueLoadRequestMessage) error {
+	if msg.StartIndex < 0 || msg.StartIndex >= len(msg.Items) {
+		return sendError(conn, msg, receiver.MediaErrorInvalidRequest, "INVALID_PARAMS")
+	}
+	startTime := msg.Items[msg.StartIndex].StartTime
+	if msg.CurrentTime != nil {
+		startTime = *msg.CurrentTime
+	}
+	return s.load(conn, msg, startTime, 1, func(q *receiver.MediaQueue) error {
+		return q.Load(msg.Items, msg.StartIndex, msg.RepeatMode)
+	})
+}
+
+// Runs fn with the lock held if the media session ID is current, replying with
+// the status or the error type and reason fn returns
+func (s *session) command(
+	conn receiver.Conn,
+	msg receiver.RequestMessage,
+	mediaSessionID int,
+	fn func() (errType, reason string),
+) error {
+	s.lock.Lock()
+	if s.mediaSessionID == 0 || mediaSessionID != s.mediaSessionID {
+		s.lock.Unlock()
+		return sendError(conn, msg, receiver.MediaErrorInvalidRequest, "INVALID_MEDIA_SESSION_ID")
+	}
+	errType, reason := fn()
+	status := s.statusUnlocked()
+	s.lock.Unlock()
+	if errType != "" {
+		return sendError(conn, msg, errType, reason)
+	}
+	return s.status.Reply(conn, msg, status...)
+}
+
+// Like command, but replies with the payload fn returns
+func (s *session) query(
+	conn receiver.Conn,
+	msg receiver.RequestMessage,
+	mediaSessionID int,
+	fn func() interface{},
+) error {
+	s.lock.Lock()
+	if s.mediaSessionID == 0 || mediaSessionID != s.mediaSessionID {
+		s.lock.Unlock()
+		return sendError(conn, msg, receiver.MediaErrorInvalidRequest, "INVALID_MEDIA_SESSION_ID")
+	}
+	resp := fn()
+	s.lock.Unlock()
+	return new(receiver.MessageBuilder).ApplyReceived(msg.Header().Raw).MustSetJSONPayload(resp).Send(conn)
+}
+
+func (s *session) currentStatus() []*receiver.MediaStatus {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.statusUnlocked()
+}
+
+// Empty if nothing loaded
+func (s *session) statusUnlocked() []*receiver.MediaStatus {
+	if s.mediaSessionID == 0 {
+		return []*receiver.MediaStatus{}
+	}
+	volume := s.volume
+	status := &receiver.MediaStatus{
+		MediaSessionID: s.mediaSessionID,
+		Media:          s.info,
+		PlaybackRate:   s.playbackRate,
+		PlayerState:    s.playerState,
+		IdleReason:     s.idleReason,
+		CurrentTime:    s.player.Position(),
+		SupportedMediaCommands: receiver.MediaCommandPause | receiver.MediaCommandSeek |
+			receiver.MediaCommandStreamVolume | receiver.MediaCommandStreamMute,
+		Volume:         &volume,
+		ActiveTrackIDs: s.activeTrackIDs,
+		LoadingItemID:  s.loadingItemID,
+	}
+	if len(s.info.Tracks) > 0 {
+		status.SupportedMediaCommands |= receiver.MediaCommandEditTracks
+	}
+	s.queue.ApplyStatus(status)
+	return []*receiver.MediaStatus{status}
+}
+
+// Handles player events and preloading until the session is closed
+func (s *session) run() {
+	preloadTicker := time.NewTicker(preloadCheckInterval)
+	defer preloadTicker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case event := <-s.player.Events():
+			s.handlePlayerEvent(event)
+		case <-preloadTicker.C:
+			s.checkPreload()
+		}
+	}
+}
+
+func (s *session) handlePlayerEvent(event receiver.PlayerEvent) {
+	s.lock.Lock()
+	// Ignore if for old media or no longer playing
+	if event.Media != s.info || s.playerState == receiver.PlayerStateIdle {
+		s.lock.Unlock()
+		return
+	}
+	switch event.Type {
+	case receiver.PlayerEventEnded:
+		// Auto-advance
+		before := s.currentItemIDUnlocked()
+		if next := s.queue.Next(); next != nil && next.ItemID == before {
+			// Repeating the same item, so just restart it
+			err := s.player.Seek(next.StartTime)
+			if err == nil {
+				err = s.player.Play()
+			}
+			if err != nil {
+				s.media.Log.Warnf("Failed repeating media: %v", err)
+				s.playerState, s.idleReason = receiver.PlayerStateIdle, receiver.IdleReasonError
+			}
+		} else {
+			s.loadCurrentItemUnlocked(nil)
+		}
+	case receiver.PlayerEventError:
+		s.media.Log.Warnf("Media player failed: %v", event.Err)
+		s.playerState, s.idleReason = receiver.PlayerStateIdle, receiver.IdleReasonError
+	}
+	status := s.statusUnlocked()
+	s.lock.Unlock()
+	s.status.Broadcast(status...)
+}
+
+// Fetches the upcoming queue item in the background if it is time to preload it
+func (s *session) checkPreload() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.playerState != receiver.PlayerStatePlaying || s.info.Duration == nil || s.preloaded != nil {
+		return
+	}
+	remaining := (*s.info.Duration - s.player.Position()) / s.playbackRate
+	item := s.queue.Preload(remaining)
+	if item == nil {
+		return
+	}
+	gen := s.loadGen
+	go func() {
+		p, err := s.prepare(item)
+		if err != nil {
+			s.media.Log.Warnf("Failed preloading: %v", err)
+			return
+		}
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		if s.closed || s.loadGen != gen || s.preloaded != nil {
+			p.discard()
+			return
+		}
+		s.preloaded = p
+	}()
+}
+
+// Loads the current queue item in the background, or goes idle if there is
+// none. Status is broadcast once loaded. If startTime is nil, the item's start
+// time is used.
+func (s *session) loadCurrentItemUnlocked(startTime *float64) {
+	s.loadGen++
+	if err := s.player.Pause(); err != nil {
+		s.media.Log.Warnf("Failed pausing media player: %v", err)
+	}
+	item := s.queue.Current()
+	if item == nil {
+		s.playerState, s.idleReason, s.loadingItemID = receiver.PlayerStateIdle, receiver.IdleReasonFinished, 0
+		if s.cancelLoad != nil {
+			s.cancelLoad()
+			s.cancelLoad = nil
+		}
+		return
+	}
+	s.playerState, s.loadingItemID = receiver.PlayerStateBuffering, item.ItemID
+	start := item.StartTime
+	if startTime != nil {
+		start = *startTime
+	}
+	// Use the preloaded media if it's for this item
+	var p *prepared
+	if s.preloaded != nil && s.preloaded.item == item {
+		p, s.preloaded = s.preloaded, nil
+	}
+	gen := s.loadGen
+	go func() {
+		var err error
+		if p == nil {
+			p, err = s.prepare(item)
+		}
+		s.lock.Lock()
+		if s.closed || s.loadGen != gen {
+			s.lock.Unlock()
+			if p != nil {
+				p.discard()
+			}
+			return
+		}
+		if err == nil {
+			if err = s.startUnlocked(p, start); err != nil {
+				p.discard()
+			}
+		}
+		if err != nil {
+			s.media.Log.Warnf("Failed loading queue item: %v", err)
+			s.playerState, s.idleReason, s.loadingItemID = receiver.PlayerStateIdle, receiver.IdleReasonError, 0
+		}
+		status := s.statusUnlocked()
+		s.lock.Unlock()
+		s.status.Broadcast(status...)
+	}()
+}
+
+// Loads the current queue item if it is no longer the one with the given ID,
+// otherwise seeks if a time is given
+func (s *session) currentItemChangedUnlocked(beforeItemID int, currentTime *float64) (string, string) {
+	if s.currentItemIDUnlocked() != beforeItemID {
+		s.loadCurrentItemUnlocked(currentTime)
+	} else if currentTime != nil {
+		if err := s.player.Seek(*currentTime); err != nil {
+			return s.playerErrorUnlocked(err)
+		}
+	}
+	return "", ""
+}
+
+// 0 if none
+func (s *session) currentItemIDUnlocked() int {
+	if item := s.queue.Current(); item != nil {
+		return item.ItemID
+	}
+	return 0
+}
+
+func (s *session) queueInsertUnlocked(msg *receiver.QueueInsertRequestMessage) (string, string) {
+	before := s.currentItemIDUnlocked()
+	inserted, err := s.queue.Insert(msg.Items, msg.InsertBefore)
+	if err == nil && msg.CurrentItemIndex != nil {
+		if *msg.CurrentItemIndex < 0 || *msg.CurrentItemIndex >= len(inserted) {
+			err = fmt.Errorf("invalid current item index %v", *msg.CurrentItemIndex)
+		} else {
+			err = s.queue.SetCurrent(inserted[*msg.CurrentItemIndex].ItemID)
+		}
+	} else if err == nil && msg.CurrentItemID != nil {
+		err = s.queue.SetCurrent(*msg.CurrentItemID)
+	}
+	if err != nil {
+		s.media.Log.Debugf("Invalid queue insert: %v", err)
+		return receiver.MediaErrorInvalidRequest, "INVALID_PARAMS"
+	}
+	return s.currentItemChangedUnlocked(before, msg.CurrentTime)
+}
+
+func (s *session) queueUpdateUnlocked(msg *receiver.QueueUpdateRequestMessage) (string, string) {
+	before := s.currentItemIDUnlocked()
+	err := s.queue.Update(msg.Items)
+	if err == nil && msg.RepeatMode != "" {
+		err = s.queue.SetRepeatMode(msg.RepeatMode)
+	}
+	if err == nil && msg.Shuffle != nil && *msg.Shuffle {
+		s.queue.Shuffle()
+	}
+	if err == nil && msg.CurrentItemID != nil {
+		err = s.queue.SetCurrent(*msg.CurrentItemID)
+	} else if err == nil && msg.Jump != nil {
+		s.queue.Jump(*msg.Jump)
+	}
+	if err != nil {
+		s.media.Log.Debugf("Invalid queue update: %v", err)
+		return receiver.MediaErrorInvalidRequest, "INVALID_PARAMS"
+	}
+	return s.currentItemChangedUnlocked(before, msg.CurrentTime)
+}
+
+func (s *session) queueRemoveUnlocked(msg *receiver.QueueRemoveRequestMessage) (string, string) {
+	before := s.currentItemIDUnlocked()
+	err := s.queue.Remove(msg.ItemIDs)
+	if err == nil && msg.CurrentItemID != nil {
+		err = s.queue.SetCurrent(*msg.CurrentItemID)
+	}
+	if err != nil {
+		s.media.Log.Debugf("Invalid queue remove: %v", err)
+		return receiver.MediaErrorInvalidRequest, "INVALID_PARAMS"
+	}
+	return s.currentItemChangedUnlocked(before, msg.CurrentTime)
+}
+
+func (s *session) queueReorderUnlocked(msg *receiver.QueueReorderRequestMessage) (string, string) {
+	before := s.currentItemIDUnlocked()
+	err := s.queue.Reorder(msg.ItemIDs, msg.InsertBefore)
+	if err == nil && msg.CurrentItemID != nil {
+		err = s.queue.SetCurrent(*msg.CurrentItemID)
+	}
+	if err != nil {
+		s.media.Log.Debugf("Invalid queue reorder: %v", err)
+		return receiver.MediaErrorInvalidRequest, "INVALID_PARAMS"
+	}
+	return s.currentItemChangedUnlocked(before, msg.CurrentTime)
+}
+
+// Logs the player error and returns the error type to reply with, if any
+func (s *session) playerErrorUnlocked(err error) (string, string) {
+	if err == nil {
+		return "", ""
+	}
+	s.media.Log.Warnf("Media player failed: %v", err)
+	return receiver.MediaErrorInvalidPlayerState, ""
+}
+
+func (s *session) playUnlocked() (string, string) {
+	if s.playerState == receiver.PlayerStateIdle {
+		return receiver.MediaErrorInvalidPlayerState, ""
+	} else if err := s.player.Play(); err != nil {
+		return s.playerErrorUnlocked(err)
+	}
+	s.playerState = receiver.PlayerStatePlaying
+	return "", ""
+}
+
+func (s *session) pauseUnlocked() (string, string) {
+	if s.playerState == receiver.PlayerStateIdle {
+		return receiver.MediaErrorInvalidPlayerState, ""
+	} else if err := s.player.Pause(); err != nil {
+		return s.playerErrorUnlocked(err)
+	}
+	s.playerState = receiver.PlayerStatePaused
+	return "", ""
+}
+
+func (s *session) seekUnlocked(msg *receiver.SeekRequestMessage) (string, string) {
+	if s.playerState == receiver.PlayerStateIdle {
+		return receiver.MediaErrorInvalidPlayerState, ""
+	}
+	pos := s.player.Position()
+	if msg.CurrentTime != nil {
+		pos = *msg.CurrentTime
+	} else if msg.RelativeTime != nil {
+		pos += *msg.RelativeTime
+	}
+	if err := s.player.Seek(pos); err != nil {
+		return s.playerErrorUnlocked(err)
+	}
+	switch msg.ResumeState {
+	case receiver.ResumeStatePlaybackStart:
+		return s.playUnlocked()
+	case receiver.ResumeStatePlaybackPause:
+		return s.pauseUnlocked()
+	}
+	return "", ""
+}
+
+func (s *session) stopUnlocked() (string, string) {
+	if s.playerState != receiver.PlayerStateIdle {
+		if err := s.player.Pause(); err != nil {
+			return s.playerErrorUnlocked(err)
+		}
+		s.playerState, s.idleReason = receiver.PlayerStateIdle, receiver.IdleReasonCancelled
+	}
+	// Also drop any background load
+	s.loadGen++
+	s.loadingItemID = 0
+	if s.cancelLoad != nil {
+		s.cancelLoad()
+		s.cancelLoad = nil
+	}
+	return "", ""
+}
+
+func (s *session) setVolumeUnlocked(change *receiver.VolumeChange) (string, string) {
+	if change == nil || change.Validate() != nil {
+		return receiver.MediaErrorInvalidRequest, "INVALID_PARAMS"
+	}
+	volume := change.Apply(s.volume)
+	if err := s.player.SetVolume(s.playerVolumeUnlocked(volume)); err != nil {
+		return s.playerErrorUnlocked(err)
+	}
+	s.volume = volume
+	return "", ""
+}
+
+func (s *session) setReceiverVolume(volume receiver.Volume) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.receiverVolume = volume
+	return s.player.SetVolume(s.playerVolumeUnlocked(s.volume))
+}
+
+// The stream volume scaled by the receiver volume
+func (s *session) playerVolumeUnlocked(stream receiver.Volume) receiver.Volume {
+	return receiver.Volume{
+		Level: stream.Level * s.receiverVolume.Level,
+		Muted: stream.Muted || s.receiverVolume.Muted,
+	}
+}
+
+func (s *session) editTracksUnlocked(msg *receiver.EditTracksInfoRequestMessage) (string, string) {
+	if msg.ActiveTrackIDs == nil {
+		return "", ""
+	}
+	for _, id := range msg.ActiveTrackIDs {
+		found := false
+		for _, track := range s.info.Tracks {
+			found = found || track.TrackID == id
+		}
+		if !found {
+			return receiver.MediaErrorInvalidRequest, "INVALID_TRACK_ID"
+		}
+	}
+	s.activeTrackIDs = msg.ActiveTrackIDs
+	return "", ""
+}
+
+func (s *session) close() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return
+	}
+	s.closed = true
+	if s.cancelLoad != nil {
+		s.cancelLoad()
+		s.cancelLoad = nil
+	}
+	if s.preloaded != nil {
+		s.preloaded.discard()
+		s.preloaded = nil
+	}
+	if err := s.player.Close(); err != nil {
+		s.media.Log.Warnf("Failed closing media player: %v", err)
+	}
+	close(s.done)
+}
@@ -0,0 +1,318 @@
+package receiver
+
+import (
+	"fmt"
+	"math/rand"
+)
+
+// MediaQueue is an ordered list of queue items with a current item, as managed
+// by the QUEUE_* media messages. It assigns item IDs, picks the next item to
+// auto-advance to based on the repeat mode, and decides when to preload it.
+// Apps use it by applying requests, comparing Current before and after to know
+// when to load another item, and calling Next when the current item ends. Not
+// safe for concurrent use, apps guard it with their own lock.
+type MediaQueue struct {
+	items      []*QueueItem
+	repeatMode string
+	// 0 if none
+	currentItemID   int
+	preloadedItemID int
+	lastItemID      int
+}
+
+// Replaces the queue with copies of the items, assigning new item IDs, and sets
+// the current item to the one at startIndex
+func (q *MediaQueue) Load(items []*QueueItem, startIndex int, repeatMode string) error {
+	if len(items) == 0 {
+		return fmt.Errorf("no items")
+	} else if startIndex < 0 || startIndex >= len(items) {
+		return fmt.Errorf("invalid start index %v", startIndex)
+	} else if err := validateRepeatMode(repeatMode); err != nil {
+		return err
+	}
+	q.items = nil
+	q.insert(items, len(q.items))
+	q.repeatMode = repeatMode
+	q.currentItemID, q.preloadedItemID = q.items[startIndex].ItemID, 0
+	return nil
+}
+
+// Inserts copies of the items with new item IDs before the item with the given
+// ID, or at the end if nil. Returns the inserted items.
+func (q *MediaQueue) Insert(items []*QueueItem, insertBefore *int) ([]*QueueItem, error) {
+	if len(items) == 0 {
+		return nil, fmt.Errorf("no items")
+	}
+	index := len(q.items)
+	if insertBefore != nil {
+		if index = q.index(*insertBefore); index < 0 {
+			return nil, fmt.Errorf("unknown item ID %v", *insertBefore)
+		}
+	}
+	// The upcoming item may have changed
+	q.preloadedItemID = 0
+	return q.insert(items, index), nil
+}
+
+func (q *MediaQueue) insert(items []*QueueItem, index int) []*QueueItem {
+	inserted := make([]*QueueItem, len(items))
+	for i, item := range items {
+		itemCopy := *item
+		q.lastItemID++
+		itemCopy.ItemID = q.lastItemID
+		inserted[i] = &itemCopy
+	}
+	newItems := make([]*QueueItem, 0, len(q.items)+len(inserted))
+	newItems = append(newItems, q.items[:index]...)
+	newItems = append(newItems, inserted...)
+	q.items = append(newItems, q.items[index:]...)
+	return inserted
+}
+
+// Replaces existing items by item ID. Items without media keep their existing
+// media.
+func (q *MediaQueue) Update(items []*QueueItem) error {
+	for _, item := range items {
+		index := q.index(item.ItemID)
+		if index < 0 {
+			return fmt.Errorf("unknown item ID %v", item.ItemID)
+		}
+		itemCopy := *item
+		if itemCopy.Media == nil {
+			itemCopy.Media = q.items[index].Media
+		}
+		q.items[index] = &itemCopy
+	}
+	return nil
+}
+
+// Removes the items. If the current item is removed, the next remaining item
+// becomes current, if any.
+func (q *MediaQueue) Remove(itemIDs []int) error {
+	for _, id := range itemIDs {
+		if q.index(id) < 0 {
+			return fmt.Errorf("unknown item ID %v", id)
+		}
+	}
+	currentIndex := q.index(q.currentItemID)
+	newItems := make([]*QueueItem, 0, len(q.items))
+	newCurrentItemID := 0
+	for i, item := range q.items {
+		if containsInt(itemIDs, item.ItemID) {
+			continue
+		}
+		if i == currentIndex || (i > currentIndex && newCurrentItemID == 0) {
+			newCurrentItemID = item.ItemID
+		}
+		newItems = append(newItems, item)
+	}
+	if currentIndex < 0 {
+		newCurrentItemID = 0
+	}
+	q.items, q.currentItemID, q.preloadedItemID = newItems, newCurrentItemID, 0
+	return nil
+}
+
+// Moves the items, in the given order, before the item with the given ID, or to
+// the end if nil
+func (q *MediaQueue) Reorder(itemIDs []int, insertBefore *int) error {
+	moved := make([]*QueueItem, len(itemIDs))
+	for i, id := range itemIDs {
+		index := q.index(id)
+		if index < 0 {
+			return fmt.Errorf("unknown item ID %v", id)
+		}
+		moved[i] = q.items[index]
+	}
+	if insertBefore != nil && (q.index(*insertBefore) < 0 || containsInt(itemIDs, *insertBefore)) {
+		return fmt.Errorf("invalid insert before item ID %v", *insertBefore)
+	}
+	newItems := make([]*QueueItem, 0, len(q.items))
+	for _, item := range q.items {
+		if insertBefore != nil && item.ItemID == *insertBefore {
+			newItems = append(newItems, moved...)
+		}
+		if !containsInt(itemIDs, item.ItemID) {
+			newItems = append(newItems, item)
+		}
+	}
+	if insertBefore == nil {
+		newItems = append(newItems, moved...)
+	}
+	q.items, q.preloadedItemID = newItems, 0
+	return nil
+}
+
+func (q *MediaQueue) RepeatMode() string {
+	if q.repeatMode == "" {
+		return RepeatModeOff
+	}
+	return q.repeatMode
+}
+
+// Empty means RepeatModeOff
+func (q *MediaQueue) SetRepeatMode(repeatMode string) error {
+	if err := validateRepeatMode(repeatMode); err != nil {
+		return err
+	}
+	q.repeatMode, q.preloadedItemID = repeatMode, 0
+	return nil
+}
+
+func validateRepeatMode(repeatMode string) error {
+	switch repeatMode {
+	case "", RepeatModeOff, RepeatModeAll, RepeatModeSingle, RepeatModeAllAndShuffle:
+		return nil
+	default:
+		return fmt.Errorf("invalid repeat mode %q", repeatMode)
+	}
+}
+
+// Randomizes the order of all items
+func (q *MediaQueue) Shuffle() {
+	rand.Shuffle(len(q.items), func(i, j int) { q.items[i], q.items[j] = q.items[j], q.items[i] })
+	q.preloadedItemID = 0
+}
+
+// Nil if none
+func (q *MediaQueue) Current() *QueueItem { return q.Item(q.currentItemID) }
+
+// Nil if not found
+func (q *MediaQueue) Item(itemID int) *QueueItem {
+	if index := q.index(itemID); index >= 0 {
+		return q.items[index]
+	}
+	return nil
+}
+
+func (q *MediaQueue) SetCurrent(itemID int) error {
+	if q.index(itemID) < 0 {
+		return fmt.Errorf("unknown item ID %v", itemID)
+	}
+	q.currentItemID, q.preloadedItemID = itemID, 0
+	return nil
+}
+
+// Moves the current item forward or back by the given amount, wrapping unless
+// the repeat mode is off. Returns the new current item, or nil if it moved past
+// either end.
+func (q *MediaQueue) Jump(n int) *QueueItem {
+	q.currentItemID, q.preloadedItemID = q.itemIDAfter(n), 0
+	return q.Current()
+}
+
+// Moves to the item to auto-advance to when the current item ends based on the
+// repeat mode, and returns it. Nil when the end of the queue is reached with
+// repeat off.
+func (q *MediaQueue) Next() *QueueItem {
+	// Reshuffle on wrap
+	if q.repeatMode == RepeatModeAllAndShuffle && q.index(q.currentItemID) == len(q.items)-1 {
+		q.Shuffle()
+		q.currentItemID = 0
+		if len(q.items) > 0 {
+			q.currentItemID = q.items[0].ItemID
+		}
+		return q.Current()
+	}
+	q.currentItemID, q.preloadedItemID = q.upcomingItemID(), 0
+	return q.Current()
+}
+
+// The item Next would move to without moving, or nil if none or unknown
+func (q *MediaQueue) Upcoming() *QueueItem { return q.Item(q.upcomingItemID()) }
+
+func (q *MediaQueue) upcomingItemID() int {
+	if q.repeatMode == RepeatModeSingle {
+		return q.currentItemID
+	} else if q.repeatMode == RepeatModeAllAndShuffle && q.index(q.currentItemID) == len(q.items)-1 {
+		// Not known until reshuffled
+		return 0
+	}
+	return q.itemIDAfter(1)
+}
+
+func (q *MediaQueue) itemIDAfter(n int) int {
+	index := q.index(q.currentItemID)
+	if index < 0 || len(q.items) == 0 {
+		return 0
+	}
+	index += n
+	if q.repeatMode == "" || q.repeatMode == RepeatModeOff {
+		if index < 0 || index >= len(q.items) {
+			return 0
+		}
+	} else {
+		index %= len(q.items)
+		if index < 0 {
+			index += len(q.items)
+		}
+	}
+	return q.items[index].ItemID
+}
+
+// Given the seconds remaining in the current item, returns the upcoming item if
+// it should start preloading now per its preload time. Each upcoming item is
+// only returned once.
+func (q *MediaQueue) Preload(remaining float64) *QueueItem {
+	upcoming := q.Upcoming()
+	if upcoming == nil || upcoming.ItemID == q.currentItemID || upcoming.ItemID == q.preloadedItemID ||
+		upcoming.PreloadTime <= 0 || remaining > upcoming.PreloadTime {
+		return nil
+	}
+	q.preloadedItemID = upcoming.ItemID
+	return upcoming
+}
+
+// The items with the given IDs, skipping unknown ones, or all items if none
+// given
+func (q *MediaQueue) Items(itemIDs ...int) []*QueueItem {
+	if len(itemIDs) == 0 {
+		return append([]*QueueItem{}, q.items...)
+	}
+	items := make([]*QueueItem, 0, len(itemIDs))
+	for _, id := range itemIDs {
+		if item := q.Item(id); item != nil {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func (q *MediaQueue) ItemIDs() []int {
+	ids := make([]int, len(q.items))
+	for i, item := range q.items {
+		ids[i] = item.ItemID
+	}
+	return ids
+}
+
+// Sets the queue fields on the status
+func (q *MediaQueue) ApplyStatus(status *MediaStatus) {
+	status.RepeatMode = q.RepeatMode()
+	status.CurrentItemID = q.currentItemID
+	status.PreloadedItemID = q.preloadedItemID
+	status.Items = q.Items()
+	if len(q.items) > 1 {
+		status.SupportedMediaCommands |= MediaCommandQueueNext | MediaCommandQueuePrev |
+			MediaCommandQueueShuffle | MediaCommandRepeatAll | MediaCommandRepeatSingle
+	}
+}
+
+// -1 if not found
+func (q *MediaQueue) index(itemID int) int {
+	for i, item := range q.items {
+		if item.ItemID == itemID {
+			return i
+		}
+	}
+	return -1
+}
+
+func containsInt(ints []int, v int) bool {
+	for _, i := range ints {
+		if i == v {
+			return true
+		}
+	}
+	return false
+}
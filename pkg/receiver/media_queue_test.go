@@ -0,0 +1,248 @@
+package receiver
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+)
+
+// Loads items with IDs 1 through n, each with the preload time
+func newTestQueue(t *testing.T, n int, current int, repeatMode string, preloadTime float64) *MediaQueue {
+	items := make([]*QueueItem, n)
+	for i := range items {
+		items[i] = &QueueItem{Media: &MediaInformation{ContentID: fmt.Sprint(i + 1)}, PreloadTime: preloadTime}
+	}
+	var q MediaQueue
+	if err := q.Load(items, current-1, repeatMode); err != nil {
+		t.Fatal(err)
+	}
+	return &q
+}
+
+func currentID(q *MediaQueue) int {
+	if item := q.Current(); item != nil {
+		return item.ItemID
+	}
+	return 0
+}
+
+func intPtr(v int) *int { return &v }
+
+func TestMediaQueueLoad(t *testing.T) {
+	q := newTestQueue(t, 3, 2, RepeatModeAll, 0)
+	if ids := fmt.Sprint(q.ItemIDs()); ids != "[1 2 3]" {
+		t.Fatalf("unexpected IDs %v", ids)
+	} else if currentID(q) != 2 || q.RepeatMode() != RepeatModeAll {
+		t.Fatalf("unexpected current %v or repeat mode %v", currentID(q), q.RepeatMode())
+	}
+	// Reloading assigns new IDs
+	if err := q.Load([]*QueueItem{{}}, 0, ""); err != nil {
+		t.Fatal(err)
+	} else if ids := fmt.Sprint(q.ItemIDs()); ids != "[4]" || q.RepeatMode() != RepeatModeOff {
+		t.Fatalf("unexpected IDs %v or repeat mode %v", ids, q.RepeatMode())
+	}
+	for name, fn := range map[string]func() error{
+		"no items":    func() error { return q.Load(nil, 0, "") },
+		"bad index":   func() error { return q.Load([]*QueueItem{{}}, 1, "") },
+		"bad repeat":  func() error { return q.Load([]*QueueItem{{}}, 0, "REPEAT_SOMETIMES") },
+		"bad before":  func() error { _, err := q.Insert([]*QueueItem{{}}, intPtr(99)); return err },
+		"empty input": func() error { _, err := q.Insert(nil, nil); return err },
+	} {
+		if fn() == nil {
+			t.Fatalf("expected error for %v", name)
+		}
+	}
+}
+
+func TestMediaQueueInsert(t *testing.T) {
+	q := newTestQueue(t, 2, 1, "", 0)
+	if inserted, err := q.Insert([]*QueueItem{{}, {}}, intPtr(2)); err != nil {
+		t.Fatal(err)
+	} else if len(inserted) != 2 || inserted[0].ItemID != 3 || inserted[1].ItemID != 4 {
+		t.Fatalf("unexpected inserted %v", inserted)
+	}
+	if _, err := q.Insert([]*QueueItem{{}}, nil); err != nil {
+		t.Fatal(err)
+	} else if ids := fmt.Sprint(q.ItemIDs()); ids != "[1 3 4 2 5]" {
+		t.Fatalf("unexpected IDs %v", ids)
+	}
+}
+
+func TestMediaQueueRemove(t *testing.T) {
+	tests := []struct {
+		name    string
+		current int
+		remove  []int
+		ids     string
+		// 0 if none
+		newCurrent int
+		err        bool
+	}{
+		{name: "current", current: 2, remove: []int{2}, ids: "[1 3 4]", newCurrent: 3},
+		{name: "current and next", current: 2, remove: []int{3, 2}, ids: "[1 4]", newCurrent: 4},
+		{name: "current is last", current: 4, remove: []int{4}, ids: "[1 2 3]", newCurrent: 0},
+		{name: "other", current: 2, remove: []int{1, 4}, ids: "[2 3]", newCurrent: 2},
+		{name: "all", current: 1, remove: []int{1, 2, 3, 4}, ids: "[]", newCurrent: 0},
+		{name: "unknown", current: 2, remove: []int{1, 9}, ids: "[1 2 3 4]", newCurrent: 2, err: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			q := newTestQueue(t, 4, test.current, "", 0)
+			if err := q.Remove(test.remove); (err != nil) != test.err {
+				t.Fatalf("expected error %v, got %v", test.err, err)
+			}
+			if ids := fmt.Sprint(q.ItemIDs()); ids != test.ids {
+				t.Fatalf("expected IDs %v, got %v", test.ids, ids)
+			} else if currentID(q) != test.newCurrent {
+				t.Fatalf("expected current %v, got %v", test.newCurrent, currentID(q))
+			}
+		})
+	}
+}
+
+func TestMediaQueueReorder(t *testing.T) {
+	tests := []struct {
+		name         string
+		reorder      []int
+		insertBefore *int
+		ids          string
+		err          bool
+	}{
+		{name: "to front", reorder: []int{4}, insertBefore: intPtr(1), ids: "[4 1 2 3]"},
+		{name: "to end", reorder: []int{1, 3}, ids: "[2 4 1 3]"},
+		{name: "given order", reorder: []int{3, 1}, insertBefore: intPtr(2), ids: "[3 1 2 4]"},
+		{name: "before self", reorder: []int{2, 3}, insertBefore: intPtr(3), ids: "[1 2 3 4]", err: true},
+		{name: "unknown item", reorder: []int{9}, ids: "[1 2 3 4]", err: true},
+		{name: "unknown before", reorder: []int{1}, insertBefore: intPtr(9), ids: "[1 2 3 4]", err: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			q := newTestQueue(t, 4, 2, "", 0)
+			if err := q.Reorder(test.reorder, test.insertBefore); (err != nil) != test.err {
+				t.Fatalf("expected error %v, got %v", test.err, err)
+			}
+			if ids := fmt.Sprint(q.ItemIDs()); ids != test.ids {
+				t.Fatalf("expected IDs %v, got %v", test.ids, ids)
+			} else if currentID(q) != 2 {
+				t.Fatalf("expected current unchanged, got %v", currentID(q))
+			}
+		})
+	}
+}
+
+func TestMediaQueueJumpNext(t *testing.T) {
+	tests := []struct {
+		name       string
+		repeatMode string
+		current    int
+		// Next if 0
+		jump int
+		// 0 if none
+		newCurrent int
+	}{
+		{name: "next", repeatMode: RepeatModeOff, current: 2, newCurrent: 3},
+		{name: "next past end", repeatMode: RepeatModeOff, current: 4, newCurrent: 0},
+		{name: "next wraps", repeatMode: RepeatModeAll, current: 4, newCurrent: 1},
+		{name: "next single", repeatMode: RepeatModeSingle, current: 2, newCurrent: 2},
+		{name: "jump forward", repeatMode: RepeatModeOff, current: 2, jump: 2, newCurrent: 4},
+		{name: "jump past start", repeatMode: RepeatModeOff, current: 1, jump: -1, newCurrent: 0},
+		{name: "jump back wraps", repeatMode: RepeatModeAll, current: 1, jump: -1, newCurrent: 4},
+		{name: "jump wraps more than once", repeatMode: RepeatModeAll, current: 3, jump: 6, newCurrent: 1},
+		// Jumps ignore single repeat but still wrap
+		{name: "jump single", repeatMode: RepeatModeSingle, current: 4, jump: 1, newCurrent: 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			q := newTestQueue(t, 4, test.current, test.repeatMode, 0)
+			var item *QueueItem
+			if test.jump == 0 {
+				item = q.Next()
+			} else {
+				item = q.Jump(test.jump)
+			}
+			if id := currentID(q); id != test.newCurrent {
+				t.Fatalf("expected current %v, got %v", test.newCurrent, id)
+			} else if (item == nil) != (test.newCurrent == 0) || (item != nil && item.ItemID != test.newCurrent) {
+				t.Fatalf("expected returned item %v, got %+v", test.newCurrent, item)
+			}
+		})
+	}
+}
+
+func TestMediaQueueShuffleOnWrap(t *testing.T) {
+	q := newTestQueue(t, 20, 19, RepeatModeAllAndShuffle, 0)
+	// Not at the end yet, so no shuffle
+	if item := q.Next(); item == nil || item.ItemID != 20 {
+		t.Fatalf("expected item 20, got %+v", item)
+	} else if ids := q.ItemIDs(); !sort.IntsAreSorted(ids) {
+		t.Fatalf("unexpected shuffle %v", ids)
+	}
+	// Upcoming is unknown until the shuffle
+	if item := q.Upcoming(); item != nil {
+		t.Fatalf("expected no upcoming item, got %+v", item)
+	}
+	item := q.Next()
+	ids := q.ItemIDs()
+	if item == nil || item.ItemID != ids[0] || currentID(q) != ids[0] {
+		t.Fatalf("expected first item %v current, got %+v", ids[0], item)
+	}
+	// Same items, almost certainly in a different order
+	sorted := append([]int{}, ids...)
+	sort.Ints(sorted)
+	if len(sorted) != 20 || sorted[0] != 1 || sorted[19] != 20 {
+		t.Fatalf("unexpected items after shuffle %v", ids)
+	} else if sort.IntsAreSorted(ids) {
+		t.Fatalf("expected shuffled order, got %v", ids)
+	}
+}
+
+func TestMediaQueuePreload(t *testing.T) {
+	tests := []struct {
+		name        string
+		repeatMode  string
+		current     int
+		preloadTime float64
+		remaining   float64
+		// 0 if none
+		preload int
+	}{
+		{name: "too early", current: 1, preloadTime: 5, remaining: 10},
+		{name: "due", current: 1, preloadTime: 5, remaining: 5, preload: 2},
+		{name: "no preload time", current: 1, preloadTime: 0, remaining: 1},
+		{name: "end of queue", current: 3, preloadTime: 5, remaining: 1},
+		{name: "wraps", repeatMode: RepeatModeAll, current: 3, preloadTime: 5, remaining: 1, preload: 1},
+		{name: "single repeat", repeatMode: RepeatModeSingle, current: 2, preloadTime: 5, remaining: 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			q := newTestQueue(t, 3, test.current, test.repeatMode, test.preloadTime)
+			item := q.Preload(test.remaining)
+			if (item == nil) != (test.preload == 0) || (item != nil && item.ItemID != test.preload) {
+				t.Fatalf("expected preload %v, got %+v", test.preload, item)
+			}
+			var status MediaStatus
+			q.ApplyStatus(&status)
+			if status.PreloadedItemID != test.preload {
+				t.Fatalf("expected preloaded ID %v, got %v", test.preload, status.PreloadedItemID)
+			}
+		})
+	}
+
+	// Only returned once until the upcoming item may have changed
+	q := newTestQueue(t, 3, 1, "", 5)
+	if item := q.Preload(1); item == nil || item.ItemID != 2 {
+		t.Fatalf("expected preload 2, got %+v", item)
+	} else if item = q.Preload(1); item != nil {
+		t.Fatalf("expected no second preload, got %+v", item)
+	}
+	if err := q.Reorder([]int{3}, intPtr(2)); err != nil {
+		t.Fatal(err)
+	} else if item := q.Preload(1); item == nil || item.ItemID != 3 {
+		t.Fatalf("expected preload 3 after reorder, got %+v", item)
+	}
+	if q.Next(); currentID(q) != 3 {
+		t.Fatalf("expected current 3, got %v", currentID(q))
+	} else if item := q.Preload(1); item == nil || item.ItemID != 2 {
+		t.Fatalf("expected preload 2 after next, got %+v", item)
+	}
+}
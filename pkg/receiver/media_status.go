@@ -0,0 +1,60 @@
+package receiver
+
+import (
+	"sync"
+
+	"github.com/cretz/takecast/pkg/receiver/cast_channel"
+)
+
+// Broadcast destination ID for messages to all senders on a connection
+const BroadcastDestinationID = "*"
+
+// MediaStatusBroadcaster tracks the senders that have sent media messages to
+// an application session and sends them media status. Apps call AddSender for
+// every received media message, Reply to answer requests, and Broadcast when
+// status changes on its own, e.g. when playback ends. Safe for concurrent use.
+type MediaStatusBroadcaster struct {
+	lock sync.Mutex
+	// Keyed by conn, value is the last raw message received from it
+	senders map[Conn]*cast_channel.CastMessage
+}
+
+// Remembers the message's sender for broadcasts
+func (m *MediaStatusBroadcaster) AddSender(conn Conn, msg RequestMessage) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.senders == nil {
+		m.senders = map[Conn]*cast_channel.CastMessage{}
+	}
+	m.senders[conn] = msg.Header().Raw
+}
+
+// Forgets the sender, e.g. when its connection is closed
+func (m *MediaStatusBroadcaster) RemoveSender(conn Conn) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	delete(m.senders, conn)
+}
+
+// Sends the status in reply to the request, echoing its request ID
+func (m *MediaStatusBroadcaster) Reply(conn Conn, req RequestMessage, status ...*MediaStatus) error {
+	return new(MessageBuilder).ApplyReceived(req.Header().Raw).MustSetJSONPayload(&MediaStatusResponseMessage{
+		MessageHeader: MessageHeader{Type: "MEDIA_STATUS", RequestID: req.Header().RequestID},
+		Status:        status,
+	}).Send(conn)
+}
+
+// Sends the status to all known senders with no request ID. Senders that fail
+// to receive it are forgotten.
+func (m *MediaStatusBroadcaster) Broadcast(status ...*MediaStatus) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	resp := &MediaStatusResponseMessage{MessageHeader: MessageHeader{Type: "MEDIA_STATUS"}, Status: status}
+	for conn, raw := range m.senders {
+		err := new(MessageBuilder).ApplyReceived(raw).SetDestinationID(BroadcastDestinationID).
+			SetNamespace(NamespaceMedia).MustSetJSONPayload(resp).Send(conn)
+		if err != nil {
+			delete(m.senders, conn)
+		}
+	}
+}
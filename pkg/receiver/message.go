@@ -43,6 +43,21 @@ type UnknownRequestMessage struct {
 	*RequestMessageHeader
 }
 
+// InvalidMessageError is returned by UnmarshalRequestMessage when the payload
+// cannot be decoded. It only affects that message, so receivers can reply with
+// INVALID_REQUEST and continue.
+type InvalidMessageError struct {
+	// Type and request ID are empty if the header could not be decoded
+	Header *RequestMessageHeader
+	Err    error
+}
+
+func (i *InvalidMessageError) Error() string {
+	return fmt.Sprintf("invalid %v message on %v: %v", i.Header.Type, i.Header.Raw.GetNamespace(), i.Err)
+}
+
+func (i *InvalidMessageError) Unwrap() error { return i.Err }
+
 func (r *RequestMessageHeader) UnmarshalHeader() error {
 	if r.Raw.PayloadUtf8 == nil {
 		return fmt.Errorf("missing string payload")
@@ -59,7 +74,7 @@ func UnmarshalRequestMessage(raw *cast_channel.CastMessage) (msg RequestMessage,
 	hdr := &RequestMessageHeader{Raw: raw}
 	if hdr.Raw.GetNamespace() != NamespaceDeviceAuth {
 		if err = hdr.UnmarshalHeader(); err != nil {
-			return nil, err
+			return nil, &InvalidMessageError{Header: &RequestMessageHeader{Raw: raw}, Err: err}
 		}
 	}
 	switch ns := hdr.Raw.GetNamespace(); ns {
@@ -76,7 +91,10 @@ func UnmarshalRequestMessage(raw *cast_channel.CastMessage) (msg RequestMessage,
 	case NamespaceWebRTC:
 		msg, err = UnmarshalWebRTCRequestMessage(hdr)
 	}
-	if msg == nil && err == nil {
+	if err != nil {
+		// The header was fine but the rest of the payload was not
+		return nil, &InvalidMessageError{Header: hdr, Err: err}
+	} else if msg == nil {
 		msg = &UnknownRequestMessage{RequestMessageHeader: hdr}
 	}
 	return
@@ -27,6 +27,11 @@ func (m *MessageBuilder) ApplyReceived(r *cast_channel.CastMessage) *MessageBuil
 	return m
 }
 
+func (m *MessageBuilder) SetDestinationID(id string) *MessageBuilder {
+	m.DestinationId = &id
+	return m
+}
+
 func (m *MessageBuilder) SetNamespace(n string) *MessageBuilder {
 	m.Namespace = &n
 	return m
@@ -1,14 +1,399 @@
 package receiver
 
+import "fmt"
+
 type GetMediaStatusRequestMessage struct {
 	*RequestMessageHeader
+	// Nil for all media sessions
+	MediaSessionID *int `json:"mediaSessionId"`
+}
+
+type LoadRequestMessage struct {
+	*RequestMessageHeader
+	SessionID string            `json:"sessionId"`
+	Media     *MediaInformation `json:"media"`
+	// Nil means true
+	Autoplay        *bool       `json:"autoplay"`
+	CurrentTime     float64     `json:"currentTime"`
+	ActiveTrackIDs  []int       `json:"activeTrackIds"`
+	PlaybackRate    float64     `json:"playbackRate"`
+	Credentials     string      `json:"credentials"`
+	CredentialsType string      `json:"credentialsType"`
+	CustomData      interface{} `json:"customData"`
+}
+
+// Whether the sender asked to start playing right away
+func (l *LoadRequestMessage) ShouldAutoplay() bool { return l.Autoplay == nil || *l.Autoplay }
+
+type PlayRequestMessage struct {
+	*RequestMessageHeader
+	MediaSessionID int         `json:"mediaSessionId"`
+	CustomData     interface{} `json:"customData"`
+}
+
+type PauseRequestMessage struct {
+	*RequestMessageHeader
+	MediaSessionID int         `json:"mediaSessionId"`
+	CustomData     interface{} `json:"customData"`
+}
+
+const (
+	ResumeStatePlaybackStart = "PLAYBACK_START"
+	ResumeStatePlaybackPause = "PLAYBACK_PAUSE"
+)
+
+type SeekRequestMessage struct {
+	*RequestMessageHeader
+	MediaSessionID int `json:"mediaSessionId"`
+	// In seconds, one of these is set
+	CurrentTime  *float64 `json:"currentTime"`
+	RelativeTime *float64 `json:"relativeTime"`
+	// Empty to keep the current state
+	ResumeState string      `json:"resumeState"`
+	CustomData  interface{} `json:"customData"`
+}
+
+type StopMediaRequestMessage struct {
+	*RequestMessageHeader
+	MediaSessionID int         `json:"mediaSessionId"`
+	CustomData     interface{} `json:"customData"`
+}
+
+type SetMediaVolumeRequestMessage struct {
+	*RequestMessageHeader
+	MediaSessionID int           `json:"mediaSessionId"`
+	Volume         *VolumeChange `json:"volume"`
+	CustomData     interface{}   `json:"customData"`
+}
+
+// Requested volume change, nil fields are unchanged
+type VolumeChange struct {
+	Level *float64 `json:"level,omitempty"`
+	Muted *bool    `json:"muted,omitempty"`
+}
+
+// Fails if the level is set and not from 0 to 1
+func (v *VolumeChange) Validate() error {
+	if v.Level != nil && (*v.Level < 0 || *v.Level > 1) {
+		return fmt.Errorf("invalid volume level %v", *v.Level)
+	}
+	return nil
+}
+
+// Returns the volume with the change applied
+func (v *VolumeChange) Apply(volume Volume) Volume {
+	if v.Level != nil {
+		volume.Level = *v.Level
+	}
+	if v.Muted != nil {
+		volume.Muted = *v.Muted
+	}
+	return volume
+}
+
+type EditTracksInfoRequestMessage struct {
+	*RequestMessageHeader
+	MediaSessionID int `json:"mediaSessionId"`
+	// Nil to leave unchanged
+	ActiveTrackIDs   []int           `json:"activeTrackIds"`
+	TextTrackStyle   *TextTrackStyle `json:"textTrackStyle"`
+	Language         string          `json:"language"`
+	EnableTextTracks *bool           `json:"enableTextTracks"`
+	CustomData       interface{}     `json:"customData"`
+}
+
+type QueueLoadRequestMessage struct {
+	*RequestMessageHeader
+	SessionID  string       `json:"sessionId"`
+	Items      []*QueueItem `json:"items"`
+	StartIndex int          `json:"startIndex"`
+	// Empty means RepeatModeOff
+	RepeatMode  string      `json:"repeatMode"`
+	CurrentTime *float64    `json:"currentTime"`
+	CustomData  interface{} `json:"customData"`
+}
+
+type QueueInsertRequestMessage struct {
+	*RequestMessageHeader
+	MediaSessionID int          `json:"mediaSessionId"`
+	Items          []*QueueItem `json:"items"`
+	// Item ID to insert before, nil to append
+	InsertBefore *int `json:"insertBefore"`
+	// Index into items to jump to after inserting, if any
+	CurrentItemIndex *int        `json:"currentItemIndex"`
+	CurrentItemID    *int        `json:"currentItemId"`
+	CurrentTime      *float64    `json:"currentTime"`
+	CustomData       interface{} `json:"customData"`
+}
+
+type QueueUpdateRequestMessage struct {
+	*RequestMessageHeader
+	MediaSessionID int `json:"mediaSessionId"`
+	// Existing items to update by item ID
+	Items         []*QueueItem `json:"items"`
+	CurrentItemID *int         `json:"currentItemId"`
+	// Items to skip forward or back from the current one
+	Jump        *int        `json:"jump"`
+	RepeatMode  string      `json:"repeatMode"`
+	Shuffle     *bool       `json:"shuffle"`
+	CurrentTime *float64    `json:"currentTime"`
+	CustomData  interface{} `json:"customData"`
+}
+
+type QueueRemoveRequestMessage struct {
+	*RequestMessageHeader
+	MediaSessionID int         `json:"mediaSessionId"`
+	ItemIDs        []int       `json:"itemIds"`
+	CurrentItemID  *int        `json:"currentItemId"`
+	CurrentTime    *float64    `json:"currentTime"`
+	CustomData     interface{} `json:"customData"`
+}
+
+type QueueReorderRequestMessage struct {
+	*RequestMessageHeader
+	MediaSessionID int   `json:"mediaSessionId"`
+	ItemIDs        []int `json:"itemIds"`
+	// Item ID to move the items before, nil to move them to the end
+	InsertBefore  *int        `json:"insertBefore"`
+	CurrentItemID *int        `json:"currentItemId"`
+	CurrentTime   *float64    `json:"currentTime"`
+	CustomData    interface{} `json:"customData"`
+}
+
+type QueueGetItemIDsRequestMessage struct {
+	*RequestMessageHeader
+	MediaSessionID int `json:"mediaSessionId"`
+}
+
+type QueueGetItemsRequestMessage struct {
+	*RequestMessageHeader
+	MediaSessionID int   `json:"mediaSessionId"`
+	ItemIDs        []int `json:"itemIds"`
 }
 
 func UnmarshalMediaRequestMessage(hdr *RequestMessageHeader) (RequestMessage, error) {
 	switch hdr.Type {
 	case "GET_STATUS":
-		return &GetMediaStatusRequestMessage{RequestMessageHeader: hdr}, nil
+		return UnmarshalJSONRequestMessage(&GetMediaStatusRequestMessage{RequestMessageHeader: hdr})
+	case "LOAD":
+		return UnmarshalJSONRequestMessage(&LoadRequestMessage{RequestMessageHeader: hdr})
+	case "PLAY":
+		return UnmarshalJSONRequestMessage(&PlayRequestMessage{RequestMessageHeader: hdr})
+	case "PAUSE":
+		return UnmarshalJSONRequestMessage(&PauseRequestMessage{RequestMessageHeader: hdr})
+	case "SEEK":
+		return UnmarshalJSONRequestMessage(&SeekRequestMessage{RequestMessageHeader: hdr})
+	case "STOP":
+		return UnmarshalJSONRequestMessage(&StopMediaRequestMessage{RequestMessageHeader: hdr})
+	case "SET_VOLUME":
+		return UnmarshalJSONRequestMessage(&SetMediaVolumeRequestMessage{RequestMessageHeader: hdr})
+	case "EDIT_TRACKS_INFO":
+		return UnmarshalJSONRequestMessage(&EditTracksInfoRequestMessage{RequestMessageHeader: hdr})
+	case "QUEUE_LOAD":
+		return UnmarshalJSONRequestMessage(&QueueLoadRequestMessage{RequestMessageHeader: hdr})
+	case "QUEUE_INSERT":
+		return UnmarshalJSONRequestMessage(&QueueInsertRequestMessage{RequestMessageHeader: hdr})
+	case "QUEUE_UPDATE":
+		return UnmarshalJSONRequestMessage(&QueueUpdateRequestMessage{RequestMessageHeader: hdr})
+	case "QUEUE_REMOVE":
+		return UnmarshalJSONRequestMessage(&QueueRemoveRequestMessage{RequestMessageHeader: hdr})
+	case "QUEUE_REORDER":
+		return UnmarshalJSONRequestMessage(&QueueReorderRequestMessage{RequestMessageHeader: hdr})
+	case "QUEUE_GET_ITEM_IDS":
+		return UnmarshalJSONRequestMessage(&QueueGetItemIDsRequestMessage{RequestMessageHeader: hdr})
+	case "QUEUE_GET_ITEMS":
+		return UnmarshalJSONRequestMessage(&QueueGetItemsRequestMessage{RequestMessageHeader: hdr})
 	default:
 		return nil, nil
 	}
 }
+
+const (
+	StreamTypeBuffered = "BUFFERED"
+	StreamTypeLive     = "LIVE"
+	StreamTypeNone     = "NONE"
+)
+
+type MediaInformation struct {
+	// Usually the URL to play, though apps can use it as an ID and put the URL
+	// in ContentURL
+	ContentID   string `json:"contentId"`
+	ContentURL  string `json:"contentUrl,omitempty"`
+	StreamType  string `json:"streamType,omitempty"`
+	ContentType string `json:"contentType,omitempty"`
+	// Nil if none
+	Metadata *MediaMetadata `json:"metadata,omitempty"`
+	// In seconds, nil if unknown or live
+	Duration       *float64        `json:"duration,omitempty"`
+	Tracks         []*MediaTrack   `json:"tracks,omitempty"`
+	TextTrackStyle *TextTrackStyle `json:"textTrackStyle,omitempty"`
+	CustomData     interface{}     `json:"customData,omitempty"`
+}
+
+const (
+	MetadataTypeGeneric = 0
+	MetadataTypeMovie   = 1
+	MetadataTypeTVShow  = 2
+	MetadataTypeMusic   = 3
+	MetadataTypePhoto   = 4
+)
+
+// Common fields across metadata types
+type MediaMetadata struct {
+	MetadataType int      `json:"metadataType"`
+	Title        string   `json:"title,omitempty"`
+	Subtitle     string   `json:"subtitle,omitempty"`
+	SeriesTitle  string   `json:"seriesTitle,omitempty"`
+	Season       int      `json:"season,omitempty"`
+	Episode      int      `json:"episode,omitempty"`
+	Artist       string   `json:"artist,omitempty"`
+	AlbumName    string   `json:"albumName,omitempty"`
+	AlbumArtist  string   `json:"albumArtist,omitempty"`
+	Studio       string   `json:"studio,omitempty"`
+	ReleaseDate  string   `json:"releaseDate,omitempty"`
+	Images       []*Image `json:"images,omitempty"`
+}
+
+type Image struct {
+	URL    string `json:"url"`
+	Width  int    `json:"width,omitempty"`
+	Height int    `json:"height,omitempty"`
+}
+
+const (
+	TrackTypeText  = "TEXT"
+	TrackTypeAudio = "AUDIO"
+	TrackTypeVideo = "VIDEO"
+)
+
+type MediaTrack struct {
+	TrackID          int    `json:"trackId"`
+	Type             string `json:"type"`
+	TrackContentID   string `json:"trackContentId,omitempty"`
+	TrackContentType string `json:"trackContentType,omitempty"`
+	Name             string `json:"name,omitempty"`
+	Language         string `json:"language,omitempty"`
+	// For text, SUBTITLES, CAPTIONS, DESCRIPTIONS, CHAPTERS, or METADATA
+	Subtype    string      `json:"subtype,omitempty"`
+	CustomData interface{} `json:"customData,omitempty"`
+}
+
+type TextTrackStyle struct {
+	BackgroundColor           string      `json:"backgroundColor,omitempty"`
+	ForegroundColor           string      `json:"foregroundColor,omitempty"`
+	EdgeType                  string      `json:"edgeType,omitempty"`
+	EdgeColor                 string      `json:"edgeColor,omitempty"`
+	FontScale                 float64     `json:"fontScale,omitempty"`
+	FontFamily                string      `json:"fontFamily,omitempty"`
+	FontGenericFamily         string      `json:"fontGenericFamily,omitempty"`
+	FontStyle                 string      `json:"fontStyle,omitempty"`
+	WindowType                string      `json:"windowType,omitempty"`
+	WindowColor               string      `json:"windowColor,omitempty"`
+	WindowRoundedCornerRadius int         `json:"windowRoundedCornerRadius,omitempty"`
+	CustomData                interface{} `json:"customData,omitempty"`
+}
+
+const (
+	RepeatModeOff           = "REPEAT_OFF"
+	RepeatModeAll           = "REPEAT_ALL"
+	RepeatModeSingle        = "REPEAT_SINGLE"
+	RepeatModeAllAndShuffle = "REPEAT_ALL_AND_SHUFFLE"
+)
+
+type QueueItem struct {
+	// Assigned by the receiver, 0 on new items
+	ItemID int               `json:"itemId,omitempty"`
+	Media  *MediaInformation `json:"media,omitempty"`
+	// Nil means true
+	Autoplay *bool `json:"autoplay,omitempty"`
+	// In seconds
+	StartTime float64 `json:"startTime,omitempty"`
+	// Seconds before the previous item ends to start loading this one
+	PreloadTime    float64     `json:"preloadTime,omitempty"`
+	ActiveTrackIDs []int       `json:"activeTrackIds,omitempty"`
+	CustomData     interface{} `json:"customData,omitempty"`
+}
+
+type MediaStatusResponseMessage struct {
+	MessageHeader
+	Status []*MediaStatus `json:"status"`
+}
+
+const (
+	PlayerStateIdle      = "IDLE"
+	PlayerStatePlaying   = "PLAYING"
+	PlayerStatePaused    = "PAUSED"
+	PlayerStateBuffering = "BUFFERING"
+)
+
+const (
+	IdleReasonCancelled   = "CANCELLED"
+	IdleReasonInterrupted = "INTERRUPTED"
+	IdleReasonFinished    = "FINISHED"
+	IdleReasonError       = "ERROR"
+)
+
+// Bit flags for MediaStatus.SupportedMediaCommands
+const (
+	MediaCommandPause        = 1
+	MediaCommandSeek         = 2
+	MediaCommandStreamVolume = 4
+	MediaCommandStreamMute   = 8
+	MediaCommandSkipForward  = 16
+	MediaCommandSkipBackward = 32
+	MediaCommandQueueNext    = 64
+	MediaCommandQueuePrev    = 128
+	MediaCommandQueueShuffle = 256
+	MediaCommandRepeatAll    = 1024
+	MediaCommandRepeatSingle = 2048
+	MediaCommandEditTracks   = 4096
+)
+
+type MediaStatus struct {
+	MediaSessionID int `json:"mediaSessionId"`
+	// Only required when changed since the last status, but always fine to send
+	Media        *MediaInformation `json:"media,omitempty"`
+	PlaybackRate float64           `json:"playbackRate"`
+	PlayerState  string            `json:"playerState"`
+	// Only set when idle
+	IdleReason string `json:"idleReason,omitempty"`
+	// In seconds
+	CurrentTime            float64      `json:"currentTime"`
+	SupportedMediaCommands int          `json:"supportedMediaCommands"`
+	Volume                 *Volume      `json:"volume,omitempty"`
+	ActiveTrackIDs         []int        `json:"activeTrackIds,omitempty"`
+	RepeatMode             string       `json:"repeatMode,omitempty"`
+	CurrentItemID          int          `json:"currentItemId,omitempty"`
+	LoadingItemID          int          `json:"loadingItemId,omitempty"`
+	PreloadedItemID        int          `json:"preloadedItemId,omitempty"`
+	Items                  []*QueueItem `json:"items,omitempty"`
+	CustomData             interface{}  `json:"customData,omitempty"`
+}
+
+// Response to QUEUE_GET_ITEM_IDS, in queue order
+type QueueItemIDsResponseMessage struct {
+	MessageHeader
+	ItemIDs []int `json:"itemIds"`
+}
+
+// Response to QUEUE_GET_ITEMS
+type QueueItemsResponseMessage struct {
+	MessageHeader
+	Items []*QueueItem `json:"items"`
+}
+
+// Error types for media requests, sent with MediaErrorResponseMessage
+const (
+	MediaErrorInvalidPlayerState = "INVALID_PLAYER_STATE"
+	MediaErrorLoadFailed         = "LOAD_FAILED"
+	MediaErrorLoadCancelled      = "LOAD_CANCELLED"
+	MediaErrorInvalidRequest     = "INVALID_REQUEST"
+)
+
+type MediaErrorResponseMessage struct {
+	MessageHeader
+	// For INVALID_REQUEST, e.g. INVALID_MEDIA_SESSION_ID or INVALID_COMMAND
+	Reason     string      `json:"reason,omitempty"`
+	ItemID     int         `json:"itemId,omitempty"`
+	CustomData interface{} `json:"customData,omitempty"`
+}
@@ -22,6 +22,11 @@ type StopRequestMessage struct {
 	SessionID string `json:"sessionId"`
 }
 
+type SetVolumeRequestMessage struct {
+	*RequestMessageHeader
+	Volume *VolumeChange `json:"volume"`
+}
+
 func UnmarshalReceiverRequestMessage(hdr *RequestMessageHeader) (RequestMessage, error) {
 	switch hdr.Type {
 	case "GET_APP_AVAILABILITY":
@@ -32,6 +37,8 @@ func UnmarshalReceiverRequestMessage(hdr *RequestMessageHeader) (RequestMessage,
 		return UnmarshalJSONRequestMessage(&LaunchRequestMessage{RequestMessageHeader: hdr})
 	case "STOP":
 		return UnmarshalJSONRequestMessage(&StopRequestMessage{RequestMessageHeader: hdr})
+	case "SET_VOLUME":
+		return UnmarshalJSONRequestMessage(&SetVolumeRequestMessage{RequestMessageHeader: hdr})
 	default:
 		return nil, nil
 	}
@@ -67,7 +74,8 @@ type ApplicationStatusNamespace struct {
 }
 
 type Volume struct {
-	Level float64 `json:"level,omitempty"`
+	// From 0 to 1
+	Level float64 `json:"level"`
 	Muted bool    `json:"muted"`
 }
 
@@ -76,6 +84,19 @@ type GetAppAvailabilityResponseMessage struct {
 	Availability map[string]string `json:"availability"`
 }
 
+// Reasons for LaunchErrorResponseMessage
+const (
+	LaunchErrorBadParameter = "BAD_PARAMETER"
+	LaunchErrorCancelled    = "CANCELLED"
+	LaunchErrorNotAllowed   = "NOT_ALLOWED"
+	LaunchErrorNotFound     = "NOT_FOUND"
+)
+
+type LaunchErrorResponseMessage struct {
+	MessageHeader
+	Reason string `json:"reason"`
+}
+
 type InvalidRequestResponseMessage struct {
 	MessageHeader
 	Reason string `json:"reason,omitempty"`
@@ -112,7 +112,7 @@ type WebRTCAnswerDimensions struct {
 }
 
 type WebRTCAnswerDisplay struct {
-	AspectRatio string `json:"aspectRatio,omitempty"`
-	Dimensions  string `json:"dimensions,omitempty"`
+	AspectRatio string                  `json:"aspectRatio,omitempty"`
+	Dimensions  *WebRTCAnswerDimensions `json:"dimensions,omitempty"`
 	// TODO: Scaling 0|1|sender
 }
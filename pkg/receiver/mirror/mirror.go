@@ -16,11 +16,20 @@ type Mirror interface {
 
 type mirror struct {
 	Config
+	// Never changed after creation
+	metadata *receiver.ApplicationMetadata
 
 	lock sync.RWMutex // Governs fields below
-	// Entire field reassigned each time, nothing internal ever changed
+	// Keyed by transport ID
+	sessions map[string]*mirrorSession
+}
+
+type mirrorSession struct {
+	// Never changed after creation
 	metadata *receiver.ApplicationMetadata
-	session  *webrtc.Session
+	appID    string
+	// Nil until offer
+	session *webrtc.Session
 }
 
 type Config struct {
@@ -30,6 +39,8 @@ type Config struct {
 	DefaultMetadata receiver.ApplicationMetadata
 	// Called async
 	OnSession func(*webrtc.Session)
+	// Limits used to pick offered streams and sent to the sender in the answer
+	Constraints webrtc.Constraints
 }
 
 const (
@@ -38,7 +49,7 @@ const (
 )
 
 func New(config Config) (Mirror, error) {
-	m := &mirror{Config: config}
+	m := &mirror{Config: config, sessions: map[string]*mirrorSession{}}
 	if len(m.DefaultMetadata.AppIDs) == 0 {
 		m.DefaultMetadata.AppIDs = []string{AppID, AudioOnlyAppID}
 	}
@@ -55,39 +66,44 @@ func New(config Config) (Mirror, error) {
 	return m, nil
 }
 
-func (m *mirror) Metadata() *receiver.ApplicationMetadata {
+func (m *mirror) Metadata() *receiver.ApplicationMetadata { return m.metadata }
+
+func (m *mirror) SessionMetadata(transportID string) *receiver.ApplicationMetadata {
 	m.lock.RLock()
 	defer m.lock.RUnlock()
-	return m.metadata
+	if sess := m.sessions[transportID]; sess != nil {
+		return sess.metadata
+	}
+	return nil
 }
 
-func (m *mirror) Start(ctx context.Context, appID string, appParams interface{}) error {
+func (m *mirror) Start(ctx context.Context, transportID, appID string, appParams interface{}) error {
 	m.lock.Lock()
 	defer m.lock.Unlock()
-	// If there's already a session ID, nothing to do
-	if m.metadata.SessionID != "" {
+	// If there's already a session, nothing to do
+	if m.sessions[transportID] != nil {
 		return nil
 	}
 	// Start session
-	m.metadata = m.newApplicationMetadata()
-	m.metadata.SessionID = uuid.New().String()
+	sess := &mirrorSession{metadata: m.newApplicationMetadata(), appID: appID}
+	sess.metadata.SessionID = uuid.New().String()
+	m.sessions[transportID] = sess
 	return nil
 }
 
-func (m *mirror) Stop(ctx context.Context) error {
+func (m *mirror) Stop(ctx context.Context, transportID string) error {
 	m.lock.Lock()
 	defer m.lock.Unlock()
 	// If there's no session, nothing to do
-	if m.metadata.SessionID == "" {
+	sess := m.sessions[transportID]
+	if sess == nil {
 		return nil
 	}
-	// Stop session if there
-	if m.session != nil {
-		m.session.Close()
-		m.session = nil
+	// Stop WebRTC session if there
+	if sess.session != nil {
+		sess.session.Close()
 	}
-	// Create new metadata without session ID
-	m.metadata = m.newApplicationMetadata()
+	delete(m.sessions, transportID)
 	return nil
 }
 
@@ -100,21 +116,30 @@ func (m *mirror) newApplicationMetadata() *receiver.ApplicationMetadata {
 	}
 }
 
-func (m *mirror) HandleMessage(ctx context.Context, conn receiver.Conn, msg receiver.RequestMessage) error {
+func (m *mirror) HandleMessage(ctx context.Context, conn receiver.Conn, transportID string, msg receiver.RequestMessage) error {
 	switch msg := msg.(type) {
 	case *receiver.WebRTCOfferRequestMessage:
 		// Lock during the entire session creation
 		session, err := func() (*webrtc.Session, error) {
 			m.lock.Lock()
 			defer m.lock.Unlock()
-			// If there's already a session, error
-			if m.session != nil {
+			// Must be started and not already have a WebRTC session
+			sess := m.sessions[transportID]
+			if sess == nil {
+				return nil, fmt.Errorf("no session for transport %v", transportID)
+			} else if sess.session != nil {
 				return nil, fmt.Errorf("session already exists")
 			}
 			// Create session
 			var err error
-			m.session, err = webrtc.StartSession(m.metadata.SessionID, msg.Offer)
-			return m.session, err
+			if sess.session, err = webrtc.StartSession(sess.metadata.SessionID, msg.Offer, m.Constraints); err != nil {
+				return nil, err
+			}
+			sess.session.AppID = sess.appID
+			if ch := receiver.ChannelFromContext(ctx); ch != nil {
+				sess.session.ConnectionInfo = ch.ConnectionInfo()
+			}
+			return sess.session, nil
 		}()
 		// Send response
 		resp := &receiver.WebRTCAnswerResponseMessage{
@@ -0,0 +1,264 @@
+package receiver
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// Player plays the media loaded by a media application. The application tracks
+// the MEDIA_STATUS state and uses the player for position and playback. All
+// methods are safe for concurrent use.
+type Player interface {
+	// Replaces any current media. The context is done when the media is replaced
+	// or stopped.
+	Load(ctx context.Context, load *PlayerLoad) error
+	Play() error
+	Pause() error
+	// In seconds, clamped to the media duration if known
+	Seek(position float64) error
+	SetVolume(Volume) error
+	// In seconds
+	Position() float64
+	// Receives events for the current media. Never closed, so callers should stop
+	// receiving once they call Close.
+	Events() <-chan PlayerEvent
+	// Unloads media and stops all events
+	Close() error
+}
+
+type PlayerLoad struct {
+	Media *MediaInformation
+	// The resolved URL of the media
+	URL *url.URL
+	// In seconds
+	StartTime float64
+	Autoplay  bool
+	// 1 if unset
+	PlaybackRate float64
+	Volume       Volume
+}
+
+const (
+	// Playback reached the end of the media. The player is paused at the end.
+	PlayerEventEnded = "ended"
+	// Playback failed. The media is no longer playing.
+	PlayerEventError = "error"
+)
+
+type PlayerEvent struct {
+	Type string
+	// The media the event is for, as given to Load. Callers should ignore events
+	// for media they have since replaced.
+	Media *MediaInformation
+	// Only set for PlayerEventError
+	Err error
+}
+
+// SimulatedPlayer is a headless Player that advances the position with a clock
+// and fires PlayerEventEnded when reaching the duration of the media, if known.
+type SimulatedPlayer interface {
+	Player
+	// Advances a manual clock, firing any end-of-media reached. Fails if the
+	// clock is not manual.
+	Advance(time.Duration) error
+}
+
+type SimulatedPlayerConfig struct {
+	// If true, the clock only advances on Advance calls, which makes playback
+	// deterministic. Otherwise, the wall clock is used.
+	ManualClock bool
+}
+
+type simulatedPlayer struct {
+	SimulatedPlayerConfig
+	events chan PlayerEvent
+	done   chan struct{}
+
+	lock sync.Mutex // Governs fields below
+	// Nil until loaded
+	load    *PlayerLoad
+	playing bool
+	// Position in seconds as of positionTime, advancing while playing
+	position     float64
+	positionTime time.Time
+	// In seconds, 0 if unknown
+	duration float64
+	volume   Volume
+	// Current time for manual clocks
+	manualNow time.Time
+	// Nil unless playing media with a known duration on the wall clock
+	endTimer *time.Timer
+	closed   bool
+}
+
+func NewSimulatedPlayer(config SimulatedPlayerConfig) SimulatedPlayer {
+	return &simulatedPlayer{
+		SimulatedPlayerConfig: config,
+		events:                make(chan PlayerEvent, 10),
+		done:                  make(chan struct{}),
+	}
+}
+
+func (s *simulatedPlayer) Load(ctx context.Context, load *PlayerLoad) error {
+	if load.Media == nil {
+		return fmt.Errorf("missing media")
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return fmt.Errorf("player closed")
+	}
+	loadCopy := *load
+	if loadCopy.PlaybackRate <= 0 {
+		loadCopy.PlaybackRate = 1
+	}
+	s.load, s.playing, s.volume, s.duration = &loadCopy, loadCopy.Autoplay, loadCopy.Volume, 0
+	if loadCopy.Media.Duration != nil {
+		s.duration = *loadCopy.Media.Duration
+	}
+	s.setPositionUnlocked(loadCopy.StartTime)
+	return nil
+}
+
+func (s *simulatedPlayer) Play() error { return s.setPlaying(true) }
+
+func (s *simulatedPlayer) Pause() error { return s.setPlaying(false) }
+
+func (s *simulatedPlayer) setPlaying(playing bool) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.load == nil {
+		return fmt.Errorf("no media loaded")
+	}
+	pos := s.positionUnlocked()
+	s.playing = playing
+	s.setPositionUnlocked(pos)
+	return nil
+}
+
+func (s *simulatedPlayer) Seek(position float64) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.load == nil {
+		return fmt.Errorf("no media loaded")
+	}
+	s.setPositionUnlocked(position)
+	return nil
+}
+
+func (s *simulatedPlayer) SetVolume(volume Volume) error {
+	if volume.Level < 0 || volume.Level > 1 {
+		return fmt.Errorf("invalid volume level %v", volume.Level)
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.volume = volume
+	return nil
+}
+
+func (s *simulatedPlayer) Position() float64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.positionUnlocked()
+}
+
+func (s *simulatedPlayer) Events() <-chan PlayerEvent { return s.events }
+
+func (s *simulatedPlayer) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if !s.closed {
+		s.closed = true
+		s.load, s.playing = nil, false
+		s.stopTimerUnlocked()
+		close(s.done)
+	}
+	return nil
+}
+
+func (s *simulatedPlayer) Advance(d time.Duration) error {
+	if !s.ManualClock {
+		return fmt.Errorf("clock not manual")
+	}
+	s.lock.Lock()
+	s.manualNow = s.manualNow.Add(d)
+	var ended *PlayerEvent
+	if s.playing && s.duration > 0 && s.positionUnlocked() >= s.duration {
+		ended = s.endUnlocked()
+	}
+	s.lock.Unlock()
+	if ended != nil {
+		s.emit(*ended)
+	}
+	return nil
+}
+
+func (s *simulatedPlayer) nowUnlocked() time.Time {
+	if s.ManualClock {
+		return s.manualNow
+	}
+	return time.Now()
+}
+
+func (s *simulatedPlayer) positionUnlocked() float64 {
+	pos := s.position
+	if s.playing {
+		pos += s.nowUnlocked().Sub(s.positionTime).Seconds() * s.load.PlaybackRate
+	}
+	if s.duration > 0 && pos > s.duration {
+		pos = s.duration
+	}
+	return pos
+}
+
+// Sets the position and reschedules the end if playing on the wall clock
+func (s *simulatedPlayer) setPositionUnlocked(pos float64) {
+	if pos < 0 {
+		pos = 0
+	} else if s.duration > 0 && pos > s.duration {
+		pos = s.duration
+	}
+	s.position, s.positionTime = pos, s.nowUnlocked()
+	s.stopTimerUnlocked()
+	if s.playing && s.duration > 0 && !s.ManualClock {
+		remaining := time.Duration((s.duration - pos) / s.load.PlaybackRate * float64(time.Second))
+		var timer *time.Timer
+		timer = time.AfterFunc(remaining, func() {
+			s.lock.Lock()
+			// Ignore if rescheduled or stopped since
+			var ended *PlayerEvent
+			if s.endTimer == timer {
+				ended = s.endUnlocked()
+			}
+			s.lock.Unlock()
+			if ended != nil {
+				s.emit(*ended)
+			}
+		})
+		s.endTimer = timer
+	}
+}
+
+// Pauses at the end of the media, returning the event to emit
+func (s *simulatedPlayer) endUnlocked() *PlayerEvent {
+	s.playing = false
+	s.setPositionUnlocked(s.duration)
+	return &PlayerEvent{Type: PlayerEventEnded, Media: s.load.Media}
+}
+
+func (s *simulatedPlayer) stopTimerUnlocked() {
+	if s.endTimer != nil {
+		s.endTimer.Stop()
+		s.endTimer = nil
+	}
+}
+
+func (s *simulatedPlayer) emit(event PlayerEvent) {
+	select {
+	case s.events <- event:
+	case <-s.done:
+	}
+}
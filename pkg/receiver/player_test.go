@@ -0,0 +1,166 @@
+package receiver
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func newTestPlayer(t *testing.T, duration float64, load PlayerLoad) (SimulatedPlayer, *MediaInformation) {
+	media := &MediaInformation{ContentID: "test"}
+	if duration > 0 {
+		media.Duration = &duration
+	}
+	load.Media = media
+	p := NewSimulatedPlayer(SimulatedPlayerConfig{ManualClock: true})
+	t.Cleanup(func() { p.Close() })
+	if err := p.Load(context.Background(), &load); err != nil {
+		t.Fatal(err)
+	}
+	return p, media
+}
+
+func advance(t *testing.T, p SimulatedPlayer, d time.Duration) {
+	t.Helper()
+	if err := p.Advance(d); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func expectPosition(t *testing.T, p SimulatedPlayer, expected float64) {
+	t.Helper()
+	if pos := p.Position(); pos != expected {
+		t.Fatalf("expected position %v, got %v", expected, pos)
+	}
+}
+
+// Returns nil if no event is pending
+func pendingEvent(p SimulatedPlayer) *PlayerEvent {
+	select {
+	case event := <-p.Events():
+		return &event
+	default:
+		return nil
+	}
+}
+
+func TestSimulatedPlayerEnd(t *testing.T) {
+	p, media := newTestPlayer(t, 10, PlayerLoad{StartTime: 2, Autoplay: true})
+	advance(t, p, 5*time.Second)
+	expectPosition(t, p, 7)
+	if event := pendingEvent(p); event != nil {
+		t.Fatalf("unexpected event %+v", event)
+	}
+	// Reaching the end fires once and pauses there
+	advance(t, p, 5*time.Second)
+	expectPosition(t, p, 10)
+	if event := pendingEvent(p); event == nil || event.Type != PlayerEventEnded || event.Media != media {
+		t.Fatalf("expected ended event, got %+v", event)
+	}
+	advance(t, p, 5*time.Second)
+	expectPosition(t, p, 10)
+	if event := pendingEvent(p); event != nil {
+		t.Fatalf("unexpected event %+v", event)
+	}
+	// Seeking back and playing again ends again
+	if err := p.Seek(9); err != nil {
+		t.Fatal(err)
+	} else if err := p.Play(); err != nil {
+		t.Fatal(err)
+	}
+	advance(t, p, time.Second)
+	if event := pendingEvent(p); event == nil || event.Type != PlayerEventEnded {
+		t.Fatalf("expected ended event, got %+v", event)
+	}
+
+	// Paused or unknown duration media never ends
+	p, _ = newTestPlayer(t, 10, PlayerLoad{})
+	advance(t, p, time.Minute)
+	expectPosition(t, p, 0)
+	p, _ = newTestPlayer(t, 0, PlayerLoad{Autoplay: true})
+	advance(t, p, time.Hour)
+	expectPosition(t, p, 3600)
+	if event := pendingEvent(p); event != nil {
+		t.Fatalf("unexpected event %+v", event)
+	}
+}
+
+func TestSimulatedPlayerSeek(t *testing.T) {
+	tests := []struct {
+		name     string
+		duration float64
+		seek     float64
+		position float64
+	}{
+		{"within", 10, 4, 4},
+		{"negative", 10, -5, 0},
+		{"past end", 10, 20, 10},
+		{"unknown duration", 0, 1000, 1000},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p, _ := newTestPlayer(t, test.duration, PlayerLoad{})
+			if err := p.Seek(test.seek); err != nil {
+				t.Fatal(err)
+			}
+			expectPosition(t, p, test.position)
+		})
+	}
+	// Start time is clamped the same way
+	p, _ := newTestPlayer(t, 10, PlayerLoad{StartTime: 30})
+	expectPosition(t, p, 10)
+	// Nothing to seek before load
+	if err := NewSimulatedPlayer(SimulatedPlayerConfig{ManualClock: true}).Seek(1); err == nil {
+		t.Fatal("expected error seeking without media")
+	}
+}
+
+func TestSimulatedPlayerPlaybackRate(t *testing.T) {
+	tests := []struct {
+		name     string
+		rate     float64
+		elapsed  time.Duration
+		position float64
+	}{
+		{"default", 0, 3 * time.Second, 3},
+		{"double", 2, 3 * time.Second, 6},
+		{"half", 0.5, 3 * time.Second, 1.5},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			p, _ := newTestPlayer(t, 0, PlayerLoad{Autoplay: true, PlaybackRate: test.rate})
+			advance(t, p, test.elapsed)
+			expectPosition(t, p, test.position)
+			// Pausing holds the position
+			if err := p.Pause(); err != nil {
+				t.Fatal(err)
+			}
+			advance(t, p, test.elapsed)
+			expectPosition(t, p, test.position)
+		})
+	}
+	// The end comes sooner at a higher rate
+	p, _ := newTestPlayer(t, 10, PlayerLoad{Autoplay: true, PlaybackRate: 2})
+	advance(t, p, 5*time.Second)
+	if event := pendingEvent(p); event == nil || event.Type != PlayerEventEnded {
+		t.Fatalf("expected ended event, got %+v", event)
+	}
+}
+
+func TestSimulatedPlayerInvalid(t *testing.T) {
+	wall := NewSimulatedPlayer(SimulatedPlayerConfig{})
+	defer wall.Close()
+	if err := wall.Advance(time.Second); err == nil {
+		t.Fatal("expected error advancing wall clock")
+	} else if err := wall.Load(context.Background(), &PlayerLoad{}); err == nil {
+		t.Fatal("expected error loading without media")
+	} else if err := wall.SetVolume(Volume{Level: 1.5}); err == nil {
+		t.Fatal("expected error for volume over 1")
+	} else if err := wall.Play(); err == nil {
+		t.Fatal("expected error playing without media")
+	}
+	wall.Close()
+	if err := wall.Load(context.Background(), &PlayerLoad{Media: &MediaInformation{}}); err == nil {
+		t.Fatal("expected error loading after close")
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"sort"
 	"sync"
 
 	"github.com/cretz/takecast/pkg/receiver/cast_channel"
@@ -18,12 +19,25 @@ type Receiver interface {
 	UnregisterApplication(context.Context, Application) error
 	// Nil if not found
 	ApplicationByID(string) Application
-	// If appID is empty, just stops current one. Channel not required if appID is
-	// empty, required otherwise.
+	// Starts the application for the channel, stopping any other application
+	// the channel started. If appID is empty, just stops the channel's current
+	// one. Other channels' applications are unaffected.
 	SwitchToApplication(ctx context.Context, ch Channel, appID string, params interface{}) error
-	CurrentApplication() Application
+	// Stops the application running for the transport ID. Does not error if
+	// nothing is running for it.
+	StopApplication(ctx context.Context, transportID string) error
+	// Stops all applications the channel started, e.g. once it closes
+	StopApplicationsForChannel(ctx context.Context, ch Channel) error
+	// Nil if nothing running for the transport ID
+	ApplicationForTransport(transportID string) Application
+	// Transport ID of the application the channel started, or empty if none
+	TransportForChannel(Channel) string
 	// Result should not be mutated (without being cloned first)
 	Status() *ReceiverStatus
+	Volume() Volume
+	// Applies the change, notifying status listeners and running applications
+	// that implement VolumeApplication. Fails if the level is not from 0 to 1.
+	SetVolume(ctx context.Context, change *VolumeChange) error
 	// Channel should have buffer, sent to non-blocking
 	AddStatusListener(chan<- *ReceiverStatus)
 	RemoveStatusListener(chan<- *ReceiverStatus)
@@ -33,6 +47,9 @@ type Receiver interface {
 
 var ErrReceiverClosed = errors.New("receiver closed")
 
+// Returned, possibly wrapped, when an application ID is not registered
+var ErrApplicationNotFound = errors.New("application not found")
+
 type receiver struct {
 	config ReceiverConfig
 	log    Log
@@ -41,10 +58,20 @@ type receiver struct {
 
 	lock            sync.RWMutex // Governs all fields below
 	apps            map[string]Application
+	running         map[string]*runningApp // Keyed by transport ID
+	transportIndex  int
+	volume          Volume
 	status          *ReceiverStatus // Always completely replaced, never mutated
 	statusListeners map[chan<- *ReceiverStatus]struct{}
 }
 
+type runningApp struct {
+	app         Application
+	appID       string
+	transportID string
+	ch          Channel
+}
+
 type ReceiverConfig struct {
 	// Default is NewChannel
 	NewChannel func(ChannelConfig) (Channel, error)
@@ -53,9 +80,11 @@ type ReceiverConfig struct {
 
 func NewReceiver(config ReceiverConfig) Receiver {
 	r := &receiver{
-		config: config,
-		log:    config.Log,
-		apps:   map[string]Application{},
+		config:  config,
+		log:     config.Log,
+		apps:    map[string]Application{},
+		running: map[string]*runningApp{},
+		volume:  Volume{Level: 1},
 		status: &ReceiverStatus{
 			IsActiveInput: true,
 			Volume: &Volume{
@@ -169,15 +198,18 @@ func (r *receiver) UnregisterApplication(ctx context.Context, app Application) e
 	}
 	r.lock.Lock()
 	defer r.lock.Unlock()
-	for _, appID := range app.Metadata().AppIDs {
-		// If the app is running, stop it first
-		if len(r.status.Applications) > 0 && appID == r.status.Applications[0].AppID {
-			if err := r.switchToApplicationUnlocked(ctx, nil, "", nil); err != nil {
+	// If the app is running, stop it first
+	for transportID, running := range r.running {
+		if running.app == app {
+			if err := r.stopUnlocked(ctx, transportID); err != nil {
 				return err
 			}
 		}
+	}
+	for _, appID := range app.Metadata().AppIDs {
 		delete(r.apps, appID)
 	}
+	r.updateStatusUnlocked()
 	return nil
 }
 
@@ -198,39 +230,112 @@ func (r *receiver) SwitchToApplication(ctx context.Context, ch Channel, appID st
 
 func (r *receiver) switchToApplicationUnlocked(ctx context.Context, ch Channel, appID string, params interface{}) error {
 	if appID != "" && r.apps[appID] == nil {
-		return fmt.Errorf("unrecognized application ID %v", appID)
-	} else if appID != "" && ch == nil {
-		return fmt.Errorf("must have channel when giving application to switch to")
-	}
-	// Stop the current app if there is one not that's not the same ID
-	if len(r.status.Applications) > 0 && r.status.Applications[0].AppID != appID {
-		r.log.Debugf("Stopping application %v", r.status.Applications[0].AppID)
-		if err := r.apps[r.status.Applications[0].AppID].Stop(ctx); err != nil {
-			return fmt.Errorf("failed stopping current application: %w", err)
+		return fmt.Errorf("%w: %v", ErrApplicationNotFound, appID)
+	} else if ch == nil {
+		return fmt.Errorf("missing channel")
+	}
+	// Stop the channel's current app if there is one that's not the same ID
+	current := r.runningForChannelUnlocked(ch)
+	if current != nil && current.appID != appID {
+		if err := r.stopUnlocked(ctx, current.transportID); err != nil {
+			return err
 		}
+		current = nil
 	}
 	// Start the requested app if any but not already the current
-	if appID != "" && (len(r.status.Applications) == 0 || r.status.Applications[0].AppID != appID) {
-		r.log.Debugf("Starting application %v", appID)
-		if err := r.apps[appID].Start(ctx, appID, params); err != nil {
+	if appID != "" && current == nil {
+		r.transportIndex++
+		running := &runningApp{
+			app:         r.apps[appID],
+			appID:       appID,
+			transportID: fmt.Sprintf("web-%v", r.transportIndex),
+			ch:          ch,
+		}
+		r.log.Debugf("Starting application %v on transport %v", appID, running.transportID)
+		if err := running.app.Start(ctx, running.transportID, appID, params); err != nil {
 			return fmt.Errorf("failed starting application: %w", err)
 		}
+		r.running[running.transportID] = running
+		r.forwardVolumeUnlocked(ctx, running)
+	}
+	r.updateStatusUnlocked()
+	return nil
+}
+
+func (r *receiver) StopApplication(ctx context.Context, transportID string) error {
+	if r.ctx.Err() != nil {
+		return ErrReceiverClosed
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if err := r.stopUnlocked(ctx, transportID); err != nil {
+		return err
+	}
+	r.updateStatusUnlocked()
+	return nil
+}
+
+func (r *receiver) StopApplicationsForChannel(ctx context.Context, ch Channel) error {
+	if r.ctx.Err() != nil {
+		return ErrReceiverClosed
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	// Stop as many as possible, returning the first failure
+	var firstErr error
+	for transportID, running := range r.running {
+		if running.ch == ch {
+			if err := r.stopUnlocked(ctx, transportID); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	r.updateStatusUnlocked()
+	return firstErr
+}
+
+// Does not update status
+func (r *receiver) stopUnlocked(ctx context.Context, transportID string) error {
+	running := r.running[transportID]
+	if running == nil {
+		return nil
+	}
+	r.log.Debugf("Stopping application %v on transport %v", running.appID, transportID)
+	if err := running.app.Stop(ctx, transportID); err != nil {
+		return fmt.Errorf("failed stopping application: %w", err)
+	}
+	delete(r.running, transportID)
+	return nil
+}
+
+func (r *receiver) runningForChannelUnlocked(ch Channel) *runningApp {
+	for _, running := range r.running {
+		if running.ch == ch {
+			return running
+		}
 	}
-	// Rebuild the status every time, no matter what
+	return nil
+}
+
+// Rebuilds the status every time and sends to listeners
+func (r *receiver) updateStatusUnlocked() {
 	newStatus := &ReceiverStatus{
 		IsActiveInput: r.status.IsActiveInput,
 		Volume: &Volume{
-			Level: r.status.Volume.Level,
-			Muted: r.status.Volume.Muted,
+			Level: r.volume.Level,
+			Muted: r.volume.Muted,
 		},
 	}
-	if appID != "" {
-		appMeta := r.apps[appID].Metadata()
+	for transportID, running := range r.running {
+		appMeta := running.app.SessionMetadata(transportID)
+		if appMeta == nil {
+			continue
+		}
 		appStatus := &ApplicationStatus{
-			TransportID:    ch.ConnectionInfo().Raw.GetSourceId(),
+			TransportID:    transportID,
 			SessionID:      appMeta.SessionID,
-			AppID:          appID,
-			UniversalAppID: appID,
+			AppID:          running.appID,
+			UniversalAppID: running.appID,
 			DisplayName:    appMeta.DisplayName,
 			StatusText:     appMeta.StatusText,
 			// TODO: IsIdleScreen
@@ -239,8 +344,12 @@ func (r *receiver) switchToApplicationUnlocked(ctx context.Context, ch Channel,
 		for i, namespace := range appMeta.SupportedNamespaces {
 			appStatus.Namespaces[i] = &ApplicationStatusNamespace{Name: namespace}
 		}
-		newStatus.Applications = []*ApplicationStatus{appStatus}
+		newStatus.Applications = append(newStatus.Applications, appStatus)
 	}
+	// Keep a stable order
+	sort.Slice(newStatus.Applications, func(i, j int) bool {
+		return newStatus.Applications[i].TransportID < newStatus.Applications[j].TransportID
+	})
 	r.status = newStatus
 	// Send status updates non-blocking
 	for ch := range r.statusListeners {
@@ -249,16 +358,24 @@ func (r *receiver) switchToApplicationUnlocked(ctx context.Context, ch Channel,
 		default:
 		}
 	}
+}
+
+func (r *receiver) ApplicationForTransport(transportID string) Application {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	if running := r.running[transportID]; running != nil {
+		return running.app
+	}
 	return nil
 }
 
-func (r *receiver) CurrentApplication() Application {
+func (r *receiver) TransportForChannel(ch Channel) string {
 	r.lock.RLock()
 	defer r.lock.RUnlock()
-	if len(r.status.Applications) == 0 {
-		return nil
+	if running := r.runningForChannelUnlocked(ch); running != nil {
+		return running.transportID
 	}
-	return r.apps[r.status.Applications[0].AppID]
+	return ""
 }
 
 func (r *receiver) Status() *ReceiverStatus {
@@ -267,6 +384,38 @@ func (r *receiver) Status() *ReceiverStatus {
 	return r.status
 }
 
+func (r *receiver) Volume() Volume {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	return r.volume
+}
+
+func (r *receiver) SetVolume(ctx context.Context, change *VolumeChange) error {
+	if r.ctx.Err() != nil {
+		return ErrReceiverClosed
+	} else if err := change.Validate(); err != nil {
+		return err
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.volume = change.Apply(r.volume)
+	r.log.Debugf("Volume changed to %v, muted: %v", r.volume.Level, r.volume.Muted)
+	for _, running := range r.running {
+		r.forwardVolumeUnlocked(ctx, running)
+	}
+	r.updateStatusUnlocked()
+	return nil
+}
+
+// Sends the volume to the app if it accepts it, logging failure
+func (r *receiver) forwardVolumeUnlocked(ctx context.Context, running *runningApp) {
+	if app, ok := running.app.(VolumeApplication); ok {
+		if err := app.SetVolume(ctx, running.transportID, r.volume); err != nil {
+			r.log.Warnf("Failed setting volume on application %v: %v", running.appID, err)
+		}
+	}
+}
+
 func (r *receiver) AddStatusListener(ch chan<- *ReceiverStatus) {
 	r.lock.Lock()
 	defer r.lock.Unlock()
@@ -282,9 +431,12 @@ func (r *receiver) RemoveStatusListener(ch chan<- *ReceiverStatus) {
 func (r *receiver) Close() error {
 	r.lock.Lock()
 	defer r.lock.Unlock()
-	r.switchToApplicationUnlocked(r.ctx, nil, "", nil)
+	for transportID := range r.running {
+		r.stopUnlocked(r.ctx, transportID)
+	}
 	r.status.Applications = nil
 	r.apps = nil
+	r.running = nil
 	r.statusListeners = nil
 	r.cancel()
 	return nil
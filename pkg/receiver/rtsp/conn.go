@@ -0,0 +1,405 @@
+package rtsp
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/google/uuid"
+)
+
+// RTSP session timeout in seconds sent to clients. Clients stay alive by
+// keeping the connection open or sending keep-alive requests.
+const sessionTimeout = 60
+
+// An RTSP connection. It can have at most one RTSP session.
+type conn struct {
+	server  *Server
+	netConn net.Conn
+	// Created after SETUP
+	sessionID string
+	// Interleaved packets queued for the writer. Closed when done.
+	out chan []byte
+
+	writeLock sync.Mutex // Governs writes to the net conn
+
+	// Fields below are governed by the server lock. Stream is set on the first
+	// SETUP.
+	stream *stream
+	// Keyed by track ID
+	transports       map[int]*transport
+	playing          bool
+	awaitingKeyFrame bool
+	closed           bool
+}
+
+// Where to send a track's packets for a client
+type transport struct {
+	// Interleaved channels if not UDP
+	rtpChannel  int
+	rtcpChannel int
+	// Nil if interleaved
+	rtpAddr  *net.UDPAddr
+	rtcpAddr *net.UDPAddr
+}
+
+type request struct {
+	method string
+	url    string
+	header textproto.MIMEHeader
+}
+
+type response struct {
+	status int
+	header map[string]string
+	body   string
+}
+
+func newConn(server *Server, netConn net.Conn) *conn {
+	return &conn{
+		server:     server,
+		netConn:    netConn,
+		out:        make(chan []byte, server.ClientQueueSize),
+		transports: map[int]*transport{},
+	}
+}
+
+func (c *conn) serve() {
+	defer c.close()
+	go c.writeInterleaved()
+	r := bufio.NewReader(c.netConn)
+	for {
+		req, err := readRequest(r)
+		if err != nil {
+			if err != io.EOF {
+				c.server.Log.Debugf("Closing RTSP connection from %v: %v", c.netConn.RemoteAddr(), err)
+			}
+			return
+		} else if req == nil {
+			continue
+		}
+		resp := c.handle(req)
+		if resp.header == nil {
+			resp.header = map[string]string{}
+		}
+		resp.header["CSeq"] = req.header.Get("CSeq")
+		if c.sessionID != "" {
+			resp.header["Session"] = fmt.Sprintf("%v;timeout=%v", c.sessionID, sessionTimeout)
+		}
+		if err := c.writeResponse(resp); err != nil {
+			return
+		}
+	}
+}
+
+func (c *conn) close() {
+	c.server.removeConn(c)
+	c.server.lock.Lock()
+	c.closed = true
+	close(c.out)
+	c.server.lock.Unlock()
+	c.netConn.Close()
+}
+
+// Reads a request, or returns nil for interleaved data from the client
+func readRequest(r *bufio.Reader) (*request, error) {
+	// Interleaved data such as client RTCP is skipped
+	if b, err := r.Peek(1); err != nil {
+		return nil, err
+	} else if b[0] == '$' {
+		var header [4]byte
+		if _, err := io.ReadFull(r, header[:]); err != nil {
+			return nil, err
+		}
+		_, err := r.Discard(int(binary.BigEndian.Uint16(header[2:])))
+		return nil, err
+	}
+	tp := textproto.NewReader(r)
+	line, err := tp.ReadLine()
+	if err != nil {
+		return nil, err
+	}
+	parts := strings.Fields(line)
+	if len(parts) != 3 || !strings.HasPrefix(parts[2], "RTSP/") {
+		return nil, fmt.Errorf("invalid request line %q", line)
+	}
+	req := &request{method: parts[0], url: parts[1]}
+	if req.header, err = tp.ReadMIMEHeader(); err != nil {
+		return nil, err
+	}
+	// Bodies are not used
+	if length, _ := strconv.Atoi(req.header.Get("Content-Length")); length > 0 {
+		if _, err := r.Discard(length); err != nil {
+			return nil, err
+		}
+	}
+	return req, nil
+}
+
+func (c *conn) writeResponse(resp response) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "RTSP/1.0 %v %v\r\n", resp.status, statusText[resp.status])
+	keys := make([]string, 0, len(resp.header))
+	for k := range resp.header {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(&b, "%v: %v\r\n", k, resp.header[k])
+	}
+	if resp.body != "" {
+		fmt.Fprintf(&b, "Content-Length: %v\r\n", len(resp.body))
+	}
+	b.WriteString("\r\n")
+	b.WriteString(resp.body)
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	_, err := io.WriteString(c.netConn, b.String())
+	return err
+}
+
+var statusText = map[int]string{
+	200: "OK",
+	400: "Bad Request",
+	404: "Not Found",
+	454: "Session Not Found",
+	455: "Method Not Valid in This State",
+	461: "Unsupported Transport",
+	500: "Internal Server Error",
+	501: "Not Implemented",
+}
+
+func (c *conn) handle(req *request) response {
+	if c.sessionID != "" && req.method != "OPTIONS" && req.method != "DESCRIBE" && req.method != "SETUP" {
+		if session := req.header.Get("Session"); session != "" && !strings.HasPrefix(session, c.sessionID) {
+			return response{status: 454}
+		}
+	}
+	switch req.method {
+	case "OPTIONS":
+		return response{status: 200, header: map[string]string{
+			"Public": "OPTIONS, DESCRIBE, SETUP, PLAY, PAUSE, TEARDOWN, GET_PARAMETER, SET_PARAMETER",
+		}}
+	case "DESCRIBE":
+		return c.describe(req)
+	case "SETUP":
+		return c.setup(req)
+	case "PLAY":
+		return c.play()
+	case "PAUSE":
+		c.server.lock.Lock()
+		c.playing = false
+		c.server.lock.Unlock()
+		return response{status: 200}
+	case "TEARDOWN":
+		c.server.lock.Lock()
+		c.playing, c.stream, c.transports = false, nil, map[int]*transport{}
+		c.server.lock.Unlock()
+		c.sessionID = ""
+		return response{status: 200}
+	case "GET_PARAMETER", "SET_PARAMETER":
+		return response{status: 200}
+	default:
+		return response{status: 501}
+	}
+}
+
+func (c *conn) describe(req *request) response {
+	c.server.lock.Lock()
+	defer c.server.lock.Unlock()
+	if c.server.current == nil {
+		return response{status: 404}
+	}
+	host, _, _ := net.SplitHostPort(c.netConn.LocalAddr().String())
+	base := req.url
+	if !strings.HasSuffix(base, "/") {
+		base += "/"
+	}
+	return response{
+		status: 200,
+		header: map[string]string{"Content-Type": "application/sdp", "Content-Base": base},
+		body:   c.server.current.sdp(host),
+	}
+}
+
+func (c *conn) setup(req *request) response {
+	// Track is the number after the last trackID=, defaulting to the only track
+	trackID := 0
+	if i := strings.LastIndex(req.url, "trackID="); i >= 0 {
+		var err error
+		if trackID, err = strconv.Atoi(req.url[i+len("trackID="):]); err != nil {
+			return response{status: 400}
+		}
+	}
+	c.server.lock.Lock()
+	defer c.server.lock.Unlock()
+	if c.stream == nil {
+		c.stream = c.server.current
+	}
+	if c.stream == nil || c.stream != c.server.current {
+		return response{status: 404}
+	} else if trackID < 0 || trackID >= len(c.stream.tracks) {
+		return response{status: 404}
+	}
+	t, header, err := c.parseTransportUnlocked(req.header.Get("Transport"), trackID)
+	if err != nil {
+		c.server.Log.Debugf("Unsupported RTSP transport: %v", err)
+		return response{status: 461}
+	}
+	c.transports[trackID] = t
+	if c.sessionID == "" {
+		c.sessionID = strings.ReplaceAll(uuid.New().String(), "-", "")
+	}
+	return response{status: 200, header: map[string]string{"Transport": header}}
+}
+
+// Returns the transport and the Transport header for the response
+func (c *conn) parseTransportUnlocked(header string, trackID int) (*transport, string, error) {
+	// Take the first supported of the comma-separated options
+	for _, option := range strings.Split(header, ",") {
+		params := strings.Split(strings.TrimSpace(option), ";")
+		var tcp, multicast bool
+		var ports []int
+		switch params[0] {
+		case "RTP/AVP", "RTP/AVP/UDP":
+		case "RTP/AVP/TCP":
+			tcp = true
+		default:
+			continue
+		}
+		for _, param := range params[1:] {
+			kv := strings.SplitN(param, "=", 2)
+			switch kv[0] {
+			case "multicast":
+				multicast = true
+			case "interleaved", "client_port":
+				if len(kv) == 2 {
+					ports = parsePortRange(kv[1])
+				}
+			}
+		}
+		if multicast {
+			continue
+		}
+		if tcp {
+			if ports == nil {
+				ports = []int{trackID * 2, trackID*2 + 1}
+			}
+			// Channels are a single byte in the interleaved frame header
+			if ports[0] < 0 || ports[0] > 255 || ports[1] < 0 || ports[1] > 255 {
+				return nil, "", fmt.Errorf("invalid interleaved channels %v-%v", ports[0], ports[1])
+			}
+			return &transport{rtpChannel: ports[0], rtcpChannel: ports[1]},
+				fmt.Sprintf("RTP/AVP/TCP;unicast;interleaved=%v-%v", ports[0], ports[1]), nil
+		} else if ports == nil {
+			continue
+		}
+		serverPort, err := c.server.udpPortUnlocked()
+		if err != nil {
+			return nil, "", err
+		}
+		ip := c.netConn.RemoteAddr().(*net.TCPAddr).IP
+		t := &transport{
+			rtpAddr:  &net.UDPAddr{IP: ip, Port: ports[0]},
+			rtcpAddr: &net.UDPAddr{IP: ip, Port: ports[1]},
+		}
+		return t, fmt.Sprintf("RTP/AVP;unicast;client_port=%v-%v;server_port=%v-%v",
+			ports[0], ports[1], serverPort, serverPort+1), nil
+	}
+	return nil, "", fmt.Errorf("no supported transport in %q", header)
+}
+
+// Parses "a-b" or "a" as a and a+1, or nil if invalid
+func parsePortRange(s string) []int {
+	parts := strings.SplitN(s, "-", 2)
+	first, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return nil
+	}
+	second := first + 1
+	if len(parts) == 2 {
+		if second, err = strconv.Atoi(parts[1]); err != nil {
+			return nil
+		}
+	}
+	return []int{first, second}
+}
+
+func (c *conn) play() response {
+	c.server.lock.Lock()
+	defer c.server.lock.Unlock()
+	if len(c.transports) == 0 {
+		return response{status: 455}
+	} else if c.stream != c.server.current {
+		return response{status: 404}
+	}
+	if !c.playing {
+		c.playing = true
+		// Video starts at the next key frame, so ask for one
+		if c.stream.session.Video != nil {
+			c.awaitingKeyFrame = true
+			if err := c.stream.session.RequestKeyFrame(); err != nil {
+				c.server.Log.Debugf("Failed requesting key frame: %v", err)
+			}
+		}
+	}
+	return response{status: 200, header: map[string]string{"Range": "npt=0.000-"}}
+}
+
+// Sends a frame's packets and optional sender report if playing the track.
+// Must be called with the server lock held.
+func (c *conn) sendFrameUnlocked(st *stream, t *track, keyFrame bool, packets [][]byte, report []byte) {
+	tr := c.transports[t.id]
+	if !c.playing || c.closed || c.stream != st || tr == nil {
+		return
+	}
+	if c.awaitingKeyFrame {
+		// Nothing is sent until video can be decoded
+		if t.audio || !keyFrame {
+			return
+		}
+		c.awaitingKeyFrame = false
+	}
+	if report != nil {
+		c.sendUnlocked(tr.rtcpAddr, c.server.rtcpConn, tr.rtcpChannel, report)
+	}
+	for _, packet := range packets {
+		c.sendUnlocked(tr.rtpAddr, c.server.rtpConn, tr.rtpChannel, packet)
+	}
+}
+
+func (c *conn) sendUnlocked(addr *net.UDPAddr, udpConn *net.UDPConn, channel int, packet []byte) {
+	if addr != nil {
+		// UDP loss is acceptable, so errors are ignored
+		udpConn.WriteToUDP(packet, addr)
+		return
+	}
+	b := make([]byte, 4, 4+len(packet))
+	b[0], b[1] = '$', byte(channel)
+	binary.BigEndian.PutUint16(b[2:], uint16(len(packet)))
+	select {
+	case c.out <- append(b, packet...):
+	default:
+		c.server.Log.Infof("Disconnecting slow RTSP client %v", c.netConn.RemoteAddr())
+		c.playing = false
+		c.netConn.Close()
+	}
+}
+
+func (c *conn) writeInterleaved() {
+	for b := range c.out {
+		c.writeLock.Lock()
+		_, err := c.netConn.Write(b)
+		c.writeLock.Unlock()
+		if err != nil {
+			c.netConn.Close()
+		}
+	}
+}
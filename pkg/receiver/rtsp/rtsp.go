@@ -0,0 +1,236 @@
+package rtsp
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/cretz/takecast/pkg/receiver"
+	"github.com/cretz/takecast/pkg/receiver/webrtc"
+)
+
+const (
+	// Used when Config.MTU is 0
+	DefaultMTU = 1200
+	// Used when Config.ClientQueueSize is 0
+	DefaultClientQueueSize = 2048
+)
+
+// Server re-publishes the current session over RTSP. Any path can be used to
+// describe and play it. Video is sent as VP8 (RFC 7741) or H.264 (RFC 6184) and
+// audio as Opus (RFC 7587), over RTP on UDP or interleaved in the RTSP
+// connection.
+type Server struct {
+	Config
+
+	lock sync.Mutex // Governs fields below
+	// Nil when no session is being published
+	current   *stream
+	listeners map[net.Listener]struct{}
+	conns     map[*conn]struct{}
+	// Shared by all UDP clients, nil until the first UDP setup
+	rtpConn  *net.UDPConn
+	rtcpConn *net.UDPConn
+	closed   bool
+}
+
+type Config struct {
+	Log receiver.Log
+	// Max RTP packet size. Default is DefaultMTU.
+	MTU int
+	// Number of packets that can be queued for an interleaved client before it
+	// is disconnected as too slow. Default is DefaultClientQueueSize.
+	ClientQueueSize int
+}
+
+func New(config Config) *Server {
+	s := &Server{Config: config, listeners: map[net.Listener]struct{}{}, conns: map[*conn]struct{}{}}
+	if s.Log == nil {
+		s.Log = receiver.NopLog()
+	}
+	if s.MTU <= 0 {
+		s.MTU = DefaultMTU
+	}
+	if s.ClientQueueSize <= 0 {
+		s.ClientQueueSize = DefaultClientQueueSize
+	}
+	return s
+}
+
+var ErrServerClosed = errors.New("server closed")
+
+// Accepts RTSP connections until the listener fails or the server is closed.
+// The listener is closed when this returns.
+func (s *Server) Serve(l net.Listener) error {
+	defer l.Close()
+	s.lock.Lock()
+	if s.closed {
+		s.lock.Unlock()
+		return ErrServerClosed
+	}
+	s.listeners[l] = struct{}{}
+	s.lock.Unlock()
+	for {
+		netConn, err := l.Accept()
+		if err != nil {
+			s.lock.Lock()
+			defer s.lock.Unlock()
+			delete(s.listeners, l)
+			if s.closed {
+				return ErrServerClosed
+			}
+			return err
+		}
+		c := newConn(s, netConn)
+		s.lock.Lock()
+		if s.closed {
+			s.lock.Unlock()
+			netConn.Close()
+			return ErrServerClosed
+		}
+		s.conns[c] = struct{}{}
+		s.lock.Unlock()
+		go c.serve()
+	}
+}
+
+// Closes all listeners and connections
+func (s *Server) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	for l := range s.listeners {
+		l.Close()
+	}
+	for c := range s.conns {
+		c.netConn.Close()
+	}
+	if s.rtpConn != nil {
+		s.rtpConn.Close()
+		s.rtcpConn.Close()
+	}
+	return nil
+}
+
+// OnSession publishes the session until it ends, reading it with a new
+// FrameBuffer. This can be used as mirror.Config.OnSession.
+func (s *Server) OnSession(sess *webrtc.Session) {
+	s.Publish(sess, webrtc.NewFrameBuffer(sess, webrtc.FrameBufferConfig{Log: s.Log}))
+}
+
+// Publish makes the session the one being published, reading its frames from
+// the given reader in the background until it fails or another session is
+// published. Clients playing the previous session are disconnected. If the
+// reader is an io.Closer, it is closed when done.
+func (s *Server) Publish(sess *webrtc.Session, frames webrtc.FrameReader) {
+	st, err := newStream(sess)
+	if err != nil {
+		s.Log.Warnf("Cannot publish session %v over RTSP: %v", sess.ID, err)
+		if closer, ok := frames.(io.Closer); ok {
+			closer.Close()
+		}
+		return
+	}
+	s.lock.Lock()
+	s.endStreamUnlocked()
+	s.current = st
+	s.lock.Unlock()
+	go s.pump(st, frames)
+}
+
+func (s *Server) pump(st *stream, frames webrtc.FrameReader) {
+	if closer, ok := frames.(io.Closer); ok {
+		defer closer.Close()
+	}
+	defer func() {
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		if s.current == st {
+			s.endStreamUnlocked()
+		}
+	}()
+	var f webrtc.Frame
+	for {
+		if err := frames.Read(&f); err != nil {
+			s.Log.Debugf("RTSP publishing of session %v ended: %v", st.session.ID, err)
+			return
+		}
+		t := st.track(f.Audio)
+		if t == nil {
+			continue
+		}
+		s.lock.Lock()
+		if s.current != st {
+			s.lock.Unlock()
+			return
+		}
+		packets := t.packetize(&f, s.MTU)
+		var report []byte
+		if now := time.Now(); now.Sub(t.lastReport) >= senderReportInterval {
+			t.lastReport = now
+			report = t.senderReport(st.wallClock(f.Timestamp))
+		}
+		for c := range s.conns {
+			c.sendFrameUnlocked(st, t, f.KeyFrame, packets, report)
+		}
+		s.lock.Unlock()
+	}
+}
+
+// Disconnects clients of the current stream and removes it
+func (s *Server) endStreamUnlocked() {
+	if s.current == nil {
+		return
+	}
+	for c := range s.conns {
+		if c.stream == s.current {
+			c.netConn.Close()
+		}
+	}
+	s.current = nil
+}
+
+func (s *Server) removeConn(c *conn) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	delete(s.conns, c)
+}
+
+// Opens the shared UDP sockets if not already open and returns the RTP port
+func (s *Server) udpPortUnlocked() (int, error) {
+	if s.rtpConn == nil {
+		rtpConn, rtcpConn, err := listenUDPPair()
+		if err != nil {
+			return 0, err
+		}
+		s.rtpConn, s.rtcpConn = rtpConn, rtcpConn
+		// Nothing from the clients is used, but keep the buffers drained
+		go io.Copy(ioutil.Discard, rtpConn)
+		go io.Copy(ioutil.Discard, rtcpConn)
+	}
+	return s.rtpConn.LocalAddr().(*net.UDPAddr).Port, nil
+}
+
+// RTP needs an even port with RTCP on the next one
+func listenUDPPair() (rtpConn, rtcpConn *net.UDPConn, err error) {
+	for i := 0; i < 20; i++ {
+		if rtpConn, err = net.ListenUDP("udp", &net.UDPAddr{}); err != nil {
+			return nil, nil, err
+		}
+		port := rtpConn.LocalAddr().(*net.UDPAddr).Port
+		if port%2 == 0 {
+			if rtcpConn, err = net.ListenUDP("udp", &net.UDPAddr{Port: port + 1}); err == nil {
+				return rtpConn, rtcpConn, nil
+			}
+		}
+		rtpConn.Close()
+	}
+	return nil, nil, fmt.Errorf("unable to find free UDP port pair")
+}
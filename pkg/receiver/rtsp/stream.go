@@ -0,0 +1,191 @@
+package rtsp
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"math/rand"
+	"strings"
+	"time"
+
+	"github.com/cretz/takecast/pkg/receiver/webrtc"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+)
+
+const (
+	senderReportInterval = time.Second
+	videoPayloadType     = 96
+	audioPayloadType     = 97
+	// Seconds from the NTP epoch of 1900 to the Unix epoch
+	ntpEpochOffset = 2208988800
+)
+
+// A session being published
+type stream struct {
+	// Never changed after creation
+	session *webrtc.Session
+	// Audio first if present, index is the track ID in control URLs
+	tracks []*track
+	// Wall clock time of Frame.Timestamp 0 for sender reports, set on first frame
+	start    time.Time
+	hasStart bool
+}
+
+// All fields besides the ones set on creation are governed by the server lock
+type track struct {
+	id          int
+	audio       bool
+	codec       string
+	payloadType uint8
+	clockRate   uint32
+	channels    int
+	ssrc        uint32
+	payloader   rtp.Payloader
+	sequencer   rtp.Sequencer
+	// Random offset for RTP timestamps
+	timestampBase uint32
+	// H.264 only, for the SDP
+	h264 webrtc.H264ParameterSets
+	// For sender reports
+	lastRTPTime uint32
+	packetCount uint32
+	octetCount  uint32
+	lastReport  time.Time
+}
+
+func newStream(sess *webrtc.Session) (*stream, error) {
+	st := &stream{session: sess}
+	if sess.Audio != nil {
+		if sess.Audio.CodecName != "opus" {
+			return nil, fmt.Errorf("expected opus audio codec, got %v", sess.Audio.CodecName)
+		}
+		// Opus is always advertised as 48000 and 2 channels in SDP
+		st.addTrack(&track{audio: true, codec: "opus", payloadType: audioPayloadType, clockRate: 48000,
+			channels: sess.Audio.Channels, ssrc: sess.Audio.SSRC, payloader: &codecs.OpusPayloader{}})
+	}
+	if sess.Video != nil {
+		t := &track{codec: sess.Video.CodecName, payloadType: videoPayloadType, clockRate: 90000, ssrc: sess.Video.SSRC}
+		switch t.codec {
+		case "vp8":
+			t.payloader = &codecs.VP8Payloader{}
+		case "h264":
+			t.payloader = &codecs.H264Payloader{}
+		default:
+			return nil, fmt.Errorf("expected vp8 or h264 video codec, got %v", t.codec)
+		}
+		st.addTrack(t)
+	}
+	return st, nil
+}
+
+func (s *stream) addTrack(t *track) {
+	t.id = len(s.tracks)
+	t.sequencer = rtp.NewRandomSequencer()
+	t.timestampBase = rand.Uint32()
+	s.tracks = append(s.tracks, t)
+}
+
+// Nil if the stream has no such track
+func (s *stream) track(audio bool) *track {
+	for _, t := range s.tracks {
+		if t.audio == audio {
+			return t
+		}
+	}
+	return nil
+}
+
+func (s *stream) wallClock(timestamp time.Duration) time.Time {
+	if !s.hasStart {
+		s.start, s.hasStart = time.Now().Add(-timestamp), true
+	}
+	return s.start.Add(timestamp)
+}
+
+// SDP for DESCRIBE. Must be called with the server lock held.
+func (s *stream) sdp(host string) string {
+	var b strings.Builder
+	// Session version must only increase, so time works for both
+	version := time.Now().Unix()
+	fmt.Fprintf(&b, "v=0\r\no=- %v %v IN IP4 %v\r\ns=TakeCast\r\nc=IN IP4 0.0.0.0\r\nt=0 0\r\na=control:*\r\n",
+		version, version, host)
+	for _, t := range s.tracks {
+		kind := "video"
+		if t.audio {
+			kind = "audio"
+		}
+		fmt.Fprintf(&b, "m=%v 0 RTP/AVP %v\r\n", kind, t.payloadType)
+		switch t.codec {
+		case "opus":
+			fmt.Fprintf(&b, "a=rtpmap:%v opus/48000/2\r\n", t.payloadType)
+			if t.channels != 1 {
+				fmt.Fprintf(&b, "a=fmtp:%v sprop-stereo=1\r\n", t.payloadType)
+			}
+		case "vp8":
+			fmt.Fprintf(&b, "a=rtpmap:%v VP8/90000\r\n", t.payloadType)
+		case "h264":
+			fmt.Fprintf(&b, "a=rtpmap:%v H264/90000\r\n", t.payloadType)
+			fmtp := "packetization-mode=1"
+			if t.h264.Ready() && len(t.h264.SPS) >= 4 {
+				fmtp += ";profile-level-id=" + hex.EncodeToString(t.h264.SPS[1:4]) +
+					";sprop-parameter-sets=" + base64.StdEncoding.EncodeToString(t.h264.SPS) + "," +
+					base64.StdEncoding.EncodeToString(t.h264.PPS)
+			}
+			fmt.Fprintf(&b, "a=fmtp:%v %v\r\n", t.payloadType, fmtp)
+		}
+		fmt.Fprintf(&b, "a=control:trackID=%v\r\n", t.id)
+	}
+	return b.String()
+}
+
+// Marshaled RTP packets for the frame. Must be called with the server lock
+// held.
+func (t *track) packetize(f *webrtc.Frame, mtu int) [][]byte {
+	if t.codec == "h264" {
+		// Bad parameter sets are ignored and the previous ones kept
+		t.h264.Update(f.Data)
+	}
+	t.lastRTPTime = t.timestampBase + uint32(webrtc.DurationToTicks(f.Timestamp, t.clockRate))
+	payloads := t.payloader.Payload(mtu-12, f.Data)
+	packets := make([][]byte, 0, len(payloads))
+	for i, payload := range payloads {
+		pkt := &rtp.Packet{
+			Header: rtp.Header{
+				Version:        2,
+				Marker:         !t.audio && i == len(payloads)-1,
+				PayloadType:    t.payloadType,
+				SequenceNumber: t.sequencer.NextSequenceNumber(),
+				Timestamp:      t.lastRTPTime,
+				SSRC:           t.ssrc,
+			},
+			Payload: payload,
+		}
+		if b, err := pkt.Marshal(); err == nil {
+			packets = append(packets, b)
+			t.packetCount++
+			t.octetCount += uint32(len(payload))
+		}
+	}
+	return packets
+}
+
+// Marshaled sender report for the last packetized frame at the given time, or
+// nil on failure. Must be called with the server lock held.
+func (t *track) senderReport(at time.Time) []byte {
+	b, _ := (&rtcp.SenderReport{
+		SSRC:        t.ssrc,
+		NTPTime:     ntpTime(at),
+		RTPTime:     t.lastRTPTime,
+		PacketCount: t.packetCount,
+		OctetCount:  t.octetCount,
+	}).Marshal()
+	return b
+}
+
+func ntpTime(t time.Time) uint64 {
+	secs := uint64(t.Unix() + ntpEpochOffset)
+	frac := uint64(t.Nanosecond()) << 32 / uint64(time.Second)
+	return secs<<32 | frac
+}
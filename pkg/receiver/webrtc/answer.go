@@ -0,0 +1,185 @@
+package webrtc
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/cretz/takecast/pkg/receiver"
+)
+
+// Receiver-side limits for choosing offered streams and telling the sender
+// what to send. Any zero value means no limit.
+type Constraints struct {
+	MaxWidth  int
+	MaxHeight int
+	// Frames per second
+	MaxFrameRate float64
+	// In bits per second
+	MinVideoBitRate int
+	MaxVideoBitRate int
+	MinAudioBitRate int
+	MaxAudioBitRate int
+	// Hz
+	MaxAudioSampleRate int
+	MaxAudioChannels   int
+	MaxDelay           time.Duration
+	// E.g. "16:9"
+	AspectRatio string
+	// Codec names in order of preference, unsupported ones are ignored. If
+	// empty, the order of SupportedAudioCodecs or SupportedVideoCodecs is used.
+	AudioCodecs []string
+	VideoCodecs []string
+}
+
+// Codecs the pipeline can handle in default order of preference. VP8 is first
+// since snapshots and RTSP can't take VP9 or AV1. H.264 and AAC can only be
+// saved as MP4, so AAC is only selected without video or with H.264.
+var (
+	SupportedAudioCodecs = []string{"opus", "aac"}
+	SupportedVideoCodecs = []string{"vp8", "vp9", "av1", "h264"}
+)
+
+// RTP extensions the framer understands
+var SupportedRTPExtensions = []string{"adaptive_playout_delay"}
+
+// Whether there is nothing to put in the answer. Codec preferences only affect
+// stream selection so they are not checked.
+func (c *Constraints) empty() bool {
+	return c.MaxWidth == 0 && c.MaxHeight == 0 && c.MaxFrameRate == 0 &&
+		c.MinVideoBitRate == 0 && c.MaxVideoBitRate == 0 && c.MinAudioBitRate == 0 && c.MaxAudioBitRate == 0 &&
+		c.MaxAudioSampleRate == 0 && c.MaxAudioChannels == 0 && c.MaxDelay == 0 && c.AspectRatio == ""
+}
+
+// Position of the codec in the preferences, or -1 if not supported or not
+// preferred
+func codecRank(preferred, supported []string, codec string) int {
+	if !containsString(supported, codec) {
+		return -1
+	} else if len(preferred) == 0 {
+		preferred = supported
+	}
+	for i, name := range preferred {
+		if name == codec {
+			return i
+		}
+	}
+	return -1
+}
+
+// Whether the resolution fits in the max dimensions
+func (c *Constraints) fits(res *receiver.WebRTCOfferStreamResolution) bool {
+	return (c.MaxWidth <= 0 || res.Width <= c.MaxWidth) && (c.MaxHeight <= 0 || res.Height <= c.MaxHeight)
+}
+
+// Returns the largest resolution area of the stream that fits, -1 if none fit,
+// or 0 if there are no resolutions
+func (c *Constraints) bestArea(stream *receiver.WebRTCOfferStream) int {
+	if len(stream.Resolutions) == 0 {
+		return 0
+	}
+	best := -1
+	for _, res := range stream.Resolutions {
+		if area := res.Width * res.Height; c.fits(res) && area > best {
+			best = area
+		}
+	}
+	return best
+}
+
+// Picks the index of the best audio and video streams from the offer, -1 for
+// either if none supported. The most preferred codec wins before any other
+// criteria. Video is picked first and audio that can't be saved with it is
+// skipped.
+func (c *Constraints) selectStreams(offer *receiver.WebRTCOffer) (audio, video int) {
+	audio, video = -1, -1
+	audioRank, videoRank := -1, -1
+	for i, stream := range offer.SupportedStreams {
+		if stream.Type != "video_source" {
+			continue
+		}
+		rank := codecRank(c.VideoCodecs, SupportedVideoCodecs, stream.CodecName)
+		if rank == -1 {
+			continue
+		}
+		// Prefer a stream with a fitting resolution, then the biggest fitting
+		// resolution. Streams with no fitting resolution are still accepted
+		// since the sender scales down to our constraints.
+		if video == -1 || rank < videoRank ||
+			(rank == videoRank && c.bestArea(stream) > c.bestArea(offer.SupportedStreams[video])) {
+			video, videoRank = i, rank
+		}
+	}
+	for i, stream := range offer.SupportedStreams {
+		if stream.Type != "audio_source" {
+			continue
+		}
+		rank := codecRank(c.AudioCodecs, SupportedAudioCodecs, stream.CodecName)
+		if rank == -1 {
+			continue
+		} else if stream.CodecName == "aac" && video != -1 && offer.SupportedStreams[video].CodecName != "h264" {
+			continue
+		} else if c.MaxAudioChannels > 0 && stream.Channels > c.MaxAudioChannels {
+			continue
+		} else if c.MaxAudioSampleRate > 0 && int(stream.SampleRate) > c.MaxAudioSampleRate {
+			continue
+		}
+		// Prefer higher bit rate
+		if audio == -1 || rank < audioRank ||
+			(rank == audioRank && stream.BitRate > offer.SupportedStreams[audio].BitRate) {
+			audio, audioRank = i, rank
+		}
+	}
+	return
+}
+
+// Sets constraints and display on the answer if any are configured
+func (c *Constraints) applyToAnswer(answer *receiver.WebRTCAnswer, audio, video *receiver.WebRTCOfferStream) {
+	answer.RTPExtensions = SupportedRTPExtensions
+	if c.empty() {
+		return
+	}
+	answer.Constraints = &receiver.WebRTCAnswerConstraints{}
+	if audio != nil {
+		answer.Constraints.Audio = &receiver.WebRTCAnswerConstraintsAudio{
+			MaxSampleRate: c.MaxAudioSampleRate,
+			MaxChannels:   c.MaxAudioChannels,
+			MinBitRate:    c.MinAudioBitRate,
+			MaxBitRate:    c.MaxAudioBitRate,
+			MaxDelay:      int64(c.MaxDelay / time.Millisecond),
+		}
+	}
+	var maxDims *receiver.WebRTCAnswerDimensions
+	if c.MaxWidth > 0 || c.MaxHeight > 0 || c.MaxFrameRate > 0 {
+		maxDims = &receiver.WebRTCAnswerDimensions{Width: c.MaxWidth, Height: c.MaxHeight}
+		if c.MaxFrameRate > 0 {
+			maxDims.FrameRate = strconv.FormatFloat(c.MaxFrameRate, 'f', -1, 64)
+		}
+	}
+	if video != nil {
+		answer.Constraints.Video = &receiver.WebRTCAnswerConstraintsVideo{
+			MaxDimensions: maxDims,
+			MinBitRate:    c.MinVideoBitRate,
+			MaxBitRate:    c.MaxVideoBitRate,
+			MaxDelay:      int64(c.MaxDelay / time.Millisecond),
+		}
+		if c.MaxWidth > 0 && c.MaxHeight > 0 && c.MaxFrameRate > 0 {
+			answer.Constraints.Video.MaxPixelsPerSecond = float64(c.MaxWidth*c.MaxHeight) * c.MaxFrameRate
+		}
+		// Display only matters with video
+		if c.AspectRatio != "" || (c.MaxWidth > 0 && c.MaxHeight > 0) {
+			answer.Display = &receiver.WebRTCAnswerDisplay{AspectRatio: c.AspectRatio}
+			if c.MaxWidth > 0 && c.MaxHeight > 0 {
+				answer.Display.Dimensions = maxDims
+			}
+		}
+	}
+}
+
+func containsString(strs []string, str string) bool {
+	for _, s := range strs {
+		if s == str {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,268 @@
+package webrtc
+
+import "fmt"
+
+// AV1 OBU types we care about
+const (
+	av1OBUSequenceHeader    = 1
+	av1OBUTemporalDelimiter = 2
+	av1OBUFrameHeader       = 3
+	av1OBUFrame             = 6
+)
+
+type av1OBU struct {
+	typ int
+	// Entire OBU including header
+	raw []byte
+	// Payload after header and size
+	payload []byte
+}
+
+// Splits a low overhead bitstream format temporal unit into OBUs
+func splitAV1OBUs(b []byte) ([]av1OBU, error) {
+	var obus []av1OBU
+	for len(b) > 0 {
+		obu := av1OBU{typ: int(b[0] >> 3 & 0xf)}
+		headerSize := 1
+		if b[0]&0x04 != 0 {
+			headerSize++
+		}
+		if len(b) < headerSize {
+			return nil, fmt.Errorf("OBU header too short")
+		}
+		size := len(b) - headerSize
+		if b[0]&0x02 != 0 {
+			v, n := readLEB128(b[headerSize:])
+			if n == 0 || uint64(len(b)-headerSize-n) < v {
+				return nil, fmt.Errorf("invalid OBU size")
+			}
+			headerSize, size = headerSize+n, int(v)
+		}
+		obu.raw, obu.payload = b[:headerSize+size], b[headerSize:headerSize+size]
+		obus = append(obus, obu)
+		b = b[headerSize+size:]
+	}
+	return obus, nil
+}
+
+// Returns the value and the number of bytes read, or 0 bytes if invalid
+func readLEB128(b []byte) (v uint64, n int) {
+	for i := 0; i < 8 && i < len(b); i++ {
+		v |= uint64(b[i]&0x7f) << (7 * i)
+		if b[i]&0x80 == 0 {
+			return v, i + 1
+		}
+	}
+	return 0, 0
+}
+
+// Fields from an AV1 sequence header needed for the codec configuration
+type AV1SequenceHeader struct {
+	Profile             int
+	Level               int
+	Tier                int
+	HighBitDepth        bool
+	TwelveBit           bool
+	Monochrome          bool
+	SubsamplingX        bool
+	SubsamplingY        bool
+	ChromaSamplePos     int
+	ReducedStillPicture bool
+	MaxWidth            int
+	MaxHeight           int
+	// The entire sequence header OBU
+	OBU []byte
+}
+
+// Returns nil if the temporal unit has no sequence header
+func FindAV1SequenceHeader(b []byte) (*AV1SequenceHeader, error) {
+	obus, err := splitAV1OBUs(b)
+	if err != nil {
+		return nil, err
+	}
+	for _, obu := range obus {
+		if obu.typ == av1OBUSequenceHeader {
+			return parseAV1SequenceHeader(obu)
+		}
+	}
+	return nil, nil
+}
+
+// Whether the temporal unit has a sequence header and a key frame header
+func IsAV1KeyFrame(b []byte) bool {
+	obus, err := splitAV1OBUs(b)
+	if err != nil {
+		return false
+	}
+	var seq *AV1SequenceHeader
+	for _, obu := range obus {
+		switch obu.typ {
+		case av1OBUSequenceHeader:
+			if seq, err = parseAV1SequenceHeader(obu); err != nil {
+				return false
+			}
+		case av1OBUFrameHeader, av1OBUFrame:
+			if seq == nil {
+				return false
+			} else if seq.ReducedStillPicture {
+				return true
+			}
+			// Show existing frame then frame type of 0 for key frames
+			r := &bitReader{b: obu.payload}
+			return !r.bit() && r.bits(2) == 0 && r.err == nil
+		}
+	}
+	return false
+}
+
+func parseAV1SequenceHeader(obu av1OBU) (*AV1SequenceHeader, error) {
+	s := &AV1SequenceHeader{OBU: obu.raw}
+	r := &bitReader{b: obu.payload}
+	s.Profile = int(r.bits(3))
+	r.skip(1) // Still picture
+	s.ReducedStillPicture = r.bit()
+	if s.ReducedStillPicture {
+		s.Level = int(r.bits(5))
+	} else {
+		var bufferDelayLen int
+		timingInfo := r.bit()
+		decoderModelInfo := false
+		if timingInfo {
+			r.skip(64) // Display tick units and time scale
+			if r.bit() {
+				r.uvlc() // Ticks per picture
+			}
+			if decoderModelInfo = r.bit(); decoderModelInfo {
+				bufferDelayLen = int(r.bits(5)) + 1
+				r.skip(32 + 5 + 5) // Decoding tick units, removal/presentation time lengths
+			}
+		}
+		initialDisplayDelay := r.bit()
+		opCount := int(r.bits(5)) + 1
+		for i := 0; i < opCount; i++ {
+			r.skip(12) // Operating point IDC
+			level, tier := int(r.bits(5)), 0
+			if level > 7 {
+				tier = int(r.bits(1))
+			}
+			if i == 0 {
+				s.Level, s.Tier = level, tier
+			}
+			if decoderModelInfo && r.bit() {
+				r.skip(2*bufferDelayLen + 1) // Decoder/encoder buffer delays and low delay
+			}
+			if initialDisplayDelay && r.bit() {
+				r.skip(4)
+			}
+		}
+	}
+	widthBits, heightBits := int(r.bits(4))+1, int(r.bits(4))+1
+	s.MaxWidth, s.MaxHeight = int(r.bits(widthBits))+1, int(r.bits(heightBits))+1
+	if !s.ReducedStillPicture && r.bit() {
+		r.skip(4 + 3) // Frame ID lengths
+	}
+	r.skip(3) // 128x128 superblocks, filter intra, intra edge filter
+	if !s.ReducedStillPicture {
+		r.skip(4) // Interintra, masked compound, warped motion, dual filter
+		orderHint := r.bit()
+		if orderHint {
+			r.skip(2) // Joint compound, ref frame MVs
+		}
+		forceScreenContent := uint64(2)
+		if !r.bit() {
+			forceScreenContent = r.bits(1)
+		}
+		if forceScreenContent > 0 && !r.bit() {
+			r.skip(1) // Force integer MV
+		}
+		if orderHint {
+			r.skip(3)
+		}
+	}
+	r.skip(3) // Superres, CDEF, restoration
+	// Color config
+	s.HighBitDepth = r.bit()
+	if s.Profile == 2 && s.HighBitDepth {
+		s.TwelveBit = r.bit()
+	}
+	if s.Profile != 1 {
+		s.Monochrome = r.bit()
+	}
+	const (
+		cpBT709       = 1
+		tcSRGB        = 13
+		mcIdentity    = 0
+		unspecified   = 2
+		chromaUnknown = 0
+	)
+	cp, tc, mc := uint64(unspecified), uint64(unspecified), uint64(unspecified)
+	if r.bit() {
+		cp, tc, mc = r.bits(8), r.bits(8), r.bits(8)
+	}
+	switch {
+	case s.Monochrome:
+		r.skip(1) // Color range
+		s.SubsamplingX, s.SubsamplingY, s.ChromaSamplePos = true, true, chromaUnknown
+	case cp == cpBT709 && tc == tcSRGB && mc == mcIdentity:
+	default:
+		r.skip(1) // Color range
+		switch {
+		case s.Profile == 0:
+			s.SubsamplingX, s.SubsamplingY = true, true
+		case s.Profile == 1:
+		case s.TwelveBit:
+			if s.SubsamplingX = r.bit(); s.SubsamplingX {
+				s.SubsamplingY = r.bit()
+			}
+		default:
+			s.SubsamplingX = true
+		}
+		if s.SubsamplingX && s.SubsamplingY {
+			s.ChromaSamplePos = int(r.bits(2))
+		}
+	}
+	if r.err != nil {
+		return nil, fmt.Errorf("invalid AV1 sequence header: %w", r.err)
+	}
+	return s, nil
+}
+
+// AV1CodecConfigurationRecord with the sequence header as the config OBU, used
+// as Matroska codec private and in MP4 av1C boxes
+func (s *AV1SequenceHeader) CodecConfig() []byte {
+	b := []byte{0x81, byte(s.Profile<<5 | s.Level&0x1f), byte(s.Tier << 7), 0}
+	for i, flag := range []bool{s.HighBitDepth, s.TwelveBit, s.Monochrome, s.SubsamplingX, s.SubsamplingY} {
+		if flag {
+			b[2] |= 1 << (6 - i)
+		}
+	}
+	b[2] |= byte(s.ChromaSamplePos & 0x3)
+	return append(b, s.OBU...)
+}
+
+// Removes temporal delimiters which Matroska and MP4 do not store
+func stripAV1TemporalDelimiters(b []byte) []byte {
+	obus, err := splitAV1OBUs(b)
+	if err != nil {
+		return b
+	}
+	ret := make([]byte, 0, len(b))
+	for _, obu := range obus {
+		if obu.typ != av1OBUTemporalDelimiter {
+			ret = append(ret, obu.raw...)
+		}
+	}
+	return ret
+}
+
+// Variable length unsigned used by AV1
+func (r *bitReader) uvlc() uint64 {
+	zeros := 0
+	for !r.bit() {
+		if r.err != nil || zeros >= 32 {
+			return 0
+		}
+		zeros++
+	}
+	return 1<<zeros - 1 + r.bits(zeros)
+}
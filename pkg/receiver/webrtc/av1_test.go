@@ -0,0 +1,122 @@
+package webrtc
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+var (
+	// Profile 0, level 4.0, 1280x720 max, 4:2:0 8-bit with order hints and
+	// screen content tools chosen per frame
+	testAV1SequenceHeader = []byte{
+		0x0a, 0x0b,
+		0x00, 0x00, 0x00, 0x42, 0xaa, 0x7f, 0xac, 0xf0, 0x09, 0x60, 0x02,
+	}
+	testAV1TemporalDelimiter = []byte{0x12, 0x00}
+	// Frame OBUs with a shown key frame and inter frame header
+	testAV1KeyFrame   = []byte{0x32, 0x02, 0x10, 0x00}
+	testAV1InterFrame = []byte{0x32, 0x02, 0x30, 0x00}
+)
+
+func concatBytes(bs ...[]byte) []byte {
+	var ret []byte
+	for _, b := range bs {
+		ret = append(ret, b...)
+	}
+	return ret
+}
+
+func TestFindAV1SequenceHeader(t *testing.T) {
+	seq, err := FindAV1SequenceHeader(concatBytes(testAV1TemporalDelimiter, testAV1SequenceHeader, testAV1KeyFrame))
+	if err != nil {
+		t.Fatal(err)
+	} else if seq == nil {
+		t.Fatal("expected sequence header")
+	}
+	expected := AV1SequenceHeader{
+		Level:        8,
+		SubsamplingX: true,
+		SubsamplingY: true,
+		MaxWidth:     1280,
+		MaxHeight:    720,
+		OBU:          testAV1SequenceHeader,
+	}
+	if !reflect.DeepEqual(*seq, expected) {
+		t.Fatalf("expected %+v, got %+v", expected, seq)
+	}
+	config := seq.CodecConfig()
+	if expectedConfig := append([]byte{0x81, 0x08, 0x0c, 0x00}, testAV1SequenceHeader...); !bytes.Equal(config, expectedConfig) {
+		t.Fatalf("expected config %x, got %x", expectedConfig, config)
+	}
+	// None without a sequence header
+	if seq, err := FindAV1SequenceHeader(concatBytes(testAV1TemporalDelimiter, testAV1InterFrame)); err != nil || seq != nil {
+		t.Fatalf("expected no sequence header, got %v %v", seq, err)
+	}
+	// Truncated sequence header
+	truncated := append([]byte{0x0a, 0x04}, testAV1SequenceHeader[2:6]...)
+	if _, err := FindAV1SequenceHeader(truncated); err == nil {
+		t.Fatal("expected error for truncated sequence header")
+	}
+}
+
+func TestIsAV1KeyFrame(t *testing.T) {
+	tests := []struct {
+		name     string
+		b        []byte
+		keyFrame bool
+	}{
+		{"key frame", concatBytes(testAV1TemporalDelimiter, testAV1SequenceHeader, testAV1KeyFrame), true},
+		{"key frame without sequence header", concatBytes(testAV1TemporalDelimiter, testAV1KeyFrame), false},
+		{"inter frame", concatBytes(testAV1TemporalDelimiter, testAV1SequenceHeader, testAV1InterFrame), false},
+		{"invalid size", []byte{0x32, 0x05, 0x10}, false},
+	}
+	for _, test := range tests {
+		if keyFrame := IsAV1KeyFrame(test.b); keyFrame != test.keyFrame {
+			t.Fatalf("%v: expected %v, got %v", test.name, test.keyFrame, keyFrame)
+		}
+	}
+}
+
+func TestSplitAV1OBUs(t *testing.T) {
+	// Second OBU has an extension header, third has no size field and takes the
+	// rest
+	b := concatBytes(testAV1TemporalDelimiter, []byte{0x1e, 0x00, 0x01, 0xaa}, []byte{0x30, 0xbb, 0xcc})
+	obus, err := splitAV1OBUs(b)
+	if err != nil {
+		t.Fatal(err)
+	} else if len(obus) != 3 {
+		t.Fatalf("expected 3 OBUs, got %v", len(obus))
+	} else if obus[0].typ != av1OBUTemporalDelimiter || len(obus[0].payload) != 0 {
+		t.Fatalf("unexpected first OBU %+v", obus[0])
+	} else if obus[1].typ != av1OBUFrameHeader || !bytes.Equal(obus[1].payload, []byte{0xaa}) {
+		t.Fatalf("unexpected second OBU %+v", obus[1])
+	} else if obus[2].typ != av1OBUFrame || !bytes.Equal(obus[2].raw, []byte{0x30, 0xbb, 0xcc}) {
+		t.Fatalf("unexpected third OBU %+v", obus[2])
+	}
+	if stripped := stripAV1TemporalDelimiters(b); !bytes.Equal(stripped, b[2:]) {
+		t.Fatalf("expected %x, got %x", b[2:], stripped)
+	}
+	if _, err := splitAV1OBUs([]byte{0x32, 0x80}); err == nil {
+		t.Fatal("expected error for unterminated size")
+	}
+}
+
+func TestReadLEB128(t *testing.T) {
+	tests := []struct {
+		b []byte
+		v uint64
+		n int
+	}{
+		{[]byte{0x00}, 0, 1},
+		{[]byte{0x7f, 0xff}, 127, 1},
+		{[]byte{0x80, 0x01}, 128, 2},
+		{[]byte{0xe5, 0x8e, 0x26}, 624485, 3},
+		{[]byte{0x80}, 0, 0},
+	}
+	for _, test := range tests {
+		if v, n := readLEB128(test.b); v != test.v || n != test.n {
+			t.Fatalf("expected %v (%v bytes) for %x, got %v (%v bytes)", test.v, test.n, test.b, v, n)
+		}
+	}
+}
@@ -0,0 +1,244 @@
+package webrtc
+
+import (
+	"errors"
+	"sync"
+)
+
+// Implemented by FrameBuffer and Subscriber
+type FrameReader interface {
+	Read(*Frame) error
+}
+
+// Returned from Subscriber.Read after Close
+var ErrSubscriberClosed = errors.New("subscriber closed")
+
+// Returned from Subscriber.Read when DropPolicyDisconnect disconnected it
+var ErrSubscriberTooSlow = errors.New("subscriber too slow")
+
+// What a subscriber does with a new frame when its queue is full
+type DropPolicy int
+
+const (
+	// Removes the oldest queued frame to make room
+	DropPolicyOldest DropPolicy = iota
+	// Drops the new frame
+	DropPolicyNewest
+	// Drops queued video and new video until the next key frame, requesting one
+	// from the sender. Queued audio is kept, only dropping the oldest if there
+	// is no video to drop. This keeps the video decodable.
+	DropPolicyUntilKeyFrame
+	// Closes the subscriber with ErrSubscriberTooSlow
+	DropPolicyDisconnect
+)
+
+// Used when SubscriberConfig.QueueSize is 0
+const DefaultSubscriberQueueSize = 256
+
+// Reads frames from a session once and hands each to every subscriber. Each
+// subscriber has its own bounded queue so a slow one cannot stall the others.
+// Frame data is shared between subscribers and must not be modified.
+type Broadcaster struct {
+	session *Session
+	frames  FrameReader
+
+	lock sync.Mutex // Governs fields below
+	subs map[*Subscriber]struct{}
+	// Set when Run completes
+	err error
+}
+
+type SubscriberConfig struct {
+	// If 0, DefaultSubscriberQueueSize is used
+	QueueSize  int
+	DropPolicy DropPolicy
+}
+
+type Subscriber struct {
+	SubscriberConfig
+	broadcaster *Broadcaster
+
+	lock sync.Mutex // Governs fields below
+	cond *sync.Cond
+	// Queued frames, oldest first
+	queue []Frame
+	// Non-nil when closed, returned after the queue is drained unless closed by
+	// the subscriber
+	err error
+	// Whether video is being dropped until a key frame
+	awaitingKeyFrame bool
+	dropped          uint64
+}
+
+// Creates a broadcaster reading from a new FrameBuffer for the session. Run
+// must be called to start reading.
+func NewBroadcaster(s *Session, config FrameBufferConfig) *Broadcaster {
+	return NewFrameBroadcaster(s, NewFrameBuffer(s, config))
+}
+
+// Creates a broadcaster for frames of the session read from the given reader.
+// Run must be called to start reading.
+func NewFrameBroadcaster(s *Session, frames FrameReader) *Broadcaster {
+	return &Broadcaster{session: s, frames: frames, subs: map[*Subscriber]struct{}{}}
+}
+
+func (b *Broadcaster) Session() *Session { return b.session }
+
+// Reads frames until the reader fails, then closes all subscribers with that
+// error after they drain their queues. Returns the error.
+func (b *Broadcaster) Run() error {
+	var f Frame
+	for {
+		if err := b.frames.Read(&f); err != nil {
+			b.lock.Lock()
+			defer b.lock.Unlock()
+			b.err = err
+			for sub := range b.subs {
+				sub.close(err)
+			}
+			b.subs = nil
+			return err
+		}
+		b.lock.Lock()
+		for sub := range b.subs {
+			sub.push(&f)
+		}
+		b.lock.Unlock()
+	}
+}
+
+// Adds a subscriber that receives frames read after this call. If Run has
+// already completed, the subscriber is returned closed with its error.
+func (b *Broadcaster) Subscribe(config SubscriberConfig) *Subscriber {
+	sub := &Subscriber{SubscriberConfig: config, broadcaster: b}
+	sub.cond = sync.NewCond(&sub.lock)
+	if sub.QueueSize <= 0 {
+		sub.QueueSize = DefaultSubscriberQueueSize
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.err != nil {
+		sub.err = b.err
+	} else {
+		b.subs[sub] = struct{}{}
+	}
+	return sub
+}
+
+func (b *Broadcaster) unsubscribe(sub *Subscriber) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	delete(b.subs, sub)
+}
+
+// Session of the broadcaster this subscribes to
+func (s *Subscriber) Session() *Session { return s.broadcaster.session }
+
+// Blocks until a frame is available. Once closed, queued frames are still
+// returned before the close error unless the subscriber closed itself.
+func (s *Subscriber) Read(f *Frame) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for len(s.queue) == 0 && s.err == nil {
+		s.cond.Wait()
+	}
+	if len(s.queue) == 0 {
+		return s.err
+	}
+	*f = s.queue[0]
+	s.queue[0] = Frame{}
+	s.queue = s.queue[1:]
+	return nil
+}
+
+// Number of frames dropped due to a full queue
+func (s *Subscriber) Dropped() uint64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.dropped
+}
+
+// Stops receiving frames and unblocks Read. Safe to call concurrently and more
+// than once.
+func (s *Subscriber) Close() error {
+	s.broadcaster.unsubscribe(s)
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.queue = nil
+	s.closeUnlocked(ErrSubscriberClosed)
+	return nil
+}
+
+func (s *Subscriber) close(err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.closeUnlocked(err)
+}
+
+func (s *Subscriber) closeUnlocked(err error) {
+	if s.err == nil {
+		s.err = err
+		s.cond.Broadcast()
+	}
+}
+
+// Called with the broadcaster lock held
+func (s *Subscriber) push(f *Frame) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.err != nil {
+		return
+	}
+	if s.awaitingKeyFrame && !f.Audio {
+		if !f.KeyFrame {
+			s.dropped++
+			return
+		}
+		s.awaitingKeyFrame = false
+	}
+	if len(s.queue) >= s.QueueSize {
+		switch s.DropPolicy {
+		case DropPolicyOldest:
+			s.queue[0] = Frame{}
+			s.queue = s.queue[1:]
+			s.dropped++
+		case DropPolicyNewest:
+			s.dropped++
+			return
+		case DropPolicyUntilKeyFrame:
+			kept := s.queue[:0]
+			for _, queued := range s.queue {
+				if queued.Audio {
+					kept = append(kept, queued)
+				}
+			}
+			videoDropped := len(kept) < len(s.queue)
+			s.dropped += uint64(len(s.queue) - len(kept))
+			for i := len(kept); i < len(s.queue); i++ {
+				s.queue[i] = Frame{}
+			}
+			s.queue = kept
+			// Still full if it was all audio
+			if !videoDropped {
+				s.queue[0] = Frame{}
+				s.queue = s.queue[1:]
+				s.dropped++
+			} else if f.Audio || !f.KeyFrame {
+				// Video can only resume at a key frame
+				s.awaitingKeyFrame = true
+				s.broadcaster.session.requestKeyFrame()
+				if !f.Audio {
+					s.dropped++
+					return
+				}
+			}
+		case DropPolicyDisconnect:
+			delete(s.broadcaster.subs, s)
+			s.queue = nil
+			s.closeUnlocked(ErrSubscriberTooSlow)
+			return
+		}
+	}
+	s.queue = append(s.queue, *f)
+	s.cond.Signal()
+}
@@ -0,0 +1,64 @@
+package webrtc
+
+import (
+	"io"
+	"testing"
+)
+
+type sliceFrameReader []Frame
+
+func (s *sliceFrameReader) Read(f *Frame) error {
+	if len(*s) == 0 {
+		return io.EOF
+	}
+	*f, *s = (*s)[0], (*s)[1:]
+	return nil
+}
+
+func TestSubscriberDropUntilKeyFrame(t *testing.T) {
+	// Audio frames are "a", video frames are "v" or "k" for key frames
+	frames := func(kinds string) sliceFrameReader {
+		var ret sliceFrameReader
+		for i, kind := range kinds {
+			ret = append(ret, Frame{ID: int64(i), Audio: kind == 'a', KeyFrame: kind == 'k'})
+		}
+		return ret
+	}
+	tests := []struct {
+		name  string
+		in    string
+		size  int
+		out   string
+		count uint64
+		// Whether a key frame was requested
+		requested bool
+	}{
+		{name: "fits", in: "kava", size: 4, out: "kava"},
+		{name: "audio kept on full queue", in: "kavaa", size: 4, out: "aaa", count: 2, requested: true},
+		{name: "video dropped until key frame", in: "kavavavkv", size: 5, out: "aaakv", count: 4, requested: true},
+		{name: "key frame resets", in: "kavak", size: 4, out: "aak", count: 2},
+		{name: "oldest audio dropped when all audio", in: "aaaaav", size: 4, out: "aaav", count: 2},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			in := frames(test.in)
+			b := NewFrameBroadcaster(&Session{}, &in)
+			sub := b.Subscribe(SubscriberConfig{QueueSize: test.size, DropPolicy: DropPolicyUntilKeyFrame})
+			if err := b.Run(); err != io.EOF {
+				t.Fatal(err)
+			}
+			var out []byte
+			var f Frame
+			for sub.Read(&f) == nil {
+				out = append(out, test.in[f.ID])
+			}
+			if string(out) != test.out {
+				t.Fatalf("expected %v, got %v", test.out, string(out))
+			} else if sub.Dropped() != test.count {
+				t.Fatalf("expected %v dropped, got %v", test.count, sub.Dropped())
+			} else if requested := len(b.Session().Events()) > 0; requested != test.requested {
+				t.Fatalf("expected key frame requested %v, got events %v", test.requested, b.Session().Events())
+			}
+		})
+	}
+}
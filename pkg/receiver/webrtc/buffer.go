@@ -0,0 +1,406 @@
+package webrtc
+
+import (
+	"errors"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/cretz/takecast/pkg/receiver"
+	"github.com/pion/rtcp"
+)
+
+// Used when the offer does not have a target delay
+const DefaultPlayoutDelay = 400 * time.Millisecond
+
+// Reorders frames from a session, holding incomplete frames until their
+// playout deadline and dropping them when the deadline expires. This owns the
+// reading of the session, so nothing else should read from it or set its read
+// deadline.
+type FrameBuffer struct {
+	FrameBufferConfig
+	session *Session
+	framer  *Framer
+	packet  Packet
+	// Keyed by SSRC
+	streams map[uint32]*bufferStream
+	// Local time of Frame.Timestamp 0, set on first release
+	origin    time.Time
+	hasOrigin bool
+
+	statsLock sync.Mutex // Governs stats field in each stream
+}
+
+type FrameBufferConfig struct {
+	// If 0, each stream uses its offer's TargetDelay or DefaultPlayoutDelay if
+	// that is not set. The sender can still change this per stream with the
+	// adaptive latency extension.
+	PlayoutDelay time.Duration
+	// Minimum time between Cast feedback messages per stream. If 0,
+	// DefaultFeedbackInterval is used. If negative, no RTCP is sent at all.
+	FeedbackInterval time.Duration
+	// Time between receiver reports per stream when there is no other feedback.
+	// If 0, DefaultReportInterval is used.
+	ReportInterval time.Duration
+	// Used for timing. If nil, time.Now is used.
+	Now func() time.Time
+	// If nil, uses receiver.NopLog
+	Log receiver.Log
+}
+
+type StreamStats struct {
+	SSRC  uint32
+	Audio bool
+	// Delay currently being used to hold frames
+	PlayoutDelay time.Duration
+	// Packets received for this stream, including duplicate and late
+	PacketsReceived uint64
+	// Packets for a frame part already received or frame already released
+	PacketsDuplicate uint64
+	// Packets for a frame that has already been dropped or is too old
+	PacketsLate uint64
+	// Frames returned from Read
+	FramesReleased uint64
+	// Frames dropped because they were not complete by their deadline
+	FramesLost uint64
+	// Frames dropped because they completed after later frames were already
+	// released or lost, e.g. frames from before the first released one
+	FramesLate uint64
+	// Times a key frame was requested from the sender, either due to loss or
+	// Session.RequestKeyFrame
+	KeyFramesRequested uint64
+}
+
+type bufferStream struct {
+	ssrc  uint32
+	clock int
+	delay time.Duration
+	// Next frame ID to release
+	nextID    int64
+	hasNextID bool
+	complete  map[int64]*Frame
+	// Extended RTP timestamp tracking, relative to the first seen
+	lastTimestamp uint32
+	extTimestamp  int64
+	hasTimestamp  bool
+	// Earliest seen local time for extended timestamp 0
+	base    time.Time
+	hasBase bool
+	// Added to media time to get Frame.Timestamp, set on first release and
+	// adjusted on sender reports
+	offset    time.Duration
+	hasOffset bool
+	// Sender wall clock time of extended timestamp 0 from last sender report
+	senderBase    time.Time
+	hasSenderBase bool
+	stats         StreamStats
+	// RTCP feedback state
+	reception       receptionStats
+	lastReport      time.Time
+	lastFeedback    time.Time
+	feedbackPending bool
+	feedbackCount   uint8
+	lastKeyFrameReq time.Time
+}
+
+func NewFrameBuffer(s *Session, config FrameBufferConfig) *FrameBuffer {
+	b := &FrameBuffer{
+		FrameBufferConfig: config,
+		session:           s,
+		framer:            s.NewFramer(),
+		streams:           map[uint32]*bufferStream{},
+	}
+	if b.FeedbackInterval == 0 {
+		b.FeedbackInterval = DefaultFeedbackInterval
+	}
+	if b.ReportInterval == 0 {
+		b.ReportInterval = DefaultReportInterval
+	}
+	if b.Now == nil {
+		b.Now = time.Now
+	}
+	if b.Log == nil {
+		b.Log = receiver.NopLog()
+	}
+	if s.Audio != nil {
+		b.addStream(s.Audio.SSRC, true, b.framer.stream(s.Audio.SSRC).clockRate, s.Audio.TargetDelay)
+	}
+	if s.Video != nil {
+		b.addStream(s.Video.SSRC, false, b.framer.stream(s.Video.SSRC).clockRate, s.Video.TargetDelay)
+	}
+	return b
+}
+
+func (b *FrameBuffer) addStream(ssrc uint32, audio bool, clock int, targetDelayMS int) {
+	stream := &bufferStream{ssrc: ssrc, clock: clock, delay: b.PlayoutDelay, complete: map[int64]*Frame{}}
+	if stream.delay <= 0 {
+		stream.delay = time.Duration(targetDelayMS) * time.Millisecond
+	}
+	if stream.delay <= 0 {
+		stream.delay = DefaultPlayoutDelay
+	}
+	stream.stats = StreamStats{SSRC: ssrc, Audio: audio, PlayoutDelay: stream.delay}
+	stream.reception.clock = clock
+	b.streams[ssrc] = stream
+}
+
+// Only one Read call at a time. Blocks until the next frame is ready or the
+// session fails. Frames are returned in ID order per stream, but missing
+// frames are skipped once their deadline passes.
+func (b *FrameBuffer) Read(frame *Frame) error {
+	for {
+		// Send any feedback due, then release any frame that's ready and get the
+		// next deadline
+		feedbackDeadline := b.sendFeedback(b.Now())
+		nextDeadline, ok := b.release(frame)
+		if ok {
+			return nil
+		}
+		if nextDeadline.IsZero() || (!feedbackDeadline.IsZero() && feedbackDeadline.Before(nextDeadline)) {
+			nextDeadline = feedbackDeadline
+		}
+		if err := b.session.SetReadDeadline(nextDeadline); err != nil {
+			return err
+		}
+		if err := b.session.Read(&b.packet); err != nil {
+			var netErr net.Error
+			if (errors.As(err, &netErr) && netErr.Timeout()) || errors.Is(err, ErrMalformedPacket) {
+				continue
+			}
+			return err
+		} else if b.packet.RTP == nil {
+			b.handleRTCP(b.packet.RTCP)
+			continue
+		}
+		stream := b.streams[b.packet.RTP.SSRC]
+		if stream == nil {
+			continue
+		}
+		now := b.Now()
+		stream.observeTimestamp(b.packet.RTP.Timestamp, now)
+		stream.reception.observe(b.packet.RTP, now)
+		stream.feedbackPending = true
+		if err := b.framer.Write(b.packet.RTP); errors.Is(err, ErrMalformedPacket) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		b.updatePacketStats(stream)
+		// Take all complete frames from the framer
+		for {
+			var f Frame
+			if ok, err := b.framer.Read(&f); err != nil {
+				return err
+			} else if !ok {
+				break
+			}
+			stream := b.streams[f.SSRC]
+			if f.PlayoutDelay > 0 && f.PlayoutDelay != stream.delay {
+				stream.delay = f.PlayoutDelay
+				b.statsLock.Lock()
+				stream.stats.PlayoutDelay = f.PlayoutDelay
+				b.statsLock.Unlock()
+			}
+			// Set the starting point to the first frame seen or any earlier frame
+			// seen before anything was released
+			if !stream.hasNextID || (f.ID < stream.nextID && stream.stats.FramesReleased == 0 &&
+				stream.stats.FramesLost == 0) {
+				stream.nextID, stream.hasNextID = f.ID, true
+			}
+			if f.ID >= stream.nextID {
+				stream.complete[f.ID] = &f
+			} else {
+				b.statsLock.Lock()
+				stream.stats.FramesLate++
+				b.statsLock.Unlock()
+			}
+			// A key frame satisfies any outstanding request
+			if f.KeyFrame && !f.Audio {
+				b.session.keyFrameReceived(f.Data)
+			}
+		}
+	}
+}
+
+func (b *FrameBuffer) handleRTCP(pkts []rtcp.Packet) {
+	now := b.Now()
+	for _, pkt := range pkts {
+		switch pkt := pkt.(type) {
+		case *rtcp.SenderReport:
+			if stream := b.streams[pkt.SSRC]; stream != nil {
+				stream.reception.observeSenderReport(pkt, now)
+				stream.senderBase = fromNTPTime(pkt.NTPTime).Add(-stream.mediaTime(stream.extend(pkt.RTPTime)))
+				stream.hasSenderBase = true
+				b.syncStreams()
+			}
+		}
+	}
+}
+
+// Gets the shared-clock timestamp for the RTP timestamp on the stream
+func (b *FrameBuffer) timestamp(stream *bufferStream, ts uint32) time.Duration {
+	if !stream.hasOffset {
+		// Start the shared clock at the earliest known stream start, then offset
+		// each stream by when it started locally until sender reports arrive
+		if !b.hasOrigin {
+			for _, s := range b.streams {
+				if s.hasBase && (!b.hasOrigin || s.base.Before(b.origin)) {
+					b.origin, b.hasOrigin = s.base, true
+				}
+			}
+		}
+		stream.offset, stream.hasOffset = stream.base.Sub(b.origin), true
+		b.syncStreams()
+	}
+	return stream.mediaTime(stream.extend(ts)) + stream.offset
+}
+
+// Aligns stream offsets using sender reports. Audio is the reference if
+// present, otherwise the first stream with an offset and sender report.
+func (b *FrameBuffer) syncStreams() {
+	var ref *bufferStream
+	for _, stream := range b.streams {
+		if stream.hasOffset && stream.hasSenderBase && (ref == nil || stream.stats.Audio) {
+			ref = stream
+		}
+	}
+	if ref == nil {
+		return
+	}
+	for _, stream := range b.streams {
+		if stream != ref && stream.hasOffset && stream.hasSenderBase {
+			stream.offset = ref.offset + stream.senderBase.Sub(ref.senderBase)
+		}
+	}
+}
+
+// Returns true if a frame was set. Otherwise, returns the next deadline to wait
+// for, which may be zero to wait indefinitely.
+func (b *FrameBuffer) release(frame *Frame) (time.Time, bool) {
+	now := b.Now()
+	var nextDeadline time.Time
+	var releaseStream *bufferStream
+	var releaseDeadline time.Time
+	for _, stream := range b.streams {
+		deadline, ready := b.streamNext(stream, now)
+		if ready {
+			// Choose the ready frame with the earliest deadline across streams
+			if releaseStream == nil || deadline.Before(releaseDeadline) {
+				releaseStream, releaseDeadline = stream, deadline
+			}
+		} else if !deadline.IsZero() && (nextDeadline.IsZero() || deadline.Before(nextDeadline)) {
+			nextDeadline = deadline
+		}
+	}
+	if releaseStream == nil {
+		return nextDeadline, false
+	}
+	*frame = *releaseStream.complete[releaseStream.nextID]
+	delete(releaseStream.complete, releaseStream.nextID)
+	frame.Timestamp = b.timestamp(releaseStream, frame.RTPTimestamp)
+	releaseStream.nextID++
+	b.statsLock.Lock()
+	releaseStream.stats.FramesReleased++
+	b.statsLock.Unlock()
+	return time.Time{}, true
+}
+
+// Drops expired frames and returns whether the next frame is complete along
+// with its deadline. If not complete and deadline is zero, there is nothing to
+// wait on.
+func (b *FrameBuffer) streamNext(stream *bufferStream, now time.Time) (time.Time, bool) {
+	for stream.hasNextID {
+		if f := stream.complete[stream.nextID]; f != nil {
+			return stream.deadline(f.RTPTimestamp), true
+		}
+		// Use the partial frame's deadline if any, otherwise use the earliest
+		// known later frame's
+		var deadline time.Time
+		if partial := b.framer.stream(stream.ssrc).pending[stream.nextID]; partial != nil {
+			deadline = stream.deadline(partial.rtpTimestamp)
+		} else if later := b.earliestLaterFrame(stream); later != nil {
+			deadline = stream.deadline(later.RTPTimestamp)
+		} else {
+			return time.Time{}, false
+		}
+		if now.Before(deadline) {
+			return deadline, false
+		}
+		// Expired, drop it and move on. Video frames after a lost one can't be
+		// decoded until the next key frame, so ask for one.
+		b.framer.Discard(stream.ssrc, stream.nextID)
+		stream.nextID++
+		b.statsLock.Lock()
+		stream.stats.FramesLost++
+		b.statsLock.Unlock()
+		b.session.frameLost(stream.stats.Audio)
+		if !stream.stats.Audio {
+			b.Log.Debugf("Lost video frame %v, requesting key frame", stream.nextID-1)
+			b.session.requestKeyFrame()
+		}
+	}
+	return time.Time{}, false
+}
+
+func (b *FrameBuffer) earliestLaterFrame(stream *bufferStream) *Frame {
+	var earliest *Frame
+	for id, f := range stream.complete {
+		if id > stream.nextID && (earliest == nil || id < earliest.ID) {
+			earliest = f
+		}
+	}
+	return earliest
+}
+
+func (b *FrameBuffer) updatePacketStats(stream *bufferStream) {
+	packetStats := b.framer.Stats(stream.ssrc)
+	b.statsLock.Lock()
+	defer b.statsLock.Unlock()
+	stream.stats.PacketsReceived = packetStats.PacketsReceived
+	stream.stats.PacketsDuplicate = packetStats.PacketsDuplicate
+	stream.stats.PacketsLate = packetStats.PacketsLate
+}
+
+// Safe to call concurrently with Read. Sorted by SSRC.
+func (b *FrameBuffer) Stats() []StreamStats {
+	b.statsLock.Lock()
+	defer b.statsLock.Unlock()
+	ret := make([]StreamStats, 0, len(b.streams))
+	for _, stream := range b.streams {
+		ret = append(ret, stream.stats)
+	}
+	sort.Slice(ret, func(i, j int) bool { return ret[i].SSRC < ret[j].SSRC })
+	return ret
+}
+
+func (s *bufferStream) observeTimestamp(ts uint32, now time.Time) {
+	ext := s.extend(ts)
+	// Base is the earliest local time at which extended timestamp 0 could have
+	// arrived. Packets delayed by the network only push this later, so take min.
+	if base := now.Add(-s.mediaTime(ext)); !s.hasBase || base.Before(s.base) {
+		s.base, s.hasBase = base, true
+	}
+}
+
+// Extends the given timestamp relative to the last one seen without updating
+// the last one unless it's newer
+func (s *bufferStream) extend(ts uint32) int64 {
+	if !s.hasTimestamp {
+		s.lastTimestamp, s.extTimestamp, s.hasTimestamp = ts, 0, true
+		return s.extTimestamp
+	}
+	ext := s.extTimestamp + int64(int32(ts-s.lastTimestamp))
+	if ext > s.extTimestamp {
+		s.lastTimestamp, s.extTimestamp = ts, ext
+	}
+	return ext
+}
+
+func (s *bufferStream) mediaTime(extTimestamp int64) time.Duration {
+	return time.Duration(extTimestamp) * time.Second / time.Duration(s.clock)
+}
+
+func (s *bufferStream) deadline(ts uint32) time.Time {
+	return s.base.Add(s.mediaTime(s.extend(ts)) + s.delay)
+}
@@ -0,0 +1,167 @@
+package webrtc
+
+import (
+	"time"
+
+	"github.com/cretz/takecast/pkg/receiver"
+)
+
+type EventType string
+
+const (
+	EventStart EventType = "start"
+	EventStop  EventType = "stop"
+	// Video key frame size differs from the previous key frame's
+	EventResolution EventType = "resolution"
+	// One or more frames of a stream were lost. Losses within lossBurstWindow of
+	// each other are a single event.
+	EventPacketLoss EventType = "packetLoss"
+	// A key frame was requested while none was outstanding
+	EventKeyFrameRequest EventType = "keyFrameRequest"
+	// Receiver volume changed, added by the receiver owner
+	EventVolume EventType = "volume"
+)
+
+const (
+	// Events past this many are dropped so a bad connection can't grow the
+	// timeline forever
+	maxSessionEvents = 10000
+	lossBurstWindow  = time.Second
+)
+
+// An entry in a session timeline. Only the fields for the type are set.
+type Event struct {
+	Time time.Time `json:"time"`
+	Type EventType `json:"type"`
+	// For resolution
+	Width  int `json:"width,omitempty"`
+	Height int `json:"height,omitempty"`
+	// For packet loss
+	Audio      bool   `json:"audio,omitempty"`
+	FramesLost uint64 `json:"framesLost,omitempty"`
+	// For volume
+	Level *float64 `json:"level,omitempty"`
+	Muted *bool    `json:"muted,omitempty"`
+}
+
+// Adds the event to the session timeline, setting the time to now if unset.
+// Safe to call concurrently.
+func (s *Session) AddEvent(e Event) {
+	s.eventsLock.Lock()
+	defer s.eventsLock.Unlock()
+	s.addEventUnlocked(e)
+}
+
+func (s *Session) addEventUnlocked(e Event) {
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+	if len(s.events) < maxSessionEvents {
+		s.events = append(s.events, e)
+	}
+}
+
+// Copy of the session timeline so far. Safe to call concurrently.
+func (s *Session) Events() []Event {
+	s.eventsLock.Lock()
+	defer s.eventsLock.Unlock()
+	return append([]Event(nil), s.events...)
+}
+
+// Closes the session connection, adding a stop event the first time
+func (s *Session) Close() error {
+	s.eventsLock.Lock()
+	if !s.stopped {
+		s.stopped = true
+		s.addEventUnlocked(Event{Type: EventStop})
+	}
+	s.eventsLock.Unlock()
+	return s.PacketConn.Close()
+}
+
+func (s *Session) frameLost(audio bool) {
+	s.eventsLock.Lock()
+	defer s.eventsLock.Unlock()
+	burst := &s.videoLoss
+	if audio {
+		burst = &s.audioLoss
+	}
+	now := time.Now()
+	if now.Sub(burst.last) < lossBurstWindow {
+		s.events[burst.index].FramesLost++
+		burst.last = now
+	} else if len(s.events) < maxSessionEvents {
+		burst.index, burst.last = len(s.events), now
+		s.addEventUnlocked(Event{Time: now, Type: EventPacketLoss, Audio: audio, FramesLost: 1})
+	}
+}
+
+// The current loss burst of a stream
+type lossBurst struct {
+	// Into events, only valid if the last loss is within lossBurstWindow
+	index int
+	last  time.Time
+}
+
+// Adds a resolution event if the key frame size changed
+func (s *Session) observeKeyFrameSizeUnlocked(data []byte) {
+	var width, height int
+	if s.Video.CodecName == "h264" {
+		// Bad parameter sets are ignored and the previous ones kept
+		s.h264.Update(data)
+		width, height = s.h264.Width, s.h264.Height
+	} else {
+		width, height, _ = webmKeyFrameSize(s.Video.CodecName, data)
+	}
+	if width > 0 && height > 0 && (width != s.width || height != s.height) {
+		s.width, s.height = width, height
+		s.AddEvent(Event{Type: EventResolution, Width: width, Height: height})
+	}
+}
+
+// JSON-friendly description of a session, e.g. for a file next to a
+// recording. AES keys in the offer are redacted.
+type SessionInfo struct {
+	ID     string                 `json:"id"`
+	AppID  string                 `json:"appId,omitempty"`
+	Offer  *receiver.WebRTCOffer  `json:"offer"`
+	Answer *receiver.WebRTCAnswer `json:"answer"`
+	// Nil if unknown
+	Sender *SenderInfo `json:"sender,omitempty"`
+	Events []Event     `json:"events"`
+}
+
+// From the sender's connect message
+type SenderInfo struct {
+	UserAgent  string                 `json:"userAgent,omitempty"`
+	Origin     map[string]interface{} `json:"origin,omitempty"`
+	SenderInfo map[string]interface{} `json:"senderInfo,omitempty"`
+}
+
+// Safe to call concurrently
+func (s *Session) Info() *SessionInfo {
+	info := &SessionInfo{ID: s.ID, AppID: s.AppID, Answer: s.Answer, Events: s.Events()}
+	if s.Offer != nil {
+		offer := *s.Offer
+		offer.SupportedStreams = make([]*receiver.WebRTCOfferStream, len(s.Offer.SupportedStreams))
+		for i, stream := range s.Offer.SupportedStreams {
+			redacted := *stream
+			if redacted.AESKey != "" {
+				redacted.AESKey = "REDACTED"
+			}
+			if redacted.AESIVMask != "" {
+				redacted.AESIVMask = "REDACTED"
+			}
+			offer.SupportedStreams[i] = &redacted
+		}
+		info.Offer = &offer
+	}
+	if s.ConnectionInfo != nil {
+		info.Sender = &SenderInfo{
+			UserAgent:  s.ConnectionInfo.UserAgent,
+			Origin:     s.ConnectionInfo.Origin,
+			SenderInfo: s.ConnectionInfo.SenderInfo,
+		}
+	}
+	return info
+}
@@ -0,0 +1,217 @@
+package webrtc
+
+import (
+	"time"
+
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+)
+
+const (
+	// Used when FrameBufferConfig.FeedbackInterval is 0
+	DefaultFeedbackInterval = 33 * time.Millisecond
+	// Used when FrameBufferConfig.ReportInterval is 0
+	DefaultReportInterval = 500 * time.Millisecond
+	// Minimum time between key frame requests while waiting on one
+	keyFrameRequestInterval = 200 * time.Millisecond
+)
+
+// RTP reception statistics for receiver reports per RFC 3550 appendix A
+type receptionStats struct {
+	clock          int
+	started        bool
+	baseSeq        uint16
+	maxSeq         uint16
+	cycles         uint32
+	received       uint32
+	expectedPrior  uint32
+	receivedPrior  uint32
+	lastTransit    int64
+	jitter         float64
+	lastSR         uint32
+	lastSRReceived time.Time
+}
+
+func (r *receptionStats) observe(p *rtp.Packet, now time.Time) {
+	if !r.started {
+		r.started, r.baseSeq, r.maxSeq = true, p.SequenceNumber, p.SequenceNumber
+	} else if diff := p.SequenceNumber - r.maxSeq; diff != 0 && diff < 1<<15 {
+		// In order with permissible gap
+		if p.SequenceNumber < r.maxSeq {
+			r.cycles += 1 << 16
+		}
+		r.maxSeq = p.SequenceNumber
+	}
+	r.received++
+	// Jitter in clock units, converted without overflowing
+	arrival := now.Unix()*int64(r.clock) + int64(now.Nanosecond())*int64(r.clock)/int64(time.Second)
+	transit := arrival - int64(p.Timestamp)
+	if r.received > 1 {
+		d := transit - r.lastTransit
+		if d < 0 {
+			d = -d
+		}
+		r.jitter += (float64(d) - r.jitter) / 16
+	}
+	r.lastTransit = transit
+}
+
+func (r *receptionStats) observeSenderReport(sr *rtcp.SenderReport, now time.Time) {
+	r.lastSR = uint32(sr.NTPTime >> 16)
+	r.lastSRReceived = now
+}
+
+func (r *receptionStats) report(ssrc uint32, now time.Time) rtcp.ReceptionReport {
+	extMax := r.cycles + uint32(r.maxSeq)
+	expected := extMax - uint32(r.baseSeq) + 1
+	lost := int64(expected) - int64(r.received)
+	if lost < 0 {
+		lost = 0
+	}
+	expectedInterval := expected - r.expectedPrior
+	receivedInterval := r.received - r.receivedPrior
+	r.expectedPrior, r.receivedPrior = expected, r.received
+	var fraction uint8
+	if lostInterval := int64(expectedInterval) - int64(receivedInterval); expectedInterval > 0 && lostInterval > 0 {
+		fraction = uint8((lostInterval << 8) / int64(expectedInterval))
+	}
+	report := rtcp.ReceptionReport{
+		SSRC:               ssrc,
+		FractionLost:       fraction,
+		TotalLost:          uint32(lost) & 0xFFFFFF,
+		LastSequenceNumber: extMax,
+		Jitter:             uint32(r.jitter),
+		LastSenderReport:   r.lastSR,
+	}
+	if !r.lastSRReceived.IsZero() {
+		report.Delay = uint32(now.Sub(r.lastSRReceived) * 65536 / time.Second)
+	}
+	return report
+}
+
+// Builds the Cast feedback for the stream based on buffer state
+func (b *FrameBuffer) castFeedback(stream *bufferStream) *CastFeedback {
+	framerStream := b.framer.stream(stream.ssrc)
+	// Checkpoint is the last frame where all before it are received or dropped.
+	// If nothing is complete yet, it's the one before the earliest partial.
+	checkpoint := stream.nextID - 1
+	if !stream.hasNextID {
+		checkpoint = framerStream.lastFrameID
+		for id := range framerStream.pending {
+			if id <= checkpoint {
+				checkpoint = id - 1
+			}
+		}
+	}
+	for stream.complete[checkpoint+1] != nil {
+		checkpoint++
+	}
+	stream.feedbackCount++
+	fb := &CastFeedback{
+		SenderSSRC:        stream.ssrc + 1,
+		MediaSSRC:         stream.ssrc,
+		CheckpointFrameID: uint8(checkpoint),
+		PlayoutDelay:      stream.delay,
+		FeedbackCount:     stream.feedbackCount,
+	}
+	for id := checkpoint + 1; id <= framerStream.lastFrameID && id-checkpoint < 256; id++ {
+		if stream.complete[id] != nil {
+			if id > checkpoint+1 {
+				fb.ACKs = append(fb.ACKs, uint8(id))
+			}
+			continue
+		}
+		partial := framerStream.pending[id]
+		if partial == nil {
+			// Frame entirely missing if there are newer ones
+			if id < framerStream.lastFrameID {
+				fb.Losses = append(fb.Losses, CastLoss{FrameID: uint8(id), PacketID: CastAllPacketsLost})
+			}
+			continue
+		}
+		// For the newest frame, only NACK holes before the last received packet
+		// since the rest may still be in flight
+		last := len(partial.packets) - 1
+		if id == framerStream.lastFrameID {
+			for last >= 0 && partial.packets[last] == nil {
+				last--
+			}
+		}
+		for packetID := 0; packetID <= last; {
+			if partial.packets[packetID] != nil {
+				packetID++
+				continue
+			}
+			// Put following missing packets in the bitmask
+			loss := CastLoss{FrameID: uint8(id), PacketID: uint16(packetID)}
+			for bit := 0; bit < 8 && packetID+1+bit <= last; bit++ {
+				if partial.packets[packetID+1+bit] == nil {
+					loss.Bitmask |= 1 << bit
+				}
+			}
+			fb.Losses = append(fb.Losses, loss)
+			packetID += 9
+		}
+		if len(fb.Losses) >= castMaxLossFields {
+			fb.Losses = fb.Losses[:castMaxLossFields]
+			break
+		}
+	}
+	return fb
+}
+
+// Sends feedback and reports that are due. Returns when next one is due or
+// zero time if not waiting on any.
+func (b *FrameBuffer) sendFeedback(now time.Time) time.Time {
+	if b.FeedbackInterval < 0 {
+		return time.Time{}
+	}
+	var next time.Time
+	for _, stream := range b.streams {
+		// Nothing to send until we have received something
+		if !b.framer.stream(stream.ssrc).hasLast {
+			continue
+		}
+		reportDue := now.Sub(stream.lastReport) >= b.ReportInterval
+		feedbackDue := stream.feedbackPending && now.Sub(stream.lastFeedback) >= b.FeedbackInterval
+		keyFrameWanted := !stream.stats.Audio && b.session.keyFrameWanted()
+		keyFrameDue := keyFrameWanted && now.Sub(stream.lastKeyFrameReq) >= keyFrameRequestInterval
+		if reportDue || feedbackDue || keyFrameDue {
+			pkts := []rtcp.Packet{
+				&rtcp.ReceiverReport{
+					SSRC:    stream.ssrc + 1,
+					Reports: []rtcp.ReceptionReport{stream.reception.report(stream.ssrc, now)},
+				},
+				&ReceiverReferenceTime{SenderSSRC: stream.ssrc + 1, NTPTime: toNTPTime(now)},
+				b.castFeedback(stream),
+			}
+			if keyFrameDue {
+				pkts = append(pkts, &rtcp.PictureLossIndication{SenderSSRC: stream.ssrc + 1, MediaSSRC: stream.ssrc})
+				stream.lastKeyFrameReq = now
+				b.statsLock.Lock()
+				stream.stats.KeyFramesRequested++
+				b.statsLock.Unlock()
+			}
+			if err := b.session.WriteRTCP(pkts...); err != nil {
+				b.Log.Debugf("Failed sending RTCP feedback: %v", err)
+			}
+			stream.lastReport, stream.lastFeedback, stream.feedbackPending = now, now, false
+		}
+		// Calc next time
+		streamNext := stream.lastReport.Add(b.ReportInterval)
+		if stream.feedbackPending {
+			if feedbackNext := stream.lastFeedback.Add(b.FeedbackInterval); feedbackNext.Before(streamNext) {
+				streamNext = feedbackNext
+			}
+		}
+		if keyFrameWanted {
+			if keyFrameNext := stream.lastKeyFrameReq.Add(keyFrameRequestInterval); keyFrameNext.Before(streamNext) {
+				streamNext = keyFrameNext
+			}
+		}
+		if next.IsZero() || streamNext.Before(next) {
+			next = streamNext
+		}
+	}
+	return next
+}
@@ -3,32 +3,319 @@ package webrtc
 import (
 	"crypto/cipher"
 	"encoding/binary"
+	"errors"
+	"fmt"
 	"time"
 
 	"github.com/pion/rtp"
 )
 
+// Returned (wrapped) from Framer.Write when a packet cannot be parsed. Callers
+// can usually just drop the packet and continue.
+var ErrMalformedPacket = errors.New("malformed packet")
+
+// How many frames behind the newest frame we keep partial/emitted state for.
+// Must be less than 128 since frame IDs are truncated to 8 bits on the wire.
+const framerWindow = 100
+
 type Framer struct {
 	AES       cipher.Block
 	AESIVMask []byte
+	// Packets with this SSRC are audio, all others are video
+	AudioSSRC uint32
+	// Ticks per second for RTP timestamps. If 0, defaults to 48000 for audio and
+	// 90000 for video.
+	AudioClockRate int
+	VideoClockRate int
+	// Codec names from the offer. Used for key frame detection and durations, and
+	// may be empty to only trust the Cast header.
+	AudioCodec string
+	VideoCodec string
+
+	streams map[uint32]*framerStream
+	ready   []*partialFrame
 }
 
 type Frame struct {
-	ID       int64
-	Audio    bool
-	Data     []byte
-	Duration time.Duration
+	ID int64
+	// Same as ID for key frames
+	ReferenceID  int64
+	SSRC         uint32
+	Audio        bool
+	KeyFrame     bool
+	RTPTimestamp uint32
+	Data         []byte
+	Duration     time.Duration
+	// Non-zero if the sender asked for a new playout delay starting at this frame
+	PlayoutDelay time.Duration
+	// Presentation time since the start of the session on a clock shared by all
+	// streams of the session. Only set by FrameBuffer.
+	Timestamp time.Duration
+}
+
+type framerStream struct {
+	audio bool
+	// Whether durations can be taken from Opus packets
+	opus      bool
+	clockRate int
+	// Greatest frame ID seen so far
+	lastFrameID int64
+	hasLast     bool
+	// Last emitted frame, used for durations
+	lastEmittedID        int64
+	lastEmittedTimestamp uint32
+	hasEmitted           bool
+	pending              map[int64]*partialFrame
+	emitted              map[int64]struct{}
+	discarded            map[int64]struct{}
+	packetsReceived      uint64
+	packetsDuplicate     uint64
+	packetsLate          uint64
+}
+
+type partialFrame struct {
+	stream       *framerStream
+	ssrc         uint32
+	header       castHeader
+	id           int64
+	referenceID  int64
+	rtpTimestamp uint32
+	packets      [][]byte
+	received     int
+}
+
+// Cast streaming payload header that follows the RTP header
+type castHeader struct {
+	keyFrame bool
+	// Truncated to 8 bits
+	frameID     uint8
+	packetID    uint16
+	maxPacketID uint16
+	// Truncated to 8 bits, only valid if hasReference is true
+	referenceFrameID uint8
+	hasReference     bool
+	// From the adaptive latency extension, 0 if not present
+	playoutDelay time.Duration
+}
+
+const (
+	castExtensionAdaptiveLatency = 1
+	castExtensionSizeBits        = 10
+)
+
+func parseCastHeader(b []byte) (h castHeader, payload []byte, err error) {
+	if len(b) < 6 {
+		return h, nil, fmt.Errorf("%w: cast header too short", ErrMalformedPacket)
+	}
+	h.keyFrame = b[0]&0x80 != 0
+	h.hasReference = b[0]&0x40 != 0
+	numExtensions := int(b[0] & 0x3f)
+	h.frameID = b[1]
+	h.packetID = binary.BigEndian.Uint16(b[2:])
+	h.maxPacketID = binary.BigEndian.Uint16(b[4:])
+	if h.packetID > h.maxPacketID {
+		return h, nil, fmt.Errorf("%w: packet ID %v > max %v", ErrMalformedPacket, h.packetID, h.maxPacketID)
+	}
+	b = b[6:]
+	if h.hasReference {
+		if len(b) < 1 {
+			return h, nil, fmt.Errorf("%w: missing reference frame ID", ErrMalformedPacket)
+		}
+		h.referenceFrameID, b = b[0], b[1:]
+	}
+	for i := 0; i < numExtensions; i++ {
+		if len(b) < 2 {
+			return h, nil, fmt.Errorf("%w: extension header too short", ErrMalformedPacket)
+		}
+		typeAndSize := binary.BigEndian.Uint16(b)
+		typ, size := typeAndSize>>castExtensionSizeBits, int(typeAndSize&(1<<castExtensionSizeBits-1))
+		if b = b[2:]; len(b) < size {
+			return h, nil, fmt.Errorf("%w: extension data too short", ErrMalformedPacket)
+		}
+		if typ == castExtensionAdaptiveLatency && size >= 2 {
+			h.playoutDelay = time.Duration(binary.BigEndian.Uint16(b)) * time.Millisecond
+		}
+		b = b[size:]
+	}
+	return h, b, nil
 }
 
 // Only one write call at a time. Does not reference the packet after this call.
 func (f *Framer) Write(p *rtp.Packet) error {
-	panic("TODO")
+	h, payload, err := parseCastHeader(p.Payload)
+	if err != nil {
+		return err
+	}
+	if p.Padding && len(payload) > 0 {
+		if padLen := int(payload[len(payload)-1]); padLen <= len(payload) {
+			payload = payload[:len(payload)-padLen]
+		}
+	}
+	stream := f.stream(p.SSRC)
+	stream.packetsReceived++
+	// Expand the frame ID relative to the newest one we've seen
+	id := int64(h.frameID)
+	if stream.hasLast {
+		id = stream.lastFrameID + int64(int8(h.frameID-uint8(stream.lastFrameID)))
+	}
+	if !stream.hasLast || id > stream.lastFrameID {
+		stream.lastFrameID, stream.hasLast = id, true
+		stream.prune()
+	}
+	// Ignore if too old, discarded, or already emitted
+	if id <= stream.lastFrameID-framerWindow {
+		stream.packetsLate++
+		return nil
+	} else if _, ok := stream.discarded[id]; ok {
+		stream.packetsLate++
+		return nil
+	} else if _, ok := stream.emitted[id]; ok {
+		stream.packetsDuplicate++
+		return nil
+	}
+	// Get or create the partial frame
+	partial := stream.pending[id]
+	if partial == nil {
+		partial = &partialFrame{
+			stream:       stream,
+			ssrc:         p.SSRC,
+			header:       h,
+			id:           id,
+			rtpTimestamp: p.Timestamp,
+			packets:      make([][]byte, int(h.maxPacketID)+1),
+		}
+		switch {
+		case h.hasReference:
+			partial.referenceID = id - int64(uint8(h.frameID-h.referenceFrameID))
+		case h.keyFrame:
+			partial.referenceID = id
+		default:
+			partial.referenceID = id - 1
+		}
+		stream.pending[id] = partial
+	} else if partial.header.maxPacketID != h.maxPacketID {
+		return fmt.Errorf("%w: max packet ID changed from %v to %v for frame %v",
+			ErrMalformedPacket, partial.header.maxPacketID, h.maxPacketID, id)
+	}
+	if h.playoutDelay > 0 {
+		partial.header.playoutDelay = h.playoutDelay
+	}
+	// Store a copy if not a duplicate
+	if partial.packets[h.packetID] != nil {
+		stream.packetsDuplicate++
+		return nil
+	}
+	partial.packets[h.packetID] = append(make([]byte, 0, len(payload)), payload...)
+	partial.received++
+	// If complete, move to ready
+	if partial.received == len(partial.packets) {
+		delete(stream.pending, id)
+		stream.emitted[id] = struct{}{}
+		f.ready = append(f.ready, partial)
+	}
+	return nil
 }
 
 // Only one Read call at a time. Returns true if the frame is valid. Completely
 // resets the frame each time (no leftover data if reusing the same instance).
 func (f *Framer) Read(frame *Frame) (bool, error) {
-	panic("TODO")
+	*frame = Frame{}
+	if len(f.ready) == 0 {
+		return false, nil
+	}
+	partial := f.ready[0]
+	f.ready[0] = nil
+	f.ready = f.ready[1:]
+	// Join the packets
+	size := 0
+	for _, packet := range partial.packets {
+		size += len(packet)
+	}
+	frame.Data = make([]byte, 0, size)
+	for _, packet := range partial.packets {
+		frame.Data = append(frame.Data, packet...)
+	}
+	frame.ID = partial.id
+	frame.ReferenceID = partial.referenceID
+	frame.SSRC = partial.ssrc
+	frame.Audio = partial.stream.audio
+	frame.KeyFrame = partial.header.keyFrame
+	frame.RTPTimestamp = partial.rtpTimestamp
+	frame.PlayoutDelay = partial.header.playoutDelay
+	f.decrypt(frame)
+	if !frame.Audio {
+		frame.KeyFrame = f.videoKeyFrame(frame.Data, frame.KeyFrame)
+	}
+	frame.Duration = partial.stream.frameDuration(frame)
+	return true, nil
+}
+
+// Checks the decrypted frame data for codecs that mark key frames themselves,
+// otherwise returns the Cast header flag
+func (f *Framer) videoKeyFrame(data []byte, header bool) bool {
+	switch f.VideoCodec {
+	case "vp8":
+		return IsVP8KeyFrame(data)
+	case "h264":
+		return IsH264KeyFrame(data)
+	case "vp9":
+		return IsVP9KeyFrame(data)
+	case "av1":
+		return IsAV1KeyFrame(data)
+	default:
+		return header
+	}
+}
+
+func (f *Framer) stream(ssrc uint32) *framerStream {
+	if f.streams == nil {
+		f.streams = map[uint32]*framerStream{}
+	}
+	stream := f.streams[ssrc]
+	if stream == nil {
+		stream = &framerStream{
+			audio:     ssrc == f.AudioSSRC,
+			pending:   map[int64]*partialFrame{},
+			emitted:   map[int64]struct{}{},
+			discarded: map[int64]struct{}{},
+		}
+		if stream.audio {
+			stream.opus = f.AudioCodec == "" || f.AudioCodec == "opus"
+			stream.clockRate = f.AudioClockRate
+			if stream.clockRate <= 0 {
+				stream.clockRate = 48000
+			}
+		} else {
+			stream.clockRate = f.VideoClockRate
+			if stream.clockRate <= 0 {
+				stream.clockRate = 90000
+			}
+		}
+		f.streams[ssrc] = stream
+	}
+	return stream
+}
+
+// Drops any partial state for the frame and ignores future packets for it.
+// Does nothing if the frame was already emitted.
+func (f *Framer) Discard(ssrc uint32, id int64) {
+	stream := f.stream(ssrc)
+	if _, ok := stream.emitted[id]; !ok {
+		delete(stream.pending, id)
+		stream.discarded[id] = struct{}{}
+	}
+}
+
+// Packet-level stats only, frame-level stats are left empty
+func (f *Framer) Stats(ssrc uint32) StreamStats {
+	stream := f.stream(ssrc)
+	return StreamStats{
+		SSRC:             ssrc,
+		Audio:            stream.audio,
+		PacketsReceived:  stream.packetsReceived,
+		PacketsDuplicate: stream.packetsDuplicate,
+		PacketsLate:      stream.packetsLate,
+	}
 }
 
 func (f *Framer) decrypt(frame *Frame) {
@@ -43,3 +330,76 @@ func (f *Framer) decrypt(frame *Frame) {
 	// Now AES-CTR
 	cipher.NewCTR(f.AES, iv[:]).XORKeyStream(frame.Data, frame.Data)
 }
+
+// Removes state for frames that have fallen out of the window
+func (s *framerStream) prune() {
+	for id := range s.pending {
+		if id <= s.lastFrameID-framerWindow {
+			delete(s.pending, id)
+		}
+	}
+	for id := range s.emitted {
+		if id <= s.lastFrameID-framerWindow {
+			delete(s.emitted, id)
+		}
+	}
+	for id := range s.discarded {
+		if id <= s.lastFrameID-framerWindow {
+			delete(s.discarded, id)
+		}
+	}
+}
+
+// Must be called in frame order after decryption
+func (s *framerStream) frameDuration(frame *Frame) time.Duration {
+	var dur time.Duration
+	if s.opus {
+		dur = opusPacketDuration(frame.Data)
+	}
+	// Use the RTP timestamp distance from the last emitted frame if we can
+	if dur == 0 && s.hasEmitted && frame.ID > s.lastEmittedID {
+		ticks := int64(frame.RTPTimestamp - s.lastEmittedTimestamp)
+		dur = time.Duration(ticks) * time.Second / time.Duration(s.clockRate) / time.Duration(frame.ID-s.lastEmittedID)
+	}
+	if dur <= 0 {
+		if s.audio {
+			dur = 10 * time.Millisecond
+		} else {
+			dur = time.Second / 30
+		}
+	}
+	if !s.hasEmitted || frame.ID > s.lastEmittedID {
+		s.lastEmittedID, s.lastEmittedTimestamp, s.hasEmitted = frame.ID, frame.RTPTimestamp, true
+	}
+	return dur
+}
+
+// Returns 0 if unable to determine. See RFC 6716 section 3.1.
+func opusPacketDuration(b []byte) time.Duration {
+	if len(b) == 0 {
+		return 0
+	}
+	var frameDur time.Duration
+	switch config := b[0] >> 3; {
+	case config < 12:
+		// SILK: 10, 20, 40, 60 ms
+		frameDur = [...]time.Duration{10, 20, 40, 60}[config%4] * time.Millisecond
+	case config < 16:
+		// Hybrid: 10, 20 ms
+		frameDur = [...]time.Duration{10, 20}[config%2] * time.Millisecond
+	default:
+		// CELT: 2.5, 5, 10, 20 ms
+		frameDur = [...]time.Duration{2500, 5000, 10000, 20000}[config%4] * time.Microsecond
+	}
+	switch b[0] & 0x3 {
+	case 0:
+		return frameDur
+	case 1, 2:
+		return 2 * frameDur
+	default:
+		if len(b) < 2 {
+			return 0
+		}
+		return time.Duration(b[1]&0x3f) * frameDur
+	}
+}
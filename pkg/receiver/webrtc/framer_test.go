@@ -0,0 +1,203 @@
+package webrtc
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+)
+
+func TestParseCastHeader(t *testing.T) {
+	tests := []struct {
+		name    string
+		b       []byte
+		header  castHeader
+		payload []byte
+		err     bool
+	}{
+		{
+			name:    "minimal",
+			b:       []byte{0x00, 5, 0, 1, 0, 2, 0xaa},
+			header:  castHeader{frameID: 5, packetID: 1, maxPacketID: 2},
+			payload: []byte{0xaa},
+		},
+		{
+			name:    "key frame with reference",
+			b:       []byte{0xc0, 7, 0, 0, 0, 0, 6, 0xaa, 0xbb},
+			header:  castHeader{keyFrame: true, frameID: 7, referenceFrameID: 6, hasReference: true},
+			payload: []byte{0xaa, 0xbb},
+		},
+		{
+			name: "adaptive latency extension",
+			// Type 1, size 2, 300ms
+			b:       []byte{0x01, 1, 0, 0, 0, 0, 0x04, 0x02, 0x01, 0x2c, 0xaa},
+			header:  castHeader{frameID: 1, playoutDelay: 300 * time.Millisecond},
+			payload: []byte{0xaa},
+		},
+		{
+			name: "unknown extension skipped",
+			// Type 2, size 3, then latency
+			b:       []byte{0x42, 1, 0, 0, 0, 0, 9, 0x08, 0x03, 1, 2, 3, 0x04, 0x02, 0x00, 0x64},
+			header:  castHeader{frameID: 1, referenceFrameID: 9, hasReference: true, playoutDelay: 100 * time.Millisecond},
+			payload: []byte{},
+		},
+		{name: "too short", b: []byte{0x00, 1, 0, 0, 0}, err: true},
+		{name: "packet ID past max", b: []byte{0x00, 1, 0, 3, 0, 2}, err: true},
+		{name: "missing reference", b: []byte{0x40, 1, 0, 0, 0, 0}, err: true},
+		{name: "missing extension header", b: []byte{0x01, 1, 0, 0, 0, 0, 0x04}, err: true},
+		{name: "extension data too short", b: []byte{0x01, 1, 0, 0, 0, 0, 0x04, 0x02, 0x01}, err: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			header, payload, err := parseCastHeader(test.b)
+			if test.err {
+				if !errors.Is(err, ErrMalformedPacket) {
+					t.Fatalf("expected malformed packet error, got %v", err)
+				}
+				return
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if header != test.header {
+				t.Fatalf("expected header %+v, got %+v", test.header, header)
+			} else if !bytes.Equal(payload, test.payload) {
+				t.Fatalf("expected payload %x, got %x", test.payload, payload)
+			}
+		})
+	}
+}
+
+// Builds a framer with a zero key and a function to create encrypted packets
+// for it
+func newTestFramer(t *testing.T) (*Framer, func(ssrc uint32, header []byte, frameID int64, data []byte) *rtp.Packet) {
+	block, err := aes.NewCipher(make([]byte, 16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &Framer{AES: block, AESIVMask: make([]byte, 16), AudioSSRC: 1}
+	packet := func(ssrc uint32, header []byte, frameID int64, data []byte) *rtp.Packet {
+		var iv [16]byte
+		binary.BigEndian.PutUint32(iv[8:], uint32(frameID))
+		enc := make([]byte, len(data))
+		cipher.NewCTR(block, iv[:]).XORKeyStream(enc, data)
+		return &rtp.Packet{Header: rtp.Header{SSRC: ssrc}, Payload: append(append([]byte{}, header...), enc...)}
+	}
+	return f, packet
+}
+
+func TestFramerReassembly(t *testing.T) {
+	f, packet := newTestFramer(t)
+	data := []byte("hello world")
+	// Encrypt as a whole, then split into packets out of order
+	whole := packet(2, nil, 0, data).Payload
+	for _, p := range []*rtp.Packet{
+		{Header: rtp.Header{SSRC: 2}, Payload: append([]byte{0x80, 0, 0, 1, 0, 1}, whole[5:]...)},
+		{Header: rtp.Header{SSRC: 2}, Payload: append([]byte{0x80, 0, 0, 1, 0, 1}, whole[5:]...)},
+		{Header: rtp.Header{SSRC: 2}, Payload: append([]byte{0x80, 0, 0, 0, 0, 1}, whole[:5]...)},
+	} {
+		if err := f.Write(p); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var frame Frame
+	if ok, err := f.Read(&frame); err != nil || !ok {
+		t.Fatalf("expected frame, got %v %v", ok, err)
+	} else if !bytes.Equal(frame.Data, data) {
+		t.Fatalf("expected %q, got %q", data, frame.Data)
+	} else if !frame.KeyFrame || frame.ReferenceID != 0 || frame.Audio {
+		t.Fatalf("unexpected frame %+v", frame)
+	}
+	if ok, _ := f.Read(&frame); ok {
+		t.Fatal("expected no more frames")
+	}
+	stats := f.Stats(2)
+	if stats.PacketsReceived != 3 || stats.PacketsDuplicate != 1 {
+		t.Fatalf("unexpected stats %+v", stats)
+	}
+}
+
+func TestFramerFrameIDExpansion(t *testing.T) {
+	f, packet := newTestFramer(t)
+	// Frame IDs on the wire wrap at 8 bits
+	var ids []int64
+	for _, wireID := range []int{254, 255, 0, 1} {
+		id := int64(wireID)
+		if wireID < 100 {
+			id += 256
+		}
+		// Reference the previous frame explicitly
+		header := []byte{0x40, byte(wireID), 0, 0, 0, 0, byte(wireID - 1)}
+		if err := f.Write(packet(1, header, id, []byte{0xfc})); err != nil {
+			t.Fatal(err)
+		}
+		var frame Frame
+		if ok, err := f.Read(&frame); err != nil || !ok {
+			t.Fatalf("expected frame, got %v %v", ok, err)
+		} else if frame.ReferenceID != frame.ID-1 || !frame.Audio {
+			t.Fatalf("unexpected frame %+v", frame)
+		}
+		ids = append(ids, frame.ID)
+	}
+	if expected := []int64{254, 255, 256, 257}; fmt.Sprint(ids) != fmt.Sprint(expected) {
+		t.Fatalf("expected IDs %v, got %v", expected, ids)
+	}
+	// Too old once far behind
+	if err := f.Write(packet(1, []byte{0x00, 150, 0, 0, 0, 0}, 150, []byte{0xfc})); err != nil {
+		t.Fatal(err)
+	} else if stats := f.Stats(1); stats.PacketsLate != 1 {
+		t.Fatalf("expected late packet, got %+v", stats)
+	}
+}
+
+func TestFramerPadding(t *testing.T) {
+	f, packet := newTestFramer(t)
+	p := packet(2, []byte{0x80, 0, 0, 0, 0, 0}, 0, []byte{1, 2, 3})
+	p.Padding = true
+	p.Payload = append(p.Payload, 0, 0, 3)
+	if err := f.Write(p); err != nil {
+		t.Fatal(err)
+	}
+	var frame Frame
+	if ok, _ := f.Read(&frame); !ok || !bytes.Equal(frame.Data, []byte{1, 2, 3}) {
+		t.Fatalf("expected padding removed, got %x", frame.Data)
+	}
+}
+
+func TestFramerMaxPacketIDChange(t *testing.T) {
+	f, packet := newTestFramer(t)
+	if err := f.Write(packet(2, []byte{0x80, 0, 0, 0, 0, 1}, 0, []byte{1})); err != nil {
+		t.Fatal(err)
+	}
+	err := f.Write(packet(2, []byte{0x80, 0, 0, 1, 0, 2}, 0, []byte{1}))
+	if !errors.Is(err, ErrMalformedPacket) {
+		t.Fatalf("expected malformed packet error, got %v", err)
+	}
+}
+
+func TestOpusPacketDuration(t *testing.T) {
+	tests := []struct {
+		toc      []byte
+		duration time.Duration
+	}{
+		{nil, 0},
+		// SILK 20ms, 1 frame
+		{[]byte{1 << 3}, 20 * time.Millisecond},
+		// Hybrid 10ms, 2 frames
+		{[]byte{12<<3 | 1}, 20 * time.Millisecond},
+		// CELT 2.5ms, arbitrary frames
+		{[]byte{16<<3 | 3, 4}, 10 * time.Millisecond},
+		// CELT 20ms, code 3 missing count
+		{[]byte{19<<3 | 3}, 0},
+	}
+	for _, test := range tests {
+		if dur := opusPacketDuration(test.toc); dur != test.duration {
+			t.Fatalf("expected %v for %x, got %v", test.duration, test.toc, dur)
+		}
+	}
+}
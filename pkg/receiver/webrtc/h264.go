@@ -0,0 +1,274 @@
+package webrtc
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+// H.264 NAL unit types we care about
+const (
+	h264NALSlice = 1
+	h264NALIDR   = 5
+	h264NALSPS   = 7
+	h264NALPPS   = 8
+	h264NALAUD   = 9
+)
+
+// Splits an Annex B byte stream into NAL units without start codes
+func SplitH264AnnexB(b []byte) [][]byte {
+	var nals [][]byte
+	start := -1
+	for i := 0; i+2 < len(b); {
+		// Look for 00 00 01, which also catches 00 00 00 01
+		if b[i] != 0 || b[i+1] != 0 || b[i+2] != 1 {
+			i++
+			continue
+		}
+		if start >= 0 {
+			nals = append(nals, trimH264Trailing(b[start:i]))
+		}
+		i += 3
+		start = i
+	}
+	if start >= 0 && start < len(b) {
+		nals = append(nals, b[start:])
+	} else if start < 0 && len(b) > 0 {
+		// No start codes, treat as a single NAL
+		nals = append(nals, b)
+	}
+	return nals
+}
+
+// Removes the trailing zeros that belong to the next 4-byte start code
+func trimH264Trailing(nal []byte) []byte {
+	for len(nal) > 0 && nal[len(nal)-1] == 0 {
+		nal = nal[:len(nal)-1]
+	}
+	return nal
+}
+
+// Whether the Annex B frame has an IDR slice
+func IsH264KeyFrame(b []byte) bool {
+	for _, nal := range SplitH264AnnexB(b) {
+		if len(nal) > 0 && nal[0]&0x1f == h264NALIDR {
+			return true
+		}
+	}
+	return false
+}
+
+// Latest SPS and PPS seen in a stream of H.264 frames
+type H264ParameterSets struct {
+	SPS []byte
+	PPS []byte
+	// From the SPS, 0 if unknown
+	Width  int
+	Height int
+}
+
+// Updates from any parameter sets in the Annex B frame. Returns true if either
+// changed.
+func (h *H264ParameterSets) Update(frame []byte) (changed bool, err error) {
+	for _, nal := range SplitH264AnnexB(frame) {
+		if len(nal) == 0 {
+			continue
+		}
+		switch nal[0] & 0x1f {
+		case h264NALSPS:
+			if !bytes.Equal(nal, h.SPS) {
+				width, height, err := ParseH264SPSDimensions(nal)
+				if err != nil {
+					return changed, err
+				}
+				h.SPS, h.Width, h.Height, changed = append([]byte(nil), nal...), width, height, true
+			}
+		case h264NALPPS:
+			if !bytes.Equal(nal, h.PPS) {
+				h.PPS, changed = append([]byte(nil), nal...), true
+			}
+		}
+	}
+	return changed, nil
+}
+
+// Whether both SPS and PPS are present
+func (h *H264ParameterSets) Ready() bool { return len(h.SPS) > 0 && len(h.PPS) > 0 }
+
+// Converts an Annex B frame to 4-byte length-prefixed NAL units, leaving out
+// access unit delimiters
+func H264AnnexBToAVCC(b []byte) []byte {
+	nals := SplitH264AnnexB(b)
+	size := 0
+	for _, nal := range nals {
+		size += 4 + len(nal)
+	}
+	ret := make([]byte, 0, size)
+	for _, nal := range nals {
+		if len(nal) == 0 || nal[0]&0x1f == h264NALAUD {
+			continue
+		}
+		ret = append(ret, byte(len(nal)>>24), byte(len(nal)>>16), byte(len(nal)>>8), byte(len(nal)))
+		ret = append(ret, nal...)
+	}
+	return ret
+}
+
+// Parses the SPS NAL (including its header byte) for the cropped picture size
+func ParseH264SPSDimensions(sps []byte) (width, height int, err error) {
+	if len(sps) < 4 {
+		return 0, 0, fmt.Errorf("SPS too short")
+	}
+	r := &bitReader{b: unescapeH264RBSP(sps[1:])}
+	profileIDC := r.bits(8)
+	r.skip(16) // Constraint flags and level
+	r.ue()     // SPS ID
+	chromaFormatIDC := uint64(1)
+	separateColourPlane := false
+	switch profileIDC {
+	case 100, 110, 122, 244, 44, 83, 86, 118, 128, 138, 139, 134, 135:
+		if chromaFormatIDC = r.ue(); chromaFormatIDC == 3 {
+			separateColourPlane = r.bit()
+		}
+		r.ue()    // Bit depth luma
+		r.ue()    // Bit depth chroma
+		r.skip(1) // Transform bypass
+		if r.bit() {
+			// Scaling matrices
+			count := 8
+			if chromaFormatIDC == 3 {
+				count = 12
+			}
+			for i := 0; i < count; i++ {
+				if !r.bit() {
+					continue
+				}
+				size := 16
+				if i >= 6 {
+					size = 64
+				}
+				last, next := int64(8), int64(8)
+				for j := 0; j < size; j++ {
+					if next != 0 {
+						next = (last + r.se() + 256) % 256
+					}
+					if next != 0 {
+						last = next
+					}
+				}
+			}
+		}
+	}
+	r.ue() // Log2 max frame num
+	switch r.ue() {
+	case 0:
+		r.ue() // Log2 max pic order count LSB
+	case 1:
+		r.skip(1) // Delta pic order always zero
+		r.se()    // Offset for non-ref pic
+		r.se()    // Offset for top to bottom field
+		for n := r.ue(); n > 0 && r.err == nil; n-- {
+			r.se()
+		}
+	}
+	r.ue()    // Max ref frames
+	r.skip(1) // Gaps allowed
+	widthMBs := int(r.ue()) + 1
+	heightMapUnits := int(r.ue()) + 1
+	frameMBSOnly := r.bit()
+	if !frameMBSOnly {
+		r.skip(1) // MB adaptive frame field
+	}
+	r.skip(1) // Direct 8x8 inference
+	var cropLeft, cropRight, cropTop, cropBottom int
+	if r.bit() {
+		cropLeft, cropRight, cropTop, cropBottom = int(r.ue()), int(r.ue()), int(r.ue()), int(r.ue())
+	}
+	if r.err != nil {
+		return 0, 0, fmt.Errorf("invalid SPS: %w", r.err)
+	}
+	fieldFactor := 2
+	if frameMBSOnly {
+		fieldFactor = 1
+	}
+	cropUnitX, cropUnitY := 1, fieldFactor
+	if chromaFormatIDC != 0 && !separateColourPlane {
+		// 4:2:0 halves both, 4:2:2 halves width only, 4:4:4 neither
+		if chromaFormatIDC == 1 || chromaFormatIDC == 2 {
+			cropUnitX = 2
+		}
+		if chromaFormatIDC == 1 {
+			cropUnitY *= 2
+		}
+	}
+	width = widthMBs*16 - (cropLeft+cropRight)*cropUnitX
+	height = fieldFactor*heightMapUnits*16 - (cropTop+cropBottom)*cropUnitY
+	return width, height, nil
+}
+
+// Removes emulation prevention bytes
+func unescapeH264RBSP(b []byte) []byte {
+	ret := make([]byte, 0, len(b))
+	zeros := 0
+	for _, v := range b {
+		if zeros >= 2 && v == 3 {
+			zeros = 0
+			continue
+		}
+		if v == 0 {
+			zeros++
+		} else {
+			zeros = 0
+		}
+		ret = append(ret, v)
+	}
+	return ret
+}
+
+var errBitReaderEOF = errors.New("not enough bits")
+
+// MSB-first bit reader. After err is set, all reads return 0.
+type bitReader struct {
+	b   []byte
+	pos int
+	err error
+}
+
+func (r *bitReader) bit() bool { return r.bits(1) == 1 }
+
+func (r *bitReader) skip(n int) { r.bits(n) }
+
+func (r *bitReader) bits(n int) uint64 {
+	var v uint64
+	for i := 0; i < n; i++ {
+		if r.err != nil || r.pos >= len(r.b)*8 {
+			r.err = errBitReaderEOF
+			return 0
+		}
+		v = v<<1 | uint64(r.b[r.pos/8]>>(7-r.pos%8)&1)
+		r.pos++
+	}
+	return v
+}
+
+// Unsigned exp-Golomb
+func (r *bitReader) ue() uint64 {
+	zeros := 0
+	for !r.bit() {
+		if r.err != nil || zeros > 32 {
+			r.err = errBitReaderEOF
+			return 0
+		}
+		zeros++
+	}
+	return 1<<zeros - 1 + r.bits(zeros)
+}
+
+// Signed exp-Golomb
+func (r *bitReader) se() int64 {
+	v := r.ue()
+	if v%2 == 0 {
+		return -int64(v / 2)
+	}
+	return int64(v+1) / 2
+}
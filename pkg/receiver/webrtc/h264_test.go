@@ -0,0 +1,100 @@
+package webrtc
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+)
+
+func TestParseH264SPSDimensions(t *testing.T) {
+	tests := []struct {
+		name   string
+		sps    []byte
+		width  int
+		height int
+		err    bool
+	}{
+		{
+			// Baseline, 80x45 MBs, no cropping
+			name:   "baseline 720p",
+			sps:    []byte{0x67, 0x42, 0x00, 0x1f, 0xf4, 0x02, 0x80, 0x2d, 0xc8},
+			width:  1280,
+			height: 720,
+		},
+		{
+			// High 4:2:0, 120x68 MBs, cropped 4 units (8 rows) at the bottom
+			name:   "high 1080p cropped",
+			sps:    []byte{0x67, 0x64, 0x00, 0x28, 0xac, 0xe8, 0x07, 0x80, 0x22, 0x7e, 0x54},
+			width:  1920,
+			height: 1080,
+		},
+		{
+			// Main, 45x18 MB pairs, field coded
+			name:   "interlaced 576i",
+			sps:    []byte{0x67, 0x4d, 0x00, 0x1e, 0xf4, 0x05, 0xa1, 0x22, 0x40},
+			width:  720,
+			height: 576,
+		},
+		{name: "too short", sps: []byte{0x67, 0x42, 0x00}, err: true},
+		{name: "truncated", sps: []byte{0x67, 0x64, 0x00, 0x28, 0xac, 0xe8}, err: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			width, height, err := ParseH264SPSDimensions(test.sps)
+			if test.err {
+				if err == nil {
+					t.Fatalf("expected error, got %vx%v", width, height)
+				}
+				return
+			} else if err != nil {
+				t.Fatal(err)
+			}
+			if width != test.width || height != test.height {
+				t.Fatalf("expected %vx%v, got %vx%v", test.width, test.height, width, height)
+			}
+		})
+	}
+}
+
+func TestUnescapeH264RBSP(t *testing.T) {
+	tests := []struct{ b, expected []byte }{
+		{[]byte{0x01, 0x02}, []byte{0x01, 0x02}},
+		{[]byte{0x00, 0x00, 0x03, 0x01}, []byte{0x00, 0x00, 0x01}},
+		{[]byte{0x00, 0x00, 0x03, 0x00, 0x00, 0x03}, []byte{0x00, 0x00, 0x00, 0x00}},
+		// Only after two zeros
+		{[]byte{0x00, 0x03, 0x00, 0x03}, []byte{0x00, 0x03, 0x00, 0x03}},
+	}
+	for _, test := range tests {
+		if b := unescapeH264RBSP(test.b); !bytes.Equal(b, test.expected) {
+			t.Fatalf("expected %x for %x, got %x", test.expected, test.b, b)
+		}
+	}
+}
+
+func TestH264AnnexB(t *testing.T) {
+	// 4-byte start code, AUD, 3-byte start code, SPS, PPS, then IDR
+	frame := []byte{
+		0, 0, 0, 1, 0x09, 0xf0,
+		0, 0, 1, 0x67, 0x42,
+		0, 0, 0, 1, 0x68, 0xce,
+		0, 0, 1, 0x65, 0x88, 0x84,
+	}
+	nals := SplitH264AnnexB(frame)
+	if expected := "[[9 240] [103 66] [104 206] [101 136 132]]"; fmt.Sprint(nals) != expected {
+		t.Fatalf("expected %v, got %v", expected, nals)
+	} else if !IsH264KeyFrame(frame) {
+		t.Fatal("expected key frame")
+	}
+	// AUD dropped, others length prefixed
+	expected := []byte{
+		0, 0, 0, 2, 0x67, 0x42,
+		0, 0, 0, 2, 0x68, 0xce,
+		0, 0, 0, 3, 0x65, 0x88, 0x84,
+	}
+	if avcc := H264AnnexBToAVCC(frame); !bytes.Equal(avcc, expected) {
+		t.Fatalf("expected %x, got %x", expected, avcc)
+	}
+	if IsH264KeyFrame([]byte{0, 0, 1, 0x41, 0x9a}) {
+		t.Fatal("expected non-key frame")
+	}
+}
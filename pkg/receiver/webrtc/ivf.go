@@ -0,0 +1,161 @@
+package webrtc
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// IVF timestamps are in milliseconds
+const ivfTimebase = 1000
+
+// Four character codes for IVF keyed by codec name
+var ivfFourCCs = map[string]string{
+	"vp8":  "VP80",
+	"vp9":  "VP90",
+	"av1":  "AV01",
+	"h264": "H264",
+}
+
+// Writes video frames into IVF, the simple single stream container used by
+// libvpx and understood by ffmpeg. Not safe for concurrent use.
+type IVFWriter struct {
+	w io.Writer
+}
+
+// Writes the header immediately. The frame count in the header is left at 0
+// since the stream is written live.
+func NewIVFWriter(w io.Writer, fourCC string, width, height int) (*IVFWriter, error) {
+	if len(fourCC) != 4 {
+		return nil, fmt.Errorf("invalid four character code %q", fourCC)
+	}
+	header := make([]byte, 32)
+	copy(header, "DKIF")
+	binary.LittleEndian.PutUint16(header[6:], 32)
+	copy(header[8:], fourCC)
+	binary.LittleEndian.PutUint16(header[12:], uint16(width))
+	binary.LittleEndian.PutUint16(header[14:], uint16(height))
+	binary.LittleEndian.PutUint32(header[16:], ivfTimebase)
+	binary.LittleEndian.PutUint32(header[20:], 1)
+	if _, err := w.Write(header); err != nil {
+		return nil, err
+	}
+	return &IVFWriter{w: w}, nil
+}
+
+// Writes the frame with its header in a single write
+func (i *IVFWriter) WriteFrame(timestamp time.Duration, data []byte) error {
+	b := make([]byte, 12, 12+len(data))
+	binary.LittleEndian.PutUint32(b, uint32(len(data)))
+	binary.LittleEndian.PutUint64(b[4:], uint64(timestamp/(time.Second/ivfTimebase)))
+	_, err := i.w.Write(append(b, data...))
+	return err
+}
+
+// Does not close session but does close writer. Always returns error, may be
+// EOF on session end. Only the video stream is saved.
+func SaveSessionToIVF(ctx context.Context, w io.WriteCloser, s *Session) error {
+	return SaveFramesToIVF(ctx, w, s, NewFrameBuffer(s, FrameBufferConfig{}))
+}
+
+// Same as SaveSessionToIVF but reads the session frames from the given reader,
+// e.g. a Subscriber.
+func SaveFramesToIVF(ctx context.Context, w io.WriteCloser, s *Session, frames FrameReader) error {
+	defer w.Close()
+	if s.Video == nil {
+		return fmt.Errorf("no video stream")
+	}
+	fourCC := ivfFourCCs[s.Video.CodecName]
+	if fourCC == "" {
+		return fmt.Errorf("unsupported video codec %v", s.Video.CodecName)
+	}
+	out := &ivfOutput{w: w, fourCC: fourCC, session: s}
+	// Run in the background so context can close this. The lock keeps the pipe
+	// from writing once we're done.
+	var lock sync.Mutex
+	errCh := make(chan error, 1)
+	go func() { errCh <- pipeIVF(out, &lock, frames) }()
+	// Finish when context is done or error
+	var err error
+	select {
+	case <-ctx.Done():
+		err = ctx.Err()
+	case err = <-errCh:
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	out.closed = true
+	return err
+}
+
+// Doesn't close anything
+func pipeIVF(out *ivfOutput, lock *sync.Mutex, frames FrameReader) error {
+	var f Frame
+	for {
+		if err := frames.Read(&f); err != nil {
+			return err
+		} else if f.Audio {
+			continue
+		}
+		lock.Lock()
+		err := out.writeFrame(&f)
+		lock.Unlock()
+		if err != nil {
+			return fmt.Errorf("failed writing video: %w", err)
+		}
+	}
+}
+
+// Starts the IVF writer on the first key frame and keeps timestamps relative
+// to it
+type ivfOutput struct {
+	w       io.Writer
+	fourCC  string
+	session *Session
+	// Nil until the first key frame
+	ivf           *IVFWriter
+	h264          H264ParameterSets
+	start         time.Duration
+	lastTimestamp time.Duration
+	closed        bool
+}
+
+func (o *ivfOutput) writeFrame(f *Frame) error {
+	if o.closed {
+		return fmt.Errorf("writer closed")
+	}
+	// The header needs the size from the first key frame
+	if o.ivf == nil {
+		width, height, ok := o.keyFrameSize(f)
+		if !ok {
+			o.session.requestKeyFrame()
+			return nil
+		}
+		var err error
+		if o.ivf, err = NewIVFWriter(o.w, o.fourCC, width, height); err != nil {
+			return err
+		}
+		o.start = f.Timestamp
+	}
+	timestamp := f.Timestamp - o.start
+	if timestamp < o.lastTimestamp {
+		timestamp = o.lastTimestamp
+	}
+	o.lastTimestamp = timestamp
+	return o.ivf.WriteFrame(timestamp, f.Data)
+}
+
+// Gets the picture size if the frame is a usable key frame
+func (o *ivfOutput) keyFrameSize(f *Frame) (width, height int, ok bool) {
+	if !f.KeyFrame {
+		return 0, 0, false
+	} else if o.session.Video.CodecName != "h264" {
+		return webmKeyFrameSize(o.session.Video.CodecName, f.Data)
+	}
+	// Bad parameter sets are ignored and the previous ones kept
+	o.h264.Update(f.Data)
+	return o.h264.Width, o.h264.Height, o.h264.Ready()
+}
@@ -0,0 +1,589 @@
+package webrtc
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// Used when FragmentedMP4Writer.MaxFragmentDuration is 0
+const DefaultMaxFragmentDuration = time.Second
+
+// A track in a fragmented MP4
+type MP4Track struct {
+	// One of "h264", "opus", or "aac"
+	Codec string
+	// Ticks per second for sample times. If 0, defaults to 90000 for video, 48000
+	// for opus, and the sample rate for aac.
+	Timescale uint32
+	// H.264 only. Must be ready before the first fragment is written. Width and
+	// height are taken from the SPS.
+	H264 H264ParameterSets
+	// Audio only, default to 2 and 48000 if 0
+	Channels   int
+	SampleRate int
+}
+
+func (t *MP4Track) video() bool { return t.Codec == "h264" }
+
+func (t *MP4Track) timescale() uint32 {
+	switch {
+	case t.Timescale > 0:
+		return t.Timescale
+	case t.video():
+		return 90000
+	case t.Codec == "aac":
+		return uint32(t.sampleRate())
+	default:
+		return opusGranuleRate
+	}
+}
+
+func (t *MP4Track) channels() int {
+	if t.Channels > 0 {
+		return t.Channels
+	}
+	return 2
+}
+
+func (t *MP4Track) sampleRate() int {
+	if t.SampleRate > 0 {
+		return t.SampleRate
+	}
+	return 48000
+}
+
+type MP4Sample struct {
+	// Decode time in track timescale ticks
+	Time uint64
+	// In track timescale ticks. Only used for the last sample of a track in a
+	// fragment, the rest use the distance to the next sample.
+	Duration uint32
+	KeyFrame bool
+	// H.264 samples are 4-byte length-prefixed NAL units, audio samples are raw
+	// codec packets
+	Data []byte
+}
+
+// Writes tracks as an init segment followed by fragments (moof + mdat), usable
+// as CMAF. The init segment is written with the first fragment. Fragments are
+// cut at video key frames or once a fragment reaches MaxFragmentDuration. Not
+// safe for concurrent use.
+type FragmentedMP4Writer struct {
+	MaxFragmentDuration time.Duration
+	// Called after each fragment is written if set
+	OnFragment func(MP4Fragment)
+
+	w           io.Writer
+	tracks      []*MP4Track
+	pending     [][]MP4Sample
+	initWritten bool
+	sequence    uint32
+	closed      bool
+}
+
+// Describes a written fragment
+type MP4Fragment struct {
+	Sequence uint32
+	// Earliest sample time in the fragment
+	Time time.Duration
+	// From the earliest sample start to the latest sample end
+	Duration time.Duration
+	// Whether the fragment starts with a video key frame. Always true without
+	// video.
+	Independent bool
+}
+
+// Tracks may be updated until the first fragment is written
+func NewFragmentedMP4Writer(w io.Writer, tracks ...*MP4Track) *FragmentedMP4Writer {
+	return &FragmentedMP4Writer{w: w, tracks: tracks, pending: make([][]MP4Sample, len(tracks))}
+}
+
+// Track is the index of the track as given in the constructor
+func (m *FragmentedMP4Writer) WriteSample(track int, sample MP4Sample) error {
+	if m.closed {
+		return fmt.Errorf("writer closed")
+	} else if track < 0 || track >= len(m.tracks) {
+		return fmt.Errorf("unknown track %v", track)
+	}
+	// Cut before video key frames or if this track's samples are long enough
+	maxDur := m.MaxFragmentDuration
+	if maxDur <= 0 {
+		maxDur = DefaultMaxFragmentDuration
+	}
+	cut := sample.KeyFrame && m.tracks[track].video()
+	if pending := m.pending[track]; !cut && len(pending) > 0 {
+		ticks := uint64(maxDur) * uint64(m.tracks[track].timescale()) / uint64(time.Second)
+		cut = sample.Time-pending[0].Time >= ticks
+	}
+	if cut {
+		if err := m.Flush(); err != nil {
+			return err
+		}
+	}
+	m.pending[track] = append(m.pending[track], sample)
+	return nil
+}
+
+// Writes any pending samples as a fragment, writing the init segment first if
+// not already written
+func (m *FragmentedMP4Writer) Flush() error {
+	empty := true
+	for _, samples := range m.pending {
+		empty = empty && len(samples) == 0
+	}
+	if empty {
+		return nil
+	}
+	if !m.initWritten {
+		init, err := m.initSegment()
+		if err != nil {
+			return err
+		} else if _, err = m.w.Write(init); err != nil {
+			return err
+		}
+		m.initWritten = true
+	}
+	m.sequence++
+	// Build once to get the moof size for the data offsets, then again for real
+	moof := m.moof(0)
+	moof = m.moof(uint32(len(moof)) + 8)
+	mdatSize := 8
+	for _, samples := range m.pending {
+		for _, sample := range samples {
+			mdatSize += len(sample.Data)
+		}
+	}
+	frag := m.fragment()
+	b := make([]byte, 0, len(moof)+mdatSize)
+	b = append(b, moof...)
+	b = append(b, mp4U32(uint32(mdatSize))...)
+	b = append(b, "mdat"...)
+	for i, samples := range m.pending {
+		for _, sample := range samples {
+			b = append(b, sample.Data...)
+		}
+		m.pending[i] = samples[:0]
+	}
+	if _, err := m.w.Write(b); err != nil {
+		return err
+	}
+	if m.OnFragment != nil {
+		m.OnFragment(frag)
+	}
+	return nil
+}
+
+// Describes the pending samples
+func (m *FragmentedMP4Writer) fragment() MP4Fragment {
+	frag := MP4Fragment{Sequence: m.sequence, Independent: true}
+	var end time.Duration
+	hasTime := false
+	for i, samples := range m.pending {
+		if len(samples) == 0 {
+			continue
+		}
+		timescale := m.tracks[i].timescale()
+		last := samples[len(samples)-1]
+		if start := ticksToDuration(samples[0].Time, timescale); !hasTime || start < frag.Time {
+			frag.Time, hasTime = start, true
+		}
+		if sampleEnd := ticksToDuration(last.Time+uint64(last.Duration), timescale); sampleEnd > end {
+			end = sampleEnd
+		}
+		if m.tracks[i].video() && !samples[0].KeyFrame {
+			frag.Independent = false
+		}
+	}
+	frag.Duration = end - frag.Time
+	return frag
+}
+
+// Flushes pending samples. Does not close the underlying writer.
+func (m *FragmentedMP4Writer) Close() error {
+	if m.closed {
+		return nil
+	}
+	m.closed = true
+	return m.Flush()
+}
+
+func (m *FragmentedMP4Writer) initSegment() ([]byte, error) {
+	ftyp := mp4Box("ftyp", []byte("iso6"), mp4U32(0), []byte("iso6cmfcisommp41"))
+	mvhd := mp4FullBox("mvhd", 0, 0,
+		mp4U32(0), mp4U32(0), // Creation and modification time
+		mp4U32(1000), mp4U32(0), // Timescale and duration
+		mp4U32(0x00010000), mp4U16(0x0100), make([]byte, 10), // Rate, volume, reserved
+		mp4Matrix, make([]byte, 24),
+		mp4U32(uint32(len(m.tracks)+1)),
+	)
+	moov := [][]byte{mvhd}
+	var trexs [][]byte
+	for i, track := range m.tracks {
+		trak, err := m.trak(uint32(i+1), track)
+		if err != nil {
+			return nil, err
+		}
+		moov = append(moov, trak)
+		trexs = append(trexs, mp4FullBox("trex", 0, 0, mp4U32(uint32(i+1)), mp4U32(1), mp4U32(0), mp4U32(0), mp4U32(0)))
+	}
+	moov = append(moov, mp4Box("mvex", trexs...))
+	return append(ftyp, mp4Box("moov", moov...)...), nil
+}
+
+func (m *FragmentedMP4Writer) trak(id uint32, track *MP4Track) ([]byte, error) {
+	var sampleEntry, mediaHeader []byte
+	var handler string
+	var width, height, volume uint16
+	switch track.Codec {
+	case "h264":
+		if !track.H264.Ready() {
+			return nil, fmt.Errorf("missing H.264 parameter sets")
+		}
+		width, height = uint16(track.H264.Width), uint16(track.H264.Height)
+		sampleEntry = mp4Box("avc1",
+			make([]byte, 6), mp4U16(1), make([]byte, 16), // Reserved, data ref index, pre-defined
+			mp4U16(width), mp4U16(height),
+			mp4U32(0x00480000), mp4U32(0x00480000), mp4U32(0), mp4U16(1), // 72 DPI, 1 frame per sample
+			make([]byte, 32), mp4U16(0x0018), mp4U16(0xFFFF), // No compressor name, depth, pre-defined
+			mp4AVCConfig(&track.H264),
+		)
+		handler, mediaHeader = "vide", mp4FullBox("vmhd", 0, 1, make([]byte, 8))
+	case "opus", "aac":
+		volume = 0x0100
+		typ, sampleRate := "Opus", track.sampleRate()
+		var config []byte
+		if track.Codec == "opus" {
+			config = mp4Box("dOps", []byte{0, uint8(track.channels())}, mp4U16(0), // Version, channels, pre-skip
+				mp4U32(uint32(sampleRate)), mp4U16(0), []byte{0}) // Input rate, gain, mapping family
+			// Opus sample entries always say 48kHz
+			sampleRate = opusGranuleRate
+		} else {
+			var err error
+			if config, err = mp4AACConfig(id, track); err != nil {
+				return nil, err
+			}
+			typ = "mp4a"
+		}
+		sampleEntry = mp4Box(typ,
+			make([]byte, 6), mp4U16(1), make([]byte, 8), // Reserved, data ref index, reserved
+			mp4U16(uint16(track.channels())), mp4U16(16), make([]byte, 4), // Channels, sample size, reserved
+			mp4U32(uint32(sampleRate)<<16),
+			config,
+		)
+		handler, mediaHeader = "soun", mp4FullBox("smhd", 0, 0, make([]byte, 4))
+	default:
+		return nil, fmt.Errorf("unsupported MP4 codec %v", track.Codec)
+	}
+	tkhd := mp4FullBox("tkhd", 0, 3, // Enabled and in movie
+		mp4U32(0), mp4U32(0), mp4U32(id), mp4U32(0), mp4U32(0), // Times, ID, reserved, duration
+		make([]byte, 8), mp4U16(0), mp4U16(0), mp4U16(volume), mp4U16(0), // Reserved, layer, group, volume, reserved
+		mp4Matrix, mp4U32(uint32(width)<<16), mp4U32(uint32(height)<<16),
+	)
+	mdhd := mp4FullBox("mdhd", 0, 0,
+		mp4U32(0), mp4U32(0), mp4U32(track.timescale()), mp4U32(0),
+		mp4U16(0x55C4), mp4U16(0), // "und" language
+	)
+	hdlr := mp4FullBox("hdlr", 0, 0, mp4U32(0), []byte(handler), make([]byte, 12), []byte("takecast\x00"))
+	dinf := mp4Box("dinf", mp4FullBox("dref", 0, 0, mp4U32(1), mp4FullBox("url ", 0, 1)))
+	stbl := mp4Box("stbl",
+		mp4FullBox("stsd", 0, 0, mp4U32(1), sampleEntry),
+		mp4FullBox("stts", 0, 0, mp4U32(0)),
+		mp4FullBox("stsc", 0, 0, mp4U32(0)),
+		mp4FullBox("stsz", 0, 0, mp4U32(0), mp4U32(0)),
+		mp4FullBox("stco", 0, 0, mp4U32(0)),
+	)
+	minf := mp4Box("minf", mediaHeader, dinf, stbl)
+	return mp4Box("trak", tkhd, mp4Box("mdia", mdhd, hdlr, minf)), nil
+}
+
+// Data offset is where the mdat payload starts relative to the moof start
+func (m *FragmentedMP4Writer) moof(dataOffset uint32) []byte {
+	const (
+		tfhdDefaultBaseIsMoof = 0x020000
+		trunDataOffset        = 0x000001
+		trunSampleDuration    = 0x000100
+		trunSampleSize        = 0x000200
+		trunSampleFlags       = 0x000400
+		// Depends on no others
+		sampleFlagsSync = 0x02000000
+		// Depends on others and not a sync sample
+		sampleFlagsNonSync = 0x01010000
+	)
+	boxes := [][]byte{mp4FullBox("mfhd", 0, 0, mp4U32(m.sequence))}
+	for i, samples := range m.pending {
+		if len(samples) == 0 {
+			continue
+		}
+		trun := [][]byte{mp4U32(uint32(len(samples))), mp4U32(dataOffset)}
+		for j, sample := range samples {
+			dur := sample.Duration
+			if j+1 < len(samples) {
+				dur = uint32(samples[j+1].Time - sample.Time)
+			}
+			flags := uint32(sampleFlagsNonSync)
+			if sample.KeyFrame || !m.tracks[i].video() {
+				flags = sampleFlagsSync
+			}
+			trun = append(trun, mp4U32(dur), mp4U32(uint32(len(sample.Data))), mp4U32(flags))
+			dataOffset += uint32(len(sample.Data))
+		}
+		boxes = append(boxes, mp4Box("traf",
+			mp4FullBox("tfhd", 0, tfhdDefaultBaseIsMoof, mp4U32(uint32(i+1))),
+			mp4FullBox("tfdt", 1, 0, mp4U64(samples[0].Time)),
+			mp4FullBox("trun", 0, trunDataOffset|trunSampleDuration|trunSampleSize|trunSampleFlags, trun...),
+		))
+	}
+	return mp4Box("moof", boxes...)
+}
+
+// AVCDecoderConfigurationRecord with 4-byte NAL lengths
+func mp4AVCConfig(h *H264ParameterSets) []byte {
+	return mp4Box("avcC",
+		[]byte{1, h.SPS[1], h.SPS[2], h.SPS[3], 0xFC | 3, 0xE0 | 1},
+		mp4U16(uint16(len(h.SPS))), h.SPS,
+		[]byte{1}, mp4U16(uint16(len(h.PPS))), h.PPS,
+	)
+}
+
+var mp4AACSampleRates = []int{96000, 88200, 64000, 48000, 44100, 32000, 24000, 22050, 16000, 12000, 11025, 8000, 7350}
+
+// Elementary stream descriptor for AAC-LC
+func mp4AACConfig(id uint32, track *MP4Track) ([]byte, error) {
+	freqIndex := -1
+	for i, rate := range mp4AACSampleRates {
+		if rate == track.sampleRate() {
+			freqIndex = i
+		}
+	}
+	if freqIndex == -1 {
+		return nil, fmt.Errorf("unsupported AAC sample rate %v", track.sampleRate())
+	}
+	const aacLC = 2
+	audioConfig := mp4U16(uint16(aacLC<<11 | freqIndex<<7 | track.channels()<<3))
+	decoderSpecific := mp4Descriptor(0x05, audioConfig)
+	decoderConfig := mp4Descriptor(0x04,
+		// MPEG-4 audio, audio stream, buffer size, max and avg bit rate
+		[]byte{0x40, 0x15, 0, 0, 0}, mp4U32(0), mp4U32(0),
+		decoderSpecific,
+	)
+	slConfig := mp4Descriptor(0x06, []byte{0x02})
+	return mp4FullBox("esds", 0, 0, mp4Descriptor(0x03, mp4U16(uint16(id)), []byte{0}, decoderConfig, slConfig)), nil
+}
+
+// Removes the ADTS header if present
+func stripADTS(b []byte) []byte {
+	if len(b) < 7 || b[0] != 0xFF || b[1]&0xF6 != 0xF0 {
+		return b
+	}
+	// No CRC if protection absent bit set
+	if b[1]&0x01 == 0 {
+		if len(b) < 9 {
+			return b
+		}
+		return b[9:]
+	}
+	return b[7:]
+}
+
+var mp4Matrix = func() []byte {
+	b := make([]byte, 36)
+	binary.BigEndian.PutUint32(b, 0x00010000)
+	binary.BigEndian.PutUint32(b[16:], 0x00010000)
+	binary.BigEndian.PutUint32(b[32:], 0x40000000)
+	return b
+}()
+
+func mp4Box(typ string, payload ...[]byte) []byte {
+	size := 8
+	for _, p := range payload {
+		size += len(p)
+	}
+	b := make([]byte, 8, size)
+	binary.BigEndian.PutUint32(b, uint32(size))
+	copy(b[4:], typ)
+	for _, p := range payload {
+		b = append(b, p...)
+	}
+	return b
+}
+
+func mp4FullBox(typ string, version uint8, flags uint32, payload ...[]byte) []byte {
+	header := []byte{version, byte(flags >> 16), byte(flags >> 8), byte(flags)}
+	return mp4Box(typ, append([][]byte{header}, payload...)...)
+}
+
+// Only supports payloads under 128 bytes
+func mp4Descriptor(tag byte, payload ...[]byte) []byte {
+	b := []byte{tag, 0}
+	for _, p := range payload {
+		b = append(b, p...)
+	}
+	b[1] = byte(len(b) - 2)
+	return b
+}
+
+func mp4U16(v uint16) []byte { return []byte{byte(v >> 8), byte(v)} }
+
+func mp4U32(v uint32) []byte { b := make([]byte, 4); binary.BigEndian.PutUint32(b, v); return b }
+
+func mp4U64(v uint64) []byte { b := make([]byte, 8); binary.BigEndian.PutUint64(b, v); return b }
+
+// Converts from ticks without overflowing on long durations
+func ticksToDuration(ticks uint64, timescale uint32) time.Duration {
+	return time.Duration(ticks/uint64(timescale))*time.Second +
+		time.Duration(ticks%uint64(timescale))*time.Second/time.Duration(timescale)
+}
+
+// Converts to ticks of the clock rate or timescale without overflowing on long
+// durations. Negative durations are 0.
+func DurationToTicks(d time.Duration, timescale uint32) uint64 {
+	if d < 0 {
+		return 0
+	}
+	return uint64(d/time.Second)*uint64(timescale) + uint64(d%time.Second)*uint64(timescale)/uint64(time.Second)
+}
+
+// Does not close session but does close writer. Always returns error, may be
+// EOF on session end. Video must be h264 and audio opus or aac.
+func SaveSessionToMP4(ctx context.Context, w io.WriteCloser, s *Session) error {
+	return SaveFramesToMP4(ctx, w, s, NewFrameBuffer(s, FrameBufferConfig{}))
+}
+
+// Same as SaveSessionToMP4 but reads the session frames from the given reader,
+// e.g. a Subscriber.
+func SaveFramesToMP4(ctx context.Context, w io.WriteCloser, s *Session, frames FrameReader) error {
+	defer w.Close()
+	muxer, err := NewMP4SessionMuxer(w, s)
+	if err != nil {
+		return err
+	}
+	// Run in the background so context can close this. The lock lets us flush
+	// while the pipe may still be running.
+	var lock sync.Mutex
+	errCh := make(chan error, 1)
+	go func() { errCh <- pipeMP4(muxer, &lock, frames) }()
+	// Finish when context is done or error
+	select {
+	case <-ctx.Done():
+		err = ctx.Err()
+	case err = <-errCh:
+	}
+	// The pipe will fail on its next write if still running
+	lock.Lock()
+	defer lock.Unlock()
+	// Ignore error
+	muxer.Close()
+	return err
+}
+
+// Doesn't close anything
+func pipeMP4(muxer *MP4SessionMuxer, lock *sync.Mutex, frames FrameReader) error {
+	var f Frame
+	for {
+		if err := frames.Read(&f); err != nil {
+			return err
+		}
+		lock.Lock()
+		_, err := muxer.WriteFrame(&f)
+		lock.Unlock()
+		if err != nil {
+			return fmt.Errorf("failed writing sample: %w", err)
+		}
+	}
+}
+
+// Writes session frames as fragmented MP4. Frames are dropped until the first
+// video key frame with H.264 parameter sets (or first frame if audio only), and
+// times start at 0 from that frame. Not safe for concurrent use.
+type MP4SessionMuxer struct {
+	// Fields like MaxFragmentDuration and OnFragment can be set before the first
+	// frame is written
+	Writer *FragmentedMP4Writer
+
+	session    *Session
+	audioTrack int
+	videoTrack int
+	started    bool
+	start      time.Duration
+	// Last written ticks to keep them from going backwards when streams are
+	// re-synced
+	lastTicks []uint64
+}
+
+// Video must be h264 and audio opus or aac
+func NewMP4SessionMuxer(w io.Writer, s *Session) (*MP4SessionMuxer, error) {
+	m := &MP4SessionMuxer{session: s, audioTrack: -1, videoTrack: -1}
+	var tracks []*MP4Track
+	if s.Audio != nil {
+		if s.Audio.CodecName != "opus" && s.Audio.CodecName != "aac" {
+			return nil, fmt.Errorf("expected opus or aac audio codec, got %v", s.Audio.CodecName)
+		}
+		m.audioTrack = len(tracks)
+		tracks = append(tracks, &MP4Track{
+			Codec:      s.Audio.CodecName,
+			Channels:   s.Audio.Channels,
+			SampleRate: int(s.Audio.SampleRate),
+		})
+	}
+	if s.Video != nil {
+		if s.Video.CodecName != "h264" {
+			return nil, fmt.Errorf("expected h264 video codec, got %v", s.Video.CodecName)
+		}
+		m.videoTrack = len(tracks)
+		tracks = append(tracks, &MP4Track{Codec: "h264"})
+	}
+	m.Writer = NewFragmentedMP4Writer(w, tracks...)
+	m.lastTicks = make([]uint64, len(tracks))
+	return m, nil
+}
+
+// Returns false if the frame was dropped because the muxer is not started yet
+// or it is from before the start. Asks the sender for a key frame if waiting on
+// one.
+func (m *MP4SessionMuxer) WriteFrame(f *Frame) (bool, error) {
+	track, data := m.audioTrack, f.Data
+	if f.Audio {
+		// Audio before the start is dropped
+		if (!m.started && m.videoTrack != -1) || (m.started && f.Timestamp < m.start) {
+			return false, nil
+		} else if m.session.Audio.CodecName == "aac" {
+			data = stripADTS(data)
+		}
+	} else {
+		track = m.videoTrack
+		h264 := &m.Writer.tracks[track].H264
+		// Bad parameter sets are ignored and the previous ones kept
+		h264.Update(f.Data)
+		if !m.started && (!f.KeyFrame || !h264.Ready()) {
+			m.session.requestKeyFrame()
+			return false, nil
+		}
+		data = H264AnnexBToAVCC(f.Data)
+	}
+	if !m.started {
+		m.start, m.started = f.Timestamp, true
+	}
+	timescale := m.Writer.tracks[track].timescale()
+	ticks := DurationToTicks(f.Timestamp-m.start, timescale)
+	if ticks < m.lastTicks[track] {
+		ticks = m.lastTicks[track]
+	}
+	m.lastTicks[track] = ticks
+	sample := MP4Sample{
+		Time:     ticks,
+		Duration: uint32(DurationToTicks(f.Duration, timescale)),
+		KeyFrame: f.KeyFrame,
+		Data:     data,
+	}
+	if err := m.Writer.WriteSample(track, sample); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Flushes pending samples. Does not close the underlying writer.
+func (m *MP4SessionMuxer) Close() error { return m.Writer.Close() }
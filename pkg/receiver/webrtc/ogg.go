@@ -0,0 +1,236 @@
+package webrtc
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+const (
+	oggHeaderBOS   = 0x02
+	oggHeaderEOS   = 0x04
+	oggMaxSegments = 255
+	// Flush pages once they get this big so live readers aren't starved
+	oggTargetPageSize = 4096
+	// Opus granule positions are always in 48kHz samples
+	opusGranuleRate = 48000
+)
+
+// Writes Opus packets into an Ogg container per RFC 7845. Not safe for
+// concurrent use.
+type OggOpusWriter struct {
+	w       io.Writer
+	serial  uint32
+	pageSeq uint32
+	// Data and segment table of the page being built
+	pageData     []byte
+	pageSegments []byte
+	pageGranule  uint64
+	closed       bool
+}
+
+// Writes the OpusHead and OpusTags headers immediately. The sample rate is only
+// informational, Opus is always decoded at 48kHz.
+func NewOggOpusWriter(w io.Writer, channels int, sampleRate int) (*OggOpusWriter, error) {
+	if channels < 1 || channels > 2 {
+		return nil, fmt.Errorf("unsupported channel count %v", channels)
+	}
+	o := &OggOpusWriter{w: w, serial: rand.Uint32()}
+	// OpusHead alone on the first page
+	head := make([]byte, 19)
+	copy(head, "OpusHead")
+	head[8] = 1
+	head[9] = uint8(channels)
+	// Pre-skip and output gain are left at 0, mapping family 0
+	binary.LittleEndian.PutUint32(head[12:], uint32(sampleRate))
+	if err := o.writePacket(head, 0); err != nil {
+		return nil, err
+	} else if err = o.flush(oggHeaderBOS); err != nil {
+		return nil, err
+	}
+	// OpusTags on its own page
+	const vendor = "takecast"
+	tags := make([]byte, 8+4+len(vendor)+4)
+	copy(tags, "OpusTags")
+	binary.LittleEndian.PutUint32(tags[8:], uint32(len(vendor)))
+	copy(tags[12:], vendor)
+	if err := o.writePacket(tags, 0); err != nil {
+		return nil, err
+	} else if err = o.flush(0); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+// Granule is the 48kHz sample position at the end of this packet
+func (o *OggOpusWriter) WritePacket(data []byte, granule uint64) error {
+	if o.closed {
+		return fmt.Errorf("writer closed")
+	}
+	return o.writePacket(data, granule)
+}
+
+func (o *OggOpusWriter) writePacket(data []byte, granule uint64) error {
+	// Lacing values are 255s followed by a final value less than 255
+	segments := len(data)/255 + 1
+	if segments > oggMaxSegments {
+		return fmt.Errorf("packet too large")
+	}
+	// Flush first if it won't fit
+	if len(o.pageSegments)+segments > oggMaxSegments {
+		if err := o.flush(0); err != nil {
+			return err
+		}
+	}
+	for i := 0; i < segments-1; i++ {
+		o.pageSegments = append(o.pageSegments, 255)
+	}
+	o.pageSegments = append(o.pageSegments, uint8(len(data)%255))
+	o.pageData = append(o.pageData, data...)
+	o.pageGranule = granule
+	if len(o.pageData) >= oggTargetPageSize {
+		return o.flush(0)
+	}
+	return nil
+}
+
+// Writes any pending page
+func (o *OggOpusWriter) Flush() error { return o.flush(0) }
+
+func (o *OggOpusWriter) flush(headerType byte) error {
+	if len(o.pageSegments) == 0 && headerType&oggHeaderEOS == 0 {
+		return nil
+	}
+	page := make([]byte, 27+len(o.pageSegments)+len(o.pageData))
+	copy(page, "OggS")
+	page[5] = headerType
+	binary.LittleEndian.PutUint64(page[6:], o.pageGranule)
+	binary.LittleEndian.PutUint32(page[14:], o.serial)
+	binary.LittleEndian.PutUint32(page[18:], o.pageSeq)
+	page[26] = uint8(len(o.pageSegments))
+	copy(page[27:], o.pageSegments)
+	copy(page[27+len(o.pageSegments):], o.pageData)
+	binary.LittleEndian.PutUint32(page[22:], oggCRC(page))
+	o.pageSeq++
+	o.pageSegments, o.pageData = o.pageSegments[:0], o.pageData[:0]
+	_, err := o.w.Write(page)
+	return err
+}
+
+// Flushes the last page marked as end of stream. Does not close the underlying
+// writer.
+func (o *OggOpusWriter) Close() error {
+	if o.closed {
+		return nil
+	}
+	o.closed = true
+	return o.flush(oggHeaderEOS)
+}
+
+var oggCRCTable = func() (table [256]uint32) {
+	for i := range table {
+		r := uint32(i) << 24
+		for j := 0; j < 8; j++ {
+			if r&0x80000000 != 0 {
+				r = r<<1 ^ 0x04c11db7
+			} else {
+				r <<= 1
+			}
+		}
+		table[i] = r
+	}
+	return
+}()
+
+func oggCRC(b []byte) (crc uint32) {
+	for _, v := range b {
+		crc = crc<<8 ^ oggCRCTable[byte(crc>>24)^v]
+	}
+	return
+}
+
+// Does not close session but does close writer. Always returns error, may be
+// EOF on session end. Only the audio stream is saved.
+func SaveSessionToOgg(ctx context.Context, w io.WriteCloser, s *Session) error {
+	return SaveFramesToOgg(ctx, w, s, NewFrameBuffer(s, FrameBufferConfig{}))
+}
+
+// Same as SaveSessionToOgg but reads the session frames from the given reader,
+// e.g. a Subscriber.
+func SaveFramesToOgg(ctx context.Context, w io.WriteCloser, s *Session, frames FrameReader) error {
+	defer w.Close()
+	if s.Audio == nil {
+		return fmt.Errorf("no audio stream")
+	} else if s.Audio.CodecName != "opus" {
+		return fmt.Errorf("expected opus audio codec, got %v", s.Audio.CodecName)
+	}
+	channels, sampleRate := 2, 48000
+	if s.Audio.Channels > 0 {
+		channels = s.Audio.Channels
+	}
+	if s.Audio.SampleRate > 0 {
+		sampleRate = int(s.Audio.SampleRate)
+	}
+	ogg, err := NewOggOpusWriter(w, channels, sampleRate)
+	if err != nil {
+		return err
+	}
+	// Run in the background so context can close this. The lock lets us finish
+	// the stream while the pipe may still be running.
+	var lock sync.Mutex
+	errCh := make(chan error, 1)
+	go func() { errCh <- pipeOgg(ogg, &lock, s, frames) }()
+	// Finish when context is done or error
+	select {
+	case <-ctx.Done():
+		err = ctx.Err()
+	case err = <-errCh:
+	}
+	// The pipe will fail on its next write if still running
+	lock.Lock()
+	defer lock.Unlock()
+	// Ignore error
+	ogg.Close()
+	return err
+}
+
+// Doesn't close anything
+func pipeOgg(ogg *OggOpusWriter, lock *sync.Mutex, s *Session, frames FrameReader) error {
+	clockRate := parseTimeBase(s.Audio.TimeBase)
+	if clockRate <= 0 {
+		clockRate = opusGranuleRate
+	}
+	var f Frame
+	var granule uint64
+	var lastTimestamp uint32
+	var extTimestamp int64
+	started := false
+	for {
+		if err := frames.Read(&f); err != nil {
+			return err
+		} else if !f.Audio {
+			continue
+		}
+		// Granule is the extended RTP timestamp from the start converted to
+		// 48kHz, plus this packet's samples. Gaps from lost frames are kept.
+		if !started {
+			lastTimestamp, started = f.RTPTimestamp, true
+		}
+		extTimestamp += int64(int32(f.RTPTimestamp - lastTimestamp))
+		lastTimestamp = f.RTPTimestamp
+		end := extTimestamp*opusGranuleRate/int64(clockRate) + int64(f.Duration*opusGranuleRate/time.Second)
+		if end > int64(granule) {
+			granule = uint64(end)
+		}
+		lock.Lock()
+		err := ogg.WritePacket(f.Data, granule)
+		lock.Unlock()
+		if err != nil {
+			return fmt.Errorf("failed writing audio: %w", err)
+		}
+	}
+}
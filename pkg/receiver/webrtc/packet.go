@@ -1,6 +1,8 @@
 package webrtc
 
 import (
+	"fmt"
+
 	"github.com/pion/rtcp"
 	"github.com/pion/rtp"
 )
@@ -21,7 +23,10 @@ func (p *Packet) Unmarshal(b []byte) error {
 	} else if isRTCP {
 		p.RTCP, err = rtcp.Unmarshal(b)
 	}
-	return err
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrMalformedPacket, err)
+	}
+	return nil
 }
 
 func packetType(b []byte) (rtp, rtcp bool) {
@@ -0,0 +1,202 @@
+package webrtc
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"github.com/pion/rtcp"
+)
+
+const (
+	castFeedbackFormat     = 15
+	castFeedbackIdentifier = 0x43415354 // "CAST"
+	castCST2Identifier     = 0x43535432 // "CST2"
+	// Used as the packet ID in a loss to say the whole frame is missing
+	CastAllPacketsLost = 0xFFFF
+	// Max number of loss fields to put in a feedback so it stays under MTU
+	castMaxLossFields = 100
+
+	rtcpTypeExtendedReport     = 207
+	xrBlockTypeReceiverRefTime = 4
+)
+
+// Cast-specific application layer feedback (PSFB FMT 15) sent by receivers to
+// ACK frames and NACK packets.
+type CastFeedback struct {
+	// The receiver's SSRC
+	SenderSSRC uint32
+	// The SSRC of the stream being acked/nacked
+	MediaSSRC uint32
+	// Truncated to 8 bits. All frames up to and including this one have been
+	// received (or given up on).
+	CheckpointFrameID uint8
+	PlayoutDelay      time.Duration
+	Losses            []CastLoss
+	// Incremented each time feedback is sent. Only used if ACKs are present.
+	FeedbackCount uint8
+	// Truncated frame IDs after CheckpointFrameID+1 that are fully received
+	ACKs []uint8
+}
+
+type CastLoss struct {
+	// Truncated to 8 bits
+	FrameID uint8
+	// CastAllPacketsLost if all of the frame's packets are lost
+	PacketID uint16
+	// Bit N set means PacketID+N+1 is also lost
+	Bitmask uint8
+}
+
+var _ rtcp.Packet = (*CastFeedback)(nil)
+
+func (c *CastFeedback) DestinationSSRC() []uint32 { return []uint32{c.MediaSSRC} }
+
+func (c *CastFeedback) Marshal() ([]byte, error) {
+	// Build ACK bit vector relative to checkpoint + 2
+	var ackBits []byte
+	for _, ack := range c.ACKs {
+		bit := int(ack - c.CheckpointFrameID - 2)
+		for len(ackBits) <= bit/8 {
+			ackBits = append(ackBits, 0)
+		}
+		ackBits[bit/8] |= 1 << (bit % 8)
+	}
+	// Bit vector plus its 2 count bytes must be 4-byte aligned
+	for len(ackBits) > 0 && (len(ackBits)+2)%4 != 0 {
+		ackBits = append(ackBits, 0)
+	}
+	size := 4 + 8 + 8 + 4*len(c.Losses)
+	if len(ackBits) > 0 {
+		size += 6 + len(ackBits)
+	}
+	b := make([]byte, size)
+	hdr, err := rtcp.Header{
+		Count:  castFeedbackFormat,
+		Type:   rtcp.TypePayloadSpecificFeedback,
+		Length: uint16(size/4 - 1),
+	}.Marshal()
+	if err != nil {
+		return nil, err
+	}
+	copy(b, hdr)
+	binary.BigEndian.PutUint32(b[4:], c.SenderSSRC)
+	binary.BigEndian.PutUint32(b[8:], c.MediaSSRC)
+	binary.BigEndian.PutUint32(b[12:], castFeedbackIdentifier)
+	b[16] = c.CheckpointFrameID
+	if len(c.Losses) > 255 {
+		return nil, fmt.Errorf("too many losses")
+	}
+	b[17] = uint8(len(c.Losses))
+	binary.BigEndian.PutUint16(b[18:], uint16(c.PlayoutDelay/time.Millisecond))
+	offset := 20
+	for _, loss := range c.Losses {
+		b[offset] = loss.FrameID
+		binary.BigEndian.PutUint16(b[offset+1:], loss.PacketID)
+		b[offset+3] = loss.Bitmask
+		offset += 4
+	}
+	if len(ackBits) > 0 {
+		binary.BigEndian.PutUint32(b[offset:], castCST2Identifier)
+		b[offset+4] = c.FeedbackCount
+		b[offset+5] = uint8(len(ackBits))
+		copy(b[offset+6:], ackBits)
+	}
+	return b, nil
+}
+
+func (c *CastFeedback) Unmarshal(b []byte) error {
+	var hdr rtcp.Header
+	if err := hdr.Unmarshal(b); err != nil {
+		return err
+	} else if hdr.Type != rtcp.TypePayloadSpecificFeedback || hdr.Count != castFeedbackFormat {
+		return fmt.Errorf("not cast feedback")
+	} else if len(b) < 20 || binary.BigEndian.Uint32(b[12:]) != castFeedbackIdentifier {
+		return fmt.Errorf("invalid cast feedback")
+	}
+	*c = CastFeedback{
+		SenderSSRC:        binary.BigEndian.Uint32(b[4:]),
+		MediaSSRC:         binary.BigEndian.Uint32(b[8:]),
+		CheckpointFrameID: b[16],
+		PlayoutDelay:      time.Duration(binary.BigEndian.Uint16(b[18:])) * time.Millisecond,
+	}
+	offset := 20
+	for i := 0; i < int(b[17]); i++ {
+		if len(b) < offset+4 {
+			return fmt.Errorf("cast feedback loss fields too short")
+		}
+		c.Losses = append(c.Losses, CastLoss{
+			FrameID:  b[offset],
+			PacketID: binary.BigEndian.Uint16(b[offset+1:]),
+			Bitmask:  b[offset+3],
+		})
+		offset += 4
+	}
+	if len(b) >= offset+6 && binary.BigEndian.Uint32(b[offset:]) == castCST2Identifier {
+		c.FeedbackCount = b[offset+4]
+		ackBits := b[offset+6:]
+		if len(ackBits) > int(b[offset+5]) {
+			ackBits = ackBits[:b[offset+5]]
+		}
+		for i, byt := range ackBits {
+			for bit := 0; bit < 8; bit++ {
+				if byt&(1<<bit) != 0 {
+					c.ACKs = append(c.ACKs, c.CheckpointFrameID+2+uint8(i*8+bit))
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Extended report (RFC 3611) with only a receiver reference time report block
+type ReceiverReferenceTime struct {
+	SenderSSRC uint32
+	// As 64-bit NTP timestamp
+	NTPTime uint64
+}
+
+var _ rtcp.Packet = (*ReceiverReferenceTime)(nil)
+
+func (r *ReceiverReferenceTime) DestinationSSRC() []uint32 { return nil }
+
+func (r *ReceiverReferenceTime) Marshal() ([]byte, error) {
+	b := make([]byte, 20)
+	hdr, err := rtcp.Header{Type: rtcpTypeExtendedReport, Length: uint16(len(b)/4 - 1)}.Marshal()
+	if err != nil {
+		return nil, err
+	}
+	copy(b, hdr)
+	binary.BigEndian.PutUint32(b[4:], r.SenderSSRC)
+	b[8] = xrBlockTypeReceiverRefTime
+	binary.BigEndian.PutUint16(b[10:], 2)
+	binary.BigEndian.PutUint64(b[12:], r.NTPTime)
+	return b, nil
+}
+
+func (r *ReceiverReferenceTime) Unmarshal(b []byte) error {
+	var hdr rtcp.Header
+	if err := hdr.Unmarshal(b); err != nil {
+		return err
+	} else if hdr.Type != rtcpTypeExtendedReport || len(b) < 20 || b[8] != xrBlockTypeReceiverRefTime {
+		return fmt.Errorf("not receiver reference time report")
+	}
+	r.SenderSSRC = binary.BigEndian.Uint32(b[4:])
+	r.NTPTime = binary.BigEndian.Uint64(b[12:])
+	return nil
+}
+
+var ntpEpoch = time.Date(1900, 1, 1, 0, 0, 0, 0, time.UTC)
+
+func toNTPTime(t time.Time) uint64 {
+	d := t.Sub(ntpEpoch)
+	secs := uint64(d / time.Second)
+	frac := uint64(d%time.Second) << 32 / uint64(time.Second)
+	return secs<<32 | frac
+}
+
+func fromNTPTime(ntp uint64) time.Time {
+	secs := time.Duration(ntp>>32) * time.Second
+	frac := time.Duration((ntp & 0xFFFFFFFF) * uint64(time.Second) >> 32)
+	return ntpEpoch.Add(secs + frac)
+}
@@ -0,0 +1,173 @@
+package webrtc
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/pion/rtp"
+)
+
+func TestCastFeedbackMarshal(t *testing.T) {
+	tests := []struct {
+		name     string
+		feedback CastFeedback
+		b        []byte
+	}{
+		{
+			name: "losses",
+			feedback: CastFeedback{
+				SenderSSRC:        1,
+				MediaSSRC:         2,
+				CheckpointFrameID: 10,
+				PlayoutDelay:      400 * time.Millisecond,
+				Losses:            []CastLoss{{FrameID: 11, PacketID: CastAllPacketsLost}, {FrameID: 12, PacketID: 3, Bitmask: 0x81}},
+			},
+			b: []byte{
+				0x8f, 0xce, 0x00, 0x06,
+				0x00, 0x00, 0x00, 0x01,
+				0x00, 0x00, 0x00, 0x02,
+				'C', 'A', 'S', 'T',
+				10, 2, 0x01, 0x90,
+				11, 0xff, 0xff, 0x00,
+				12, 0x00, 0x03, 0x81,
+			},
+		},
+		{
+			name: "acks",
+			feedback: CastFeedback{
+				SenderSSRC:        1,
+				MediaSSRC:         2,
+				CheckpointFrameID: 254,
+				PlayoutDelay:      100 * time.Millisecond,
+				FeedbackCount:     7,
+				// Bits 0, 2, and 9 relative to checkpoint + 2, wrapping
+				ACKs: []uint8{0, 2, 9},
+			},
+			b: []byte{
+				0x8f, 0xce, 0x00, 0x06,
+				0x00, 0x00, 0x00, 0x01,
+				0x00, 0x00, 0x00, 0x02,
+				'C', 'A', 'S', 'T',
+				254, 0, 0x00, 0x64,
+				'C', 'S', 'T', '2',
+				7, 2, 0x05, 0x02,
+			},
+		},
+		{
+			name: "acks padded",
+			feedback: CastFeedback{
+				SenderSSRC:        1,
+				MediaSSRC:         2,
+				CheckpointFrameID: 0,
+				FeedbackCount:     1,
+				ACKs:              []uint8{2 + 16},
+			},
+			b: []byte{
+				0x8f, 0xce, 0x00, 0x07,
+				0x00, 0x00, 0x00, 0x01,
+				0x00, 0x00, 0x00, 0x02,
+				'C', 'A', 'S', 'T',
+				0, 0, 0x00, 0x00,
+				'C', 'S', 'T', '2',
+				1, 6, 0x00, 0x00,
+				0x01, 0x00, 0x00, 0x00,
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			b, err := test.feedback.Marshal()
+			if err != nil {
+				t.Fatal(err)
+			} else if !bytes.Equal(b, test.b) {
+				t.Fatalf("expected\n%x\ngot\n%x", test.b, b)
+			}
+			var feedback CastFeedback
+			if err := feedback.Unmarshal(b); err != nil {
+				t.Fatal(err)
+			}
+			// Feedback count is only sent with ACKs
+			if len(test.feedback.ACKs) == 0 {
+				feedback.FeedbackCount = test.feedback.FeedbackCount
+			}
+			if !reflect.DeepEqual(feedback, test.feedback) {
+				t.Fatalf("expected %+v, got %+v", test.feedback, feedback)
+			}
+		})
+	}
+}
+
+func TestCastFeedbackUnmarshalInvalid(t *testing.T) {
+	valid, err := (&CastFeedback{Losses: []CastLoss{{FrameID: 1}}}).Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, b := range map[string][]byte{
+		"short":         valid[:16],
+		"identifier":    append(append(append([]byte{}, valid[:12]...), 'N', 'O', 'P', 'E'), valid[16:]...),
+		"missing loss":  valid[:20],
+		"wrong type":    append([]byte{0x81, 0xce}, valid[2:]...),
+		"wrong version": append([]byte{0x0f}, valid[1:]...),
+	} {
+		if err := new(CastFeedback).Unmarshal(b); err == nil {
+			t.Fatalf("expected error for %v", name)
+		}
+	}
+}
+
+func TestReceiverReferenceTime(t *testing.T) {
+	r := &ReceiverReferenceTime{SenderSSRC: 3, NTPTime: 0x0102030405060708}
+	b, err := r.Marshal()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := []byte{
+		0x80, 207, 0x00, 0x04,
+		0x00, 0x00, 0x00, 0x03,
+		4, 0, 0x00, 0x02,
+		0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08,
+	}
+	if !bytes.Equal(b, expected) {
+		t.Fatalf("expected %x, got %x", expected, b)
+	}
+	var parsed ReceiverReferenceTime
+	if err := parsed.Unmarshal(b); err != nil {
+		t.Fatal(err)
+	} else if parsed != *r {
+		t.Fatalf("expected %+v, got %+v", r, parsed)
+	}
+}
+
+func TestNTPTime(t *testing.T) {
+	now := time.Date(2021, 1, 2, 3, 4, 5, 500000000, time.UTC)
+	if ntp := toNTPTime(now); ntp>>32 != 3818545445 || uint32(ntp) != 1<<31 {
+		t.Fatalf("unexpected NTP time %x", ntp)
+	} else if back := fromNTPTime(ntp); !back.Equal(now) {
+		t.Fatalf("expected %v, got %v", now, back)
+	}
+}
+
+func TestReceptionStatsJitter(t *testing.T) {
+	// A current wall time where nanoseconds times 90kHz wraps int64 during the
+	// packets, which breaks naive conversions
+	now := time.Unix(1700072430, 115376399)
+	stats := &receptionStats{clock: 90000}
+	for i := 0; i < 10; i++ {
+		p := &rtp.Packet{Header: rtp.Header{SequenceNumber: uint16(i), Timestamp: uint32(i * 1800)}}
+		stats.observe(p, now.Add(time.Duration(i)*20*time.Millisecond))
+	}
+	if report := stats.report(1, now); report.Jitter != 0 || report.TotalLost != 0 || report.LastSequenceNumber != 9 {
+		t.Fatalf("unexpected report %+v", report)
+	}
+	// One packet 10ms (900 ticks) late
+	p := &rtp.Packet{Header: rtp.Header{SequenceNumber: 11, Timestamp: 11 * 1800}}
+	stats.observe(p, now.Add(11*20*time.Millisecond+10*time.Millisecond))
+	report := stats.report(1, now)
+	if report.Jitter != 900/16 {
+		t.Fatalf("expected jitter %v, got %v", 900/16, report.Jitter)
+	} else if report.TotalLost != 1 || report.FractionLost != 128 {
+		t.Fatalf("expected 1 of 2 lost, got %+v", report)
+	}
+}
@@ -0,0 +1,43 @@
+package webrtc
+
+import (
+	"context"
+	"fmt"
+	"io"
+)
+
+// Formats accepted by SaveFrames
+var SaveFormats = []string{"webm", "mp4", "ivf", "ogg"}
+
+// Format to save the session in when none is given: mp4 for h264 or aac
+// sessions, ogg for other audio-only sessions, and webm otherwise
+func DefaultSaveFormat(s *Session) string {
+	switch {
+	case s.Audio != nil && s.Audio.CodecName == "aac":
+		return "mp4"
+	case s.Video == nil:
+		return "ogg"
+	case s.Video.CodecName == "h264":
+		return "mp4"
+	default:
+		return "webm"
+	}
+}
+
+// Calls the SaveFramesTo function for the format, one of SaveFormats. Does not
+// close session but does close writer.
+func SaveFrames(ctx context.Context, format string, w io.WriteCloser, s *Session, frames FrameReader) error {
+	switch format {
+	case "webm":
+		return SaveFramesToWebM(ctx, w, s, frames)
+	case "mp4":
+		return SaveFramesToMP4(ctx, w, s, frames)
+	case "ivf":
+		return SaveFramesToIVF(ctx, w, s, frames)
+	case "ogg":
+		return SaveFramesToOgg(ctx, w, s, frames)
+	default:
+		w.Close()
+		return fmt.Errorf("unrecognized format %q", format)
+	}
+}
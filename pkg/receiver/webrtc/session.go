@@ -6,6 +6,12 @@ import (
 	"encoding/hex"
 	"fmt"
 	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/pion/rtcp"
 
 	"github.com/cretz/takecast/pkg/receiver"
 )
@@ -19,9 +25,34 @@ type Session struct {
 	Video     *receiver.WebRTCOfferStream
 	AES       cipher.Block
 	AESIVMask []byte
+	// Set by the application that started the session before handing it out,
+	// may be empty
+	AppID string
+	// Set by the application that started the session before handing it out,
+	// may be nil
+	ConnectionInfo *receiver.ConnectRequestMessage
+
+	remoteAddrLock sync.RWMutex
+	remoteAddr     net.Addr
+	// Non-zero while waiting on a requested key frame, accessed atomically
+	keyFrameRequested int32
+
+	lastKeyFrameLock sync.Mutex // Governs fields below
+	// Copy of the last video key frame seen by a FrameBuffer, for snapshots
+	lastKeyFrame []byte
+	// Last key frame size and parameter sets for resolution events
+	width, height int
+	h264          H264ParameterSets
+
+	eventsLock sync.Mutex // Governs fields below
+	events     []Event
+	stopped    bool
+	audioLoss  lossBurst
+	videoLoss  lossBurst
 }
 
-func StartSession(id string, offer *receiver.WebRTCOffer) (*Session, error) {
+// Picks the best audio and video streams within the constraints
+func StartSession(id string, offer *receiver.WebRTCOffer, constraints Constraints) (*Session, error) {
 	s := &Session{
 		ID:     id,
 		Offer:  offer,
@@ -29,10 +60,19 @@ func StartSession(id string, offer *receiver.WebRTCOffer) (*Session, error) {
 	}
 	success := false
 	defer func() {
-		if !success {
+		if !success && s.PacketConn != nil {
 			s.Close()
 		}
 	}()
+	if len(offer.SupportedStreams) == 0 {
+		return nil, fmt.Errorf("no streams offered")
+	}
+	// Check that all keys are the same
+	for _, stream := range offer.SupportedStreams {
+		if offer.SupportedStreams[0].AESKey != stream.AESKey || offer.SupportedStreams[0].AESIVMask != stream.AESIVMask {
+			return nil, fmt.Errorf("mismatched key/salt")
+		}
+	}
 	// Extract keys
 	if aesKey, err := hex.DecodeString(offer.SupportedStreams[0].AESKey); err != nil {
 		return nil, fmt.Errorf("bad key: %w", err)
@@ -41,29 +81,35 @@ func StartSession(id string, offer *receiver.WebRTCOffer) (*Session, error) {
 	} else if s.AESIVMask, err = hex.DecodeString(offer.SupportedStreams[0].AESIVMask); err != nil {
 		return nil, fmt.Errorf("bad iv: %w", err)
 	}
+	// Choose streams
+	audioIndex, videoIndex := constraints.selectStreams(offer)
+	if audioIndex == -1 && videoIndex == -1 {
+		return nil, fmt.Errorf("no supported streams offered")
+	}
 	// Listen UDP
 	var err error
 	if s.PacketConn, err = net.ListenUDP("udp", nil); err != nil {
 		return nil, err
 	}
 	s.Answer.UDPPort = s.LocalAddr().(*net.UDPAddr).Port
-	// Take first audio and video stream only
-	for i, stream := range offer.SupportedStreams {
-		// Check that all keys are the same
-		if offer.SupportedStreams[0].AESKey != stream.AESKey || offer.SupportedStreams[0].AESIVMask != stream.AESIVMask {
-			return nil, fmt.Errorf("mismatched key/salt")
+	// Set answer index and also set ssrc as one more than given
+	for _, i := range []int{audioIndex, videoIndex} {
+		if i == -1 {
+			continue
 		}
-		// Set answer index and also set ssrc as one more than given
-		if stream.Type == "audio_source" && s.Audio == nil {
+		stream := offer.SupportedStreams[i]
+		if stream.Type == "audio_source" {
 			s.Audio = stream
-		} else if stream.Type == "video_stream" && s.Video == nil {
-			s.Video = stream
 		} else {
-			continue
+			s.Video = stream
 		}
-		s.Answer.SendIndexes = append(s.Answer.SendIndexes, i)
+		s.Answer.SendIndexes = append(s.Answer.SendIndexes, stream.Index)
 		s.Answer.SSRCs = append(s.Answer.SSRCs, stream.SSRC+1)
 	}
+	// We don't send RTCP event logs or handle status requests, so those are left
+	// unset
+	constraints.applyToAnswer(s.Answer, s.Audio, s.Video)
+	s.AddEvent(Event{Type: EventStart})
 	success = true
 	return s, nil
 }
@@ -78,9 +124,90 @@ func (s *Session) Read(p *Packet) error {
 		p.scratch.Raw = p.scratch.Raw[:mtu]
 	}
 	// Read
-	n, _, err := s.ReadFrom(p.scratch.Raw)
+	n, addr, err := s.ReadFrom(p.scratch.Raw)
 	if err != nil {
 		return err
 	}
+	// Keep the last sender address for RTCP
+	s.remoteAddrLock.Lock()
+	s.remoteAddr = addr
+	s.remoteAddrLock.Unlock()
 	return p.Unmarshal(p.scratch.Raw[:n])
 }
+
+// Address of the last received packet, or nil if none received yet
+func (s *Session) RemoteAddr() net.Addr {
+	s.remoteAddrLock.RLock()
+	defer s.remoteAddrLock.RUnlock()
+	return s.remoteAddr
+}
+
+// Sends the packets as a single compound packet to the remote address. Fails if
+// no packets have been received yet. Safe to call concurrently with Read.
+func (s *Session) WriteRTCP(pkts ...rtcp.Packet) error {
+	addr := s.RemoteAddr()
+	if addr == nil {
+		return fmt.Errorf("no remote address yet")
+	}
+	b, err := rtcp.Marshal(pkts)
+	if err != nil {
+		return fmt.Errorf("failed marshaling RTCP: %w", err)
+	}
+	_, err = s.WriteTo(b, addr)
+	return err
+}
+
+// Creates a new framer for this session's streams
+func (s *Session) NewFramer() *Framer {
+	f := &Framer{AES: s.AES, AESIVMask: s.AESIVMask}
+	if s.Audio != nil {
+		f.AudioSSRC = s.Audio.SSRC
+		f.AudioClockRate = parseTimeBase(s.Audio.TimeBase)
+		f.AudioCodec = s.Audio.CodecName
+	}
+	if s.Video != nil {
+		f.VideoClockRate = parseTimeBase(s.Video.TimeBase)
+		f.VideoCodec = s.Video.CodecName
+	}
+	return f
+}
+
+// Parses "1/N" and returns N, or 0 if unable to parse
+func parseTimeBase(timeBase string) int {
+	if !strings.HasPrefix(timeBase, "1/") {
+		return 0
+	}
+	n, _ := strconv.Atoi(timeBase[2:])
+	return n
+}
+
+// Asks the sender for a video key frame right away. If a FrameBuffer is reading
+// this session, it repeats the request with its feedback until a key frame
+// arrives. Does nothing if there is no video stream. Safe to call concurrently.
+func (s *Session) RequestKeyFrame() error {
+	if s.Video == nil {
+		return nil
+	}
+	s.requestKeyFrame()
+	// If we haven't heard from the sender, the buffer will send it later
+	if s.RemoteAddr() == nil {
+		return nil
+	}
+	return s.WriteRTCP(&rtcp.PictureLossIndication{SenderSSRC: s.Video.SSRC + 1, MediaSSRC: s.Video.SSRC})
+}
+
+func (s *Session) keyFrameWanted() bool { return atomic.LoadInt32(&s.keyFrameRequested) != 0 }
+
+func (s *Session) requestKeyFrame() {
+	if atomic.CompareAndSwapInt32(&s.keyFrameRequested, 0, 1) {
+		s.AddEvent(Event{Type: EventKeyFrameRequest})
+	}
+}
+
+func (s *Session) keyFrameReceived(data []byte) {
+	atomic.StoreInt32(&s.keyFrameRequested, 0)
+	s.lastKeyFrameLock.Lock()
+	defer s.lastKeyFrameLock.Unlock()
+	s.lastKeyFrame = append([]byte(nil), data...)
+	s.observeKeyFrameSizeUnlocked(data)
+}
@@ -0,0 +1,107 @@
+package webrtc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"time"
+)
+
+// Formats supported by EncodeImage
+var ImageFormats = []string{"png", "jpeg"}
+
+// Returned by Session.Snapshot before any video key frame is received
+var ErrNoKeyFrame = errors.New("no key frame received")
+
+// Snapshot decodes the last video key frame received by a FrameBuffer reading
+// this session. Only VP8 video is supported. RequestKeyFrame can be used to get
+// a fresher one. Safe to call concurrently.
+func (s *Session) Snapshot() (image.Image, error) {
+	if s.Video == nil {
+		return nil, fmt.Errorf("no video stream")
+	}
+	// The slice is replaced, never mutated, so it can be decoded unlocked
+	s.lastKeyFrameLock.Lock()
+	data := s.lastKeyFrame
+	s.lastKeyFrameLock.Unlock()
+	if data == nil {
+		return nil, ErrNoKeyFrame
+	}
+	return DecodeKeyFrame(s.Video.CodecName, data)
+}
+
+// Decodes a video key frame of the given codec. Only VP8 is supported.
+func DecodeKeyFrame(codecName string, data []byte) (image.Image, error) {
+	if codecName != "vp8" {
+		return nil, fmt.Errorf("cannot decode %v frames", codecName)
+	}
+	return DecodeVP8KeyFrame(data)
+}
+
+// Encodes the image as one of ImageFormats
+func EncodeImage(w io.Writer, img image.Image, format string) error {
+	switch format {
+	case "png":
+		return png.Encode(w, img)
+	case "jpeg":
+		return jpeg.Encode(w, img, &jpeg.Options{Quality: 90})
+	default:
+		return fmt.Errorf("unrecognized image format %q", format)
+	}
+}
+
+type SnapshotConfig struct {
+	// Minimum frame time between snapshots. Once elapsed, a key frame is
+	// requested for the next one. If 0, every key frame is a snapshot and none
+	// are requested.
+	Interval time.Duration
+	// Called with each decoded key frame and its frame timestamp. Returning an
+	// error stops the snapshots. Required.
+	OnSnapshot func(img image.Image, timestamp time.Duration) error
+}
+
+// SaveSnapshots decodes video key frames from the reader as configured. Only
+// VP8 video is supported. Returns when the reader fails, e.g. with EOF on
+// session end, or the context is done. Does not close the reader.
+func SaveSnapshots(ctx context.Context, s *Session, frames FrameReader, config SnapshotConfig) error {
+	if s.Video == nil {
+		return fmt.Errorf("no video stream")
+	} else if s.Video.CodecName != "vp8" {
+		return fmt.Errorf("cannot decode %v frames", s.Video.CodecName)
+	}
+	var f Frame
+	var last time.Duration
+	taken := false
+	for {
+		if err := ctx.Err(); err != nil {
+			return err
+		} else if err := frames.Read(&f); err != nil {
+			return err
+		} else if f.Audio || (taken && f.Timestamp-last < config.Interval) {
+			continue
+		} else if !f.KeyFrame {
+			// Only ask for one when the interval has elapsed, otherwise wait for the
+			// next natural one
+			if config.Interval > 0 {
+				s.requestKeyFrame()
+			}
+			continue
+		}
+		img, err := DecodeVP8KeyFrame(f.Data)
+		if err != nil {
+			// Try again with the next one
+			if config.Interval > 0 {
+				s.requestKeyFrame()
+			}
+			continue
+		}
+		last, taken = f.Timestamp, true
+		if err := config.OnSnapshot(img, f.Timestamp); err != nil {
+			return err
+		}
+	}
+}
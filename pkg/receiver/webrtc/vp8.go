@@ -0,0 +1,41 @@
+package webrtc
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+
+	"golang.org/x/image/vp8"
+)
+
+// Whether the VP8 frame tag says key frame
+func IsVP8KeyFrame(b []byte) bool { return len(b) > 0 && b[0]&0x01 == 0 }
+
+// Parses the picture size from a VP8 key frame header (RFC 6386 section 9.1).
+// Returns false if not a key frame or invalid.
+func ParseVP8KeyFrameSize(b []byte) (width, height int, ok bool) {
+	if len(b) < 10 || !IsVP8KeyFrame(b) || b[3] != 0x9d || b[4] != 0x01 || b[5] != 0x2a {
+		return 0, 0, false
+	}
+	// Upper 2 bits of each are scaling which we ignore
+	width = int(b[6]) | int(b[7]&0x3f)<<8
+	height = int(b[8]) | int(b[9]&0x3f)<<8
+	return width, height, width > 0 && height > 0
+}
+
+// Decodes a VP8 key frame into an image. Inter frames cannot be decoded on
+// their own.
+func DecodeVP8KeyFrame(b []byte) (*image.YCbCr, error) {
+	d := vp8.NewDecoder()
+	d.Init(bytes.NewReader(b), len(b))
+	if header, err := d.DecodeFrameHeader(); err != nil {
+		return nil, fmt.Errorf("invalid frame header: %w", err)
+	} else if !header.KeyFrame {
+		return nil, fmt.Errorf("not a key frame")
+	}
+	img, err := d.DecodeFrame()
+	if err != nil {
+		return nil, fmt.Errorf("failed decoding frame: %w", err)
+	}
+	return img, nil
+}
@@ -0,0 +1,67 @@
+package webrtc
+
+// Fields from a VP9 key frame's uncompressed header
+type VP9KeyFrameInfo struct {
+	Profile  int
+	BitDepth int
+	Width    int
+	Height   int
+}
+
+// Whether the first frame in the (possibly super) frame is a key frame
+func IsVP9KeyFrame(b []byte) bool {
+	_, ok := ParseVP9KeyFrame(b)
+	return ok
+}
+
+// Parses the uncompressed header of the first frame. Returns false if it is
+// not a key frame or cannot be parsed.
+func ParseVP9KeyFrame(b []byte) (info VP9KeyFrameInfo, ok bool) {
+	r := &bitReader{b: b}
+	if r.bits(2) != 2 {
+		return info, false
+	}
+	info.Profile = int(r.bits(1) | r.bits(1)<<1)
+	if info.Profile == 3 {
+		r.skip(1)
+	}
+	// Show existing frame, then frame type of 0 for key frames
+	if r.bit() || r.bit() {
+		return info, false
+	}
+	r.skip(2) // Show frame and error resilient
+	if r.bits(24) != 0x498342 {
+		return info, false
+	}
+	// Color config
+	info.BitDepth = 8
+	if info.Profile >= 2 {
+		if info.BitDepth = 10; r.bit() {
+			info.BitDepth = 12
+		}
+	}
+	const csRGB = 7
+	if r.bits(3) != csRGB {
+		r.skip(1) // Color range
+		if info.Profile == 1 || info.Profile == 3 {
+			r.skip(3) // Subsampling and reserved
+		}
+	} else if info.Profile == 1 || info.Profile == 3 {
+		r.skip(1)
+	}
+	info.Width = int(r.bits(16)) + 1
+	info.Height = int(r.bits(16)) + 1
+	return info, r.err == nil
+}
+
+// Matroska VP9 codec private with profile and bit depth
+func vp9CodecPrivate(info VP9KeyFrameInfo) []byte {
+	const (
+		vp9FeatureProfile  = 1
+		vp9FeatureBitDepth = 3
+	)
+	return []byte{
+		vp9FeatureProfile, 1, byte(info.Profile),
+		vp9FeatureBitDepth, 1, byte(info.BitDepth),
+	}
+}
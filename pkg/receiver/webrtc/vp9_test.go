@@ -0,0 +1,55 @@
+package webrtc
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestParseVP9KeyFrame(t *testing.T) {
+	tests := []struct {
+		name string
+		b    []byte
+		info VP9KeyFrameInfo
+		ok   bool
+	}{
+		{
+			// Color space BT.601, studio range
+			name: "profile 0",
+			b:    []byte{0x82, 0x49, 0x83, 0x42, 0x20, 0x15, 0xf0, 0x11, 0xf0},
+			info: VP9KeyFrameInfo{Profile: 0, BitDepth: 8, Width: 352, Height: 288},
+			ok:   true,
+		},
+		{
+			// Color space BT.709, studio range
+			name: "profile 2 12-bit",
+			b:    []byte{0x92, 0x49, 0x83, 0x42, 0xa0, 0x27, 0xf8, 0x16, 0x78},
+			info: VP9KeyFrameInfo{Profile: 2, BitDepth: 12, Width: 1280, Height: 720},
+			ok:   true,
+		},
+		// Frame type of 1
+		{name: "inter frame", b: []byte{0x86, 0x00, 0x00}},
+		{name: "show existing", b: []byte{0x88}},
+		{name: "bad frame marker", b: []byte{0x42, 0x49, 0x83, 0x42, 0x20, 0x15, 0xf0, 0x11, 0xf0}},
+		{name: "bad sync code", b: []byte{0x82, 0x49, 0x83, 0x43, 0x20, 0x15, 0xf0, 0x11, 0xf0}},
+		{name: "truncated", b: []byte{0x82, 0x49, 0x83, 0x42, 0x20, 0x15}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			info, ok := ParseVP9KeyFrame(test.b)
+			if ok != test.ok {
+				t.Fatalf("expected ok %v, got %v", test.ok, ok)
+			} else if ok && info != test.info {
+				t.Fatalf("expected %+v, got %+v", test.info, info)
+			} else if IsVP9KeyFrame(test.b) != test.ok {
+				t.Fatalf("expected key frame %v", test.ok)
+			}
+		})
+	}
+}
+
+func TestVP9CodecPrivate(t *testing.T) {
+	b := vp9CodecPrivate(VP9KeyFrameInfo{Profile: 2, BitDepth: 10})
+	if expected := []byte{1, 1, 2, 3, 1, 10}; !bytes.Equal(b, expected) {
+		t.Fatalf("expected %x, got %x", expected, b)
+	}
+}
@@ -1,23 +1,577 @@
 package webrtc
 
 import (
+	"bytes"
 	"context"
+	"encoding/binary"
 	"fmt"
 	"io"
+	"math"
+	"sync"
 	"time"
 
+	"github.com/at-wat/ebml-go"
 	"github.com/at-wat/ebml-go/webm"
 )
 
+const (
+	// Used when WebMWriter.MaxClusterDuration is 0
+	DefaultMaxClusterDuration = 5 * time.Second
+
+	ebmlIDSegment     = 0x18538067
+	ebmlIDSeekHead    = 0x114D9B74
+	ebmlIDSeek        = 0x4DBB
+	ebmlIDSeekID      = 0x53AB
+	ebmlIDSeekPos     = 0x53AC
+	ebmlIDInfo        = 0x1549A966
+	ebmlIDTimecode    = 0x2AD7B1
+	ebmlIDMuxingApp   = 0x4D80
+	ebmlIDWritingApp  = 0x5741
+	ebmlIDDuration    = 0x4489
+	ebmlIDTracks      = 0x1654AE6B
+	ebmlIDCluster     = 0x1F43B675
+	ebmlIDClusterTime = 0xE7
+	ebmlIDSimpleBlock = 0xA3
+	ebmlIDCues        = 0x1C53BB6B
+	ebmlIDVoid        = 0xEC
+
+	// Space reserved after the segment header for the SeekHead written on close
+	webmSeekHeadReserve = 96
+	// Space reserved after Tracks so it can be rewritten with new dimensions
+	webmTracksReserve = 64
+)
+
+// A video resolution seen in the stream, starting at the timestamp
+type WebMResolutionChange struct {
+	Timestamp time.Duration
+	Width     int
+	Height    int
+}
+
+// Writes tracks as WebM with clusters started at video key frames. If the
+// writer is an io.WriteSeeker that can seek, a SeekHead, Cues, the final
+// duration, and updated video dimensions are written on Close. Otherwise the
+// output is live: the segment and clusters have unknown size, each frame is
+// written with a single Write call, and every key frame of the video track (or
+// the audio track if there is no video) starts a new cluster so readers can
+// join at any of them. Not safe for concurrent use.
+type WebMWriter struct {
+	// Max length of a cluster when no video key frame starts a new one. If 0,
+	// uses DefaultMaxClusterDuration.
+	MaxClusterDuration time.Duration
+
+	w       io.Writer
+	seeker  io.WriteSeeker
+	tracks  []webm.TrackEntry
+	offset  int64
+	closed  bool
+	lastErr error
+	// Where segment data starts and where the values patched on close are
+	segmentStart   int64
+	seekHeadOffset int64
+	infoOffset     int64
+	durationOffset int64
+	tracksOffset   int64
+	tracksSize     int
+	tracksChanged  bool
+	// Current cluster data and its timecode in ms
+	cluster      []byte
+	clusterTime  int64
+	clusterCue   bool
+	hasCluster   bool
+	cues         webm.Cues
+	maxTimestamp int64
+	resolutions  map[int][]WebMResolutionChange
+}
+
+// Writes the header immediately. Tracks are referenced by their index in the
+// slice in other calls.
+func NewWebMWriter(w io.Writer, tracks []webm.TrackEntry) (*WebMWriter, error) {
+	m := &WebMWriter{
+		w:           w,
+		tracks:      append([]webm.TrackEntry(nil), tracks...),
+		resolutions: map[int][]WebMResolutionChange{},
+	}
+	// Only treat as seekable if seeking actually works (e.g. not a pipe)
+	if seeker, ok := w.(io.WriteSeeker); ok {
+		if offset, err := seeker.Seek(0, io.SeekCurrent); err == nil {
+			m.seeker, m.offset = seeker, offset
+		}
+	}
+	for i, track := range m.tracks {
+		if track.Video != nil {
+			m.resolutions[i] = []WebMResolutionChange{{Width: int(track.Video.PixelWidth), Height: int(track.Video.PixelHeight)}}
+		}
+	}
+	var buf bytes.Buffer
+	if err := ebml.Marshal(&struct {
+		Header *webm.EBMLHeader `ebml:"EBML"`
+	}{webm.DefaultEBMLHeader}, &buf); err != nil {
+		return nil, fmt.Errorf("failed marshaling EBML header: %w", err)
+	}
+	buf.Write(ebmlID(ebmlIDSegment))
+	if m.seeker != nil {
+		// Patched on close
+		buf.Write(ebmlFixedSize(0))
+	} else {
+		buf.Write(ebmlUnknownSize)
+	}
+	m.segmentStart = m.offset + int64(buf.Len())
+	if m.seeker != nil {
+		m.seekHeadOffset = m.segmentStart
+		buf.Write(ebmlVoid(webmSeekHeadReserve))
+	}
+	// Info with a duration placeholder at the end if seekable
+	m.infoOffset = m.offset + int64(buf.Len())
+	info := [][]byte{
+		ebmlUint(ebmlIDTimecode, uint64(time.Millisecond)),
+		ebmlElement(ebmlIDMuxingApp, []byte("takecast")),
+		ebmlElement(ebmlIDWritingApp, []byte("takecast")),
+	}
+	if m.seeker != nil {
+		info = append(info, ebmlFloat(ebmlIDDuration, 0))
+	}
+	infoBytes := ebmlElement(ebmlIDInfo, info...)
+	m.durationOffset = m.infoOffset + int64(len(infoBytes)) - 8
+	buf.Write(infoBytes)
+	// Tracks with room to grow
+	tracksBytes, err := m.marshalTracks()
+	if err != nil {
+		return nil, err
+	}
+	m.tracksOffset, m.tracksSize = m.offset+int64(buf.Len()), len(tracksBytes)
+	buf.Write(tracksBytes)
+	if m.seeker != nil {
+		buf.Write(ebmlVoid(webmTracksReserve))
+	}
+	if err := m.write(buf.Bytes()); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (m *WebMWriter) marshalTracks() ([]byte, error) {
+	var buf bytes.Buffer
+	err := ebml.Marshal(&struct {
+		Tracks webm.Tracks `ebml:"Tracks"`
+	}{webm.Tracks{TrackEntry: m.tracks}}, &buf)
+	if err != nil {
+		return nil, fmt.Errorf("failed marshaling tracks: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+func (m *WebMWriter) write(b []byte) error {
+	if m.lastErr != nil {
+		return m.lastErr
+	}
+	n, err := m.w.Write(b)
+	m.offset += int64(n)
+	m.lastErr = err
+	return err
+}
+
+// Writes a frame to the track at the index. Timestamps must not go backwards
+// on a track.
+func (m *WebMWriter) Write(track int, keyFrame bool, timestamp time.Duration, data []byte) error {
+	if m.closed {
+		return fmt.Errorf("writer closed")
+	} else if track < 0 || track >= len(m.tracks) {
+		return fmt.Errorf("unknown track %v", track)
+	}
+	ms := int64(timestamp / time.Millisecond)
+	mainTrack := m.videoTrack()
+	if mainTrack == -1 {
+		mainTrack = 0
+	}
+	mainKey := keyFrame && track == mainTrack
+	maxDur := m.MaxClusterDuration
+	if maxDur <= 0 {
+		maxDur = DefaultMaxClusterDuration
+	}
+	// Start a new cluster on video key frames (or any main track key frame if
+	// live), when too long, or if the block offset won't fit in 16 bits
+	var b []byte
+	offset := ms - m.clusterTime
+	if !m.hasCluster || (mainKey && (m.tracks[track].Video != nil || m.seeker == nil)) ||
+		offset >= int64(maxDur/time.Millisecond) || offset > math.MaxInt16 || offset < math.MinInt16 {
+		if err := m.Flush(); err != nil {
+			return err
+		}
+		m.hasCluster, m.clusterTime, offset = true, ms, 0
+		// Cue on video key frames, or any cluster if there is no video
+		m.clusterCue = mainKey || m.videoTrack() == -1
+		m.cluster = append(m.cluster[:0], ebmlUint(ebmlIDClusterTime, uint64(ms))...)
+		if m.seeker == nil {
+			b = append(append(ebmlID(ebmlIDCluster), ebmlUnknownSize...), m.cluster...)
+		}
+	}
+	// Simple block is track number, relative timecode, flags, then data
+	header := ebmlSize(int(m.tracks[track].TrackNumber))
+	header = append(header, byte(uint16(offset)>>8), byte(offset), 0)
+	if keyFrame {
+		header[len(header)-1] |= 0x80
+	}
+	block := append(ebmlID(ebmlIDSimpleBlock), ebmlSize(len(header)+len(data))...)
+	block = append(block, header...)
+	if end := ms + int64(m.tracks[track].DefaultDuration)/int64(time.Millisecond); end > m.maxTimestamp {
+		m.maxTimestamp = end
+	}
+	// Live writes right away, otherwise the cluster is buffered until flush
+	if m.seeker == nil {
+		b = append(append(b, block...), data...)
+		return m.write(b)
+	}
+	m.cluster = append(append(m.cluster, block...), data...)
+	return nil
+}
+
+// Index of the first video track or -1
+func (m *WebMWriter) videoTrack() int {
+	for i, track := range m.tracks {
+		if track.Video != nil {
+			return i
+		}
+	}
+	return -1
+}
+
+// Records the resolution of the video track at the index if it changed. If
+// seekable, the header dimensions are updated on close to the largest seen.
+func (m *WebMWriter) SetVideoSize(track int, timestamp time.Duration, width, height int) {
+	changes := m.resolutions[track]
+	if len(changes) == 0 {
+		return
+	} else if last := changes[len(changes)-1]; last.Width == width && last.Height == height {
+		return
+	}
+	m.resolutions[track] = append(changes, WebMResolutionChange{Timestamp: timestamp, Width: width, Height: height})
+	if video := m.tracks[track].Video; uint64(width*height) > video.PixelWidth*video.PixelHeight {
+		m.tracks[track].Video = &webm.Video{PixelWidth: uint64(width), PixelHeight: uint64(height)}
+		m.tracksChanged = true
+	}
+}
+
+// All resolutions of the video track at the index, starting with the one given
+// in the constructor
+func (m *WebMWriter) Resolutions(track int) []WebMResolutionChange {
+	return append([]WebMResolutionChange(nil), m.resolutions[track]...)
+}
+
+// Writes the current cluster. Does nothing if live since frames are already
+// written.
+func (m *WebMWriter) Flush() error {
+	if !m.hasCluster || m.seeker == nil {
+		return nil
+	}
+	m.hasCluster = false
+	if m.clusterCue {
+		cueTrack := m.videoTrack()
+		if cueTrack == -1 {
+			cueTrack = 0
+		}
+		m.cues.CuePoint = append(m.cues.CuePoint, webm.CuePoint{
+			CueTime: uint64(m.clusterTime),
+			CueTrackPositions: []webm.CueTrackPosition{{
+				CueTrack:           m.tracks[cueTrack].TrackNumber,
+				CueClusterPosition: uint64(m.offset - m.segmentStart),
+			}},
+		})
+	}
+	return m.write(ebmlElement(ebmlIDCluster, m.cluster))
+}
+
+// Writes the last cluster and, if seekable, the cues and final header values.
+// Does not close the underlying writer.
+func (m *WebMWriter) Close() error {
+	if m.closed {
+		return nil
+	}
+	m.closed = true
+	if err := m.Flush(); err != nil || m.seeker == nil {
+		return err
+	}
+	// Cues at the end
+	cuesOffset := m.offset
+	if len(m.cues.CuePoint) > 0 {
+		var buf bytes.Buffer
+		if err := ebml.Marshal(&struct {
+			Cues webm.Cues `ebml:"Cues"`
+		}{m.cues}, &buf); err != nil {
+			return fmt.Errorf("failed marshaling cues: %w", err)
+		} else if err = m.write(buf.Bytes()); err != nil {
+			return err
+		}
+	}
+	end := m.offset
+	// Seek head in the reserved space
+	seeks := [][]byte{m.seekEntry(ebmlIDInfo, m.infoOffset), m.seekEntry(ebmlIDTracks, m.tracksOffset)}
+	if len(m.cues.CuePoint) > 0 {
+		seeks = append(seeks, m.seekEntry(ebmlIDCues, cuesOffset))
+	}
+	seekHead := ebmlElement(ebmlIDSeekHead, seeks...)
+	seekHead = append(seekHead, ebmlVoid(webmSeekHeadReserve-len(seekHead))...)
+	if err := m.writeAt(m.seekHeadOffset, seekHead); err != nil {
+		return err
+	}
+	// Duration and segment size
+	var duration [8]byte
+	binary.BigEndian.PutUint64(duration[:], math.Float64bits(float64(m.maxTimestamp)))
+	if err := m.writeAt(m.durationOffset, duration[:]); err != nil {
+		return err
+	} else if err = m.writeAt(m.segmentStart-8, ebmlFixedSize(int(end-m.segmentStart))); err != nil {
+		return err
+	}
+	// Rewrite tracks if dimensions changed and it still fits (a void needs at
+	// least 2 bytes)
+	if m.tracksChanged {
+		tracksBytes, err := m.marshalTracks()
+		if err != nil {
+			return err
+		}
+		if avail := m.tracksSize + webmTracksReserve; len(tracksBytes) == avail || len(tracksBytes)+2 <= avail {
+			if len(tracksBytes) < avail {
+				tracksBytes = append(tracksBytes, ebmlVoid(avail-len(tracksBytes))...)
+			}
+			if err := m.writeAt(m.tracksOffset, tracksBytes); err != nil {
+				return err
+			}
+		}
+	}
+	_, err := m.seeker.Seek(end, io.SeekStart)
+	return err
+}
+
+func (m *WebMWriter) seekEntry(id uint32, offset int64) []byte {
+	return ebmlElement(ebmlIDSeek,
+		ebmlElement(ebmlIDSeekID, ebmlID(id)),
+		ebmlElement(ebmlIDSeekPos, ebmlFixedUint(uint64(offset-m.segmentStart))),
+	)
+}
+
+func (m *WebMWriter) writeAt(offset int64, b []byte) error {
+	if _, err := m.seeker.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	_, err := m.seeker.Write(b)
+	return err
+}
+
+// Element IDs include their length marker so just strip leading zeros
+func ebmlID(id uint32) []byte {
+	b := ebmlFixedUint(uint64(id))[4:]
+	for len(b) > 1 && b[0] == 0 {
+		b = b[1:]
+	}
+	return b
+}
+
+var ebmlUnknownSize = []byte{0x01, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}
+
+// Shortest variable length size. All ones is reserved for unknown.
+func ebmlSize(n int) []byte {
+	for length := 1; length < 8; length++ {
+		if uint64(n) < 1<<(7*length)-1 {
+			b := ebmlFixedUint(uint64(n))[8-length:]
+			b[0] |= 0x80 >> (length - 1)
+			return b
+		}
+	}
+	return ebmlFixedSize(n)
+}
+
+// Always 8 bytes so it can be patched
+func ebmlFixedSize(n int) []byte {
+	b := ebmlFixedUint(uint64(n))
+	b[0] = 0x01
+	return b
+}
+
+func ebmlElement(id uint32, payload ...[]byte) []byte {
+	size := 0
+	for _, p := range payload {
+		size += len(p)
+	}
+	b := append(ebmlID(id), ebmlSize(size)...)
+	for _, p := range payload {
+		b = append(b, p...)
+	}
+	return b
+}
+
+func ebmlUint(id uint32, v uint64) []byte {
+	b := ebmlFixedUint(v)
+	for len(b) > 1 && b[0] == 0 {
+		b = b[1:]
+	}
+	return ebmlElement(id, b)
+}
+
+func ebmlFixedUint(v uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, v)
+	return b
+}
+
+func ebmlFloat(id uint32, v float64) []byte {
+	return ebmlElement(id, ebmlFixedUint(math.Float64bits(v)))
+}
+
+// Void element taking exactly n bytes, n must be at least 2
+func ebmlVoid(n int) []byte {
+	if n-2 < 127 {
+		return append([]byte{ebmlIDVoid, byte(0x80 | (n - 2))}, make([]byte, n-2)...)
+	}
+	return append(append([]byte{ebmlIDVoid}, ebmlFixedSize(n-9)...), make([]byte, n-9)...)
+}
+
 // Does not close session but does close writer. Always returns error, may be
-// EOF on session end.
+// EOF on session end. If the writer is seekable, the file is finalized with
+// cues and duration.
 func SaveSessionToWebM(ctx context.Context, w io.WriteCloser, s *Session) error {
+	return SaveFramesToWebM(ctx, w, s, NewFrameBuffer(s, FrameBufferConfig{}))
+}
+
+// Same as SaveSessionToWebM but reads the session frames from the given reader,
+// e.g. a Subscriber.
+func SaveFramesToWebM(ctx context.Context, w io.WriteCloser, s *Session, frames FrameReader) error {
 	defer w.Close()
-	// Create webm tracks
+	muxer, err := NewWebMSessionMuxer(w, s)
+	if err != nil {
+		return err
+	}
+	// Run in the background so context can close this. The lock lets us
+	// finalize while the pipe may still be running.
+	var lock sync.Mutex
+	errCh := make(chan error, 1)
+	go func() { errCh <- pipeWebM(muxer, &lock, s, frames) }()
+	// Finish when context is done or error
+	select {
+	case <-ctx.Done():
+		err = ctx.Err()
+	case err = <-errCh:
+	}
+	// The pipe will fail on its next write if still running
+	lock.Lock()
+	defer lock.Unlock()
+	// Ignore error
+	muxer.Close()
+	return err
+}
+
+// Doesn't close anything
+func pipeWebM(muxer *WebMSessionMuxer, lock *sync.Mutex, s *Session, frames FrameReader) error {
+	var f Frame
+	for {
+		if err := frames.Read(&f); err != nil {
+			return err
+		}
+		lock.Lock()
+		_, err := muxer.WriteFrame(&f)
+		lock.Unlock()
+		if err != nil {
+			return fmt.Errorf("failed writing frame: %w", err)
+		}
+	}
+}
+
+// Writes session frames as WebM. The WebMWriter is created on the first video
+// key frame (or first frame if audio only) and earlier frames are dropped.
+// Timestamps start at 0 from that frame. Not safe for concurrent use.
+type WebMSessionMuxer struct {
+	// Nil until the first usable frame
+	Writer *WebMWriter
+	// Used when creating the writer
+	MaxClusterDuration time.Duration
+
+	w       io.Writer
+	session *Session
+	tracks  []webm.TrackEntry
+	closed  bool
+	start   time.Duration
+	// Last written timestamps to keep them from going backwards when streams
+	// are re-synced
+	lastTimestamps []time.Duration
+}
+
+func NewWebMSessionMuxer(w io.Writer, s *Session) (*WebMSessionMuxer, error) {
+	tracks, err := WebMTracks(s)
+	if err != nil {
+		return nil, err
+	}
+	return &WebMSessionMuxer{w: w, session: s, tracks: tracks, lastTimestamps: make([]time.Duration, len(tracks))}, nil
+}
+
+// Returns false if the frame was dropped because the writer is not started yet
+// or it is from before the start. Asks the sender for a key frame if waiting on
+// one.
+func (m *WebMSessionMuxer) WriteFrame(f *Frame) (bool, error) {
+	if m.closed {
+		return false, fmt.Errorf("muxer closed")
+	}
+	track, data := 0, f.Data
+	if !f.Audio {
+		track = len(m.tracks) - 1
+		if m.session.Video.CodecName == "av1" {
+			data = stripAV1TemporalDelimiters(data)
+		}
+	}
+	// Create the writer on the first usable frame
+	if m.Writer == nil {
+		if m.session.Video != nil {
+			if f.Audio {
+				return false, nil
+			} else if !f.KeyFrame || !applyWebMKeyFrame(&m.tracks[track], m.session.Video.CodecName, data) {
+				m.session.requestKeyFrame()
+				return false, nil
+			}
+		}
+		writer, err := NewWebMWriter(m.w, m.tracks)
+		if err != nil {
+			return false, err
+		}
+		writer.MaxClusterDuration = m.MaxClusterDuration
+		m.Writer, m.start = writer, f.Timestamp
+	}
+	// Drop audio from before the start
+	if f.Timestamp < m.start {
+		return false, nil
+	}
+	timestamp := f.Timestamp - m.start
+	if timestamp < m.lastTimestamps[track] {
+		timestamp = m.lastTimestamps[track]
+	}
+	m.lastTimestamps[track] = timestamp
+	if !f.Audio && f.KeyFrame {
+		if width, height, ok := webmKeyFrameSize(m.session.Video.CodecName, data); ok {
+			m.Writer.SetVideoSize(track, timestamp, width, height)
+		}
+	}
+	if err := m.Writer.Write(track, f.KeyFrame, timestamp, data); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Closes the writer if created. Does not close the underlying writer.
+func (m *WebMSessionMuxer) Close() error {
+	if m.closed {
+		return nil
+	}
+	m.closed = true
+	if m.Writer == nil {
+		return nil
+	}
+	return m.Writer.Close()
+}
+
+// Creates the WebM tracks for the session. Video dimensions are left empty to
+// be set from the first key frame.
+func WebMTracks(s *Session) ([]webm.TrackEntry, error) {
 	tracks := make([]webm.TrackEntry, 0, 2)
 	if s.Audio != nil {
 		if s.Audio.CodecName != "opus" {
-			return fmt.Errorf("expected opus audio codec, got %v", s.Audio.CodecName)
+			return nil, fmt.Errorf("expected opus audio codec, got %v", s.Audio.CodecName)
 		}
 		track := webm.TrackEntry{
 			Name:            s.Audio.Type,
@@ -37,81 +591,62 @@ func SaveSessionToWebM(ctx context.Context, w io.WriteCloser, s *Session) error
 		tracks = append(tracks, track)
 	}
 	if s.Video != nil {
-		if s.Audio.CodecName != "vp8" {
-			return fmt.Errorf("expected vp8 audio codec, got %v", s.Video.CodecName)
+		codecID := webmVideoCodecIDs[s.Video.CodecName]
+		if codecID == "" {
+			return nil, fmt.Errorf("expected vp8, vp9, or av1 video codec, got %v", s.Video.CodecName)
 		}
-		track := webm.TrackEntry{
+		tracks = append(tracks, webm.TrackEntry{
 			Name:            s.Video.Type,
 			TrackNumber:     uint64(len(tracks) + 1),
 			TrackUID:        uint64(s.Video.SSRC),
-			CodecID:         "A_VP8",
+			CodecID:         codecID,
 			TrackType:       1,
 			DefaultDuration: 33333333,
-			// TODO: Should I wait for first video frame to set dims?
-			Video: &webm.Video{PixelHeight: 240, PixelWidth: 320},
-		}
-		// Use first resolution
-		if len(s.Video.Resolutions) > 0 {
-			track.Video.PixelHeight = uint64(s.Video.Resolutions[0].Height)
-			track.Video.PixelWidth = uint64(s.Video.Resolutions[0].Width)
-		}
-		tracks = append(tracks, track)
+			Video:           &webm.Video{},
+		})
 	}
-	// Create writers
-	blockWriters, err := webm.NewSimpleBlockWriter(w, tracks)
-	if err != nil {
-		return err
-	}
-	defer func() {
-		for _, blockWriter := range blockWriters {
-			// Ignore error
-			blockWriter.Close()
+	return tracks, nil
+}
+
+var webmVideoCodecIDs = map[string]string{
+	"vp8": "V_VP8",
+	"vp9": "V_VP9",
+	"av1": "V_AV1",
+}
+
+// Gets the picture size from a key frame, false if the frame cannot be used
+func webmKeyFrameSize(codec string, data []byte) (width, height int, ok bool) {
+	switch codec {
+	case "vp8":
+		return ParseVP8KeyFrameSize(data)
+	case "vp9":
+		info, ok := ParseVP9KeyFrame(data)
+		return info.Width, info.Height, ok
+	case "av1":
+		seq, err := FindAV1SequenceHeader(data)
+		if err != nil || seq == nil {
+			return 0, 0, false
 		}
-	}()
-	// Run in the background so context can close this
-	errCh := make(chan error, 1)
-	go func() { errCh <- pipeWebM(blockWriters, s) }()
-	// Finish when context is done or error
-	select {
-	case <-ctx.Done():
-		return ctx.Err()
-	case err := <-errCh:
-		return err
+		return seq.MaxWidth, seq.MaxHeight, true
 	}
+	return 0, 0, false
 }
 
-// Doesn't close anything
-func pipeWebM(w []webm.BlockWriteCloser, s *Session) error {
-	// Create the framer
-	framer := &Framer{AES: s.AES, AESIVMask: s.AESIVMask}
-	// Keep reading/writing until error
-	var p Packet
-	var f Frame
-	var audioTimestamp, videoTimestamp time.Duration
-	for {
-		// Get RTP packet, write to framer, try to read frame
-		if err := s.Read(&p); err != nil {
-			return err
-		} else if p.RTP == nil {
-			continue
-		} else if err := framer.Write(p.RTP); err != nil {
-			return err
-		} else if ok, err := framer.Read(&f); err != nil {
-			return err
-		} else if !ok {
-			continue
-		}
-		// Write to block writers
-		if f.Audio {
-			audioTimestamp += f.Duration
-			if _, err := w[0].Write(true, int64(audioTimestamp/time.Millisecond), f.Data); err != nil {
-				return fmt.Errorf("failed writing audio: %w", err)
-			}
-		} else {
-			videoTimestamp += f.Duration
-			if _, err := w[len(w)-1].Write(f.Data[0]&0x1 == 0, int64(videoTimestamp/time.Millisecond), f.Data); err != nil {
-				return fmt.Errorf("failed writing video: %w", err)
-			}
-		}
+// Updates the video track from a key frame, returning false if the frame cannot
+// be used to start the track
+func applyWebMKeyFrame(track *webm.TrackEntry, codec string, data []byte) bool {
+	width, height, ok := webmKeyFrameSize(codec, data)
+	if !ok {
+		return false
+	}
+	track.Video = &webm.Video{PixelWidth: uint64(width), PixelHeight: uint64(height)}
+	switch codec {
+	case "vp9":
+		info, _ := ParseVP9KeyFrame(data)
+		track.CodecPrivate = vp9CodecPrivate(info)
+	case "av1":
+		seq, _ := FindAV1SequenceHeader(data)
+		track.CodecPrivate = seq.CodecConfig()
 	}
+	return true
 }